@@ -1,9 +1,25 @@
 set -e
+case "$1" in
+--compile)
+    if [ "$2" = /src/code ]; then
+        clang++ -x c++ /src/code -o /build/a.out
+    else
+        cd "$(dirname "$2")"
+        clang++ *.cpp -o /build/a.out
+    fi
+    exit 0
+    ;;
+--exec)
+    exec /build/a.out
+    ;;
+esac
+# runs without a compile phase build into /tmp, as the code directory is not writable
 if [ $# -ne 1 ]; then
     exec cling
+elif [ "$1" = /src/code ]; then
+    clang++ -x c++ "$1" -o /tmp/a.out
+    exec /tmp/a.out
 else
-    mv "$1" code.cpp
-    clang++ code.cpp
-    chmod 700 a.out
-    exec ./a.out
+    clang++ *.cpp -o /tmp/a.out
+    exec /tmp/a.out
 fi
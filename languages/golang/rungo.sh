@@ -1,7 +1,26 @@
 set -e
+# the go tool needs a writable build cache, and only /tmp is writable
+export HOME=/tmp GOCACHE=/tmp/go-build
+case "$1" in
+--compile)
+    if [ "$2" = /src/code ]; then
+        cp /src/code /tmp/code.go
+        go build -o /build/main /tmp/code.go
+    else
+        cd "$(dirname "$2")"
+        go build -o /build/main $(ls *.go | grep -v '_test\.go$')
+    fi
+    exit 0
+    ;;
+--exec)
+    exec /build/main
+    ;;
+esac
 if [ $# -ne 1 ]; then
     exec gore
+elif [ "$1" = /src/code ]; then
+    cp "$1" /tmp/code.go
+    exec go run /tmp/code.go
 else
-    cp "$1" /code.go
-    exec go run /code.go
+    exec go run $(ls *.go | grep -v '_test\.go$')
 fi
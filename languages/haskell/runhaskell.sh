@@ -1,7 +1,26 @@
 set -e
+# ghc keeps its user files under HOME, and its build files under -outputdir
+export HOME=/tmp
+case "$1" in
+--compile)
+    if [ "$2" = /src/code ]; then
+        cp /src/code /tmp/code.hs
+        ghc -o /build/main -outputdir /tmp/ghc /tmp/code.hs
+    else
+        cd "$(dirname "$2")"
+        ghc -o /build/main -outputdir /tmp/ghc "$2"
+    fi
+    exit 0
+    ;;
+--exec)
+    exec /build/main
+    ;;
+esac
 if [ $# -ne 1 ]; then
     exec ghci
+elif [ "$1" = /src/code ]; then
+    cp "$1" /tmp/code.hs
+    exec runghc -- -- /tmp/code.hs
 else
-    mv "$1" /code.hs
-    exec runghc -- -- /code.hs
+    exec runghc -- -- "$1"
 fi
@@ -2,6 +2,5 @@ set -e
 if [ $# -ne 1 ]; then
     exec php -a
 else
-    mv "$1" script.php
-    exec php script.php
+    exec php "$1"
 fi
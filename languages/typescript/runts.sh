@@ -1,9 +1,13 @@
 set -e
+# ts-node writes its compile cache under HOME
+export HOME=/tmp
 if [ $# -ne 1 ]; then
     echo -n 'NodeJS (TS-Node) '
     node --version
     exec ts-node
+elif [ "$1" = /src/code ]; then
+    cp "$1" /tmp/script.ts
+    exec ts-node /tmp/script.ts
 else
-    mv "$1" script.ts
-    exec ts-node script.ts
+    exec ts-node "$1"
 fi
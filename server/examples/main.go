@@ -15,27 +15,56 @@ import (
 	"github.com/alecthomas/chroma/formatters/html"
 	"github.com/alecthomas/chroma/lexers"
 	"github.com/alecthomas/chroma/styles"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 func main() {
 	var esdir string
 	var serve string
+	var loglevel, logformat string
 	flag.StringVar(&esdir, "examples", "/examples", "dir containing examples")
 	flag.StringVar(&serve, "http", ":80", "http server address")
+	flag.StringVar(&loglevel, "log-level", "info", "minimum level of logged messages (debug, info, warning or error)")
+	flag.StringVar(&logformat, "log-format", "json", "log format (json or text)")
 	flag.Parse()
+	err := setupLogging(loglevel, logformat)
+	if err != nil {
+		panic(err)
+	}
 
 	es, err := LoadExampleSet(esdir)
 	if err != nil {
 		panic(err)
 	}
+	logrus.WithField("examples", len(es)).Info("loaded examples")
 
 	http.Handle("/query", es)
 	http.HandleFunc("/highlight", HandleHighlight)
 	http.HandleFunc("/highlight.css", HandleCSS)
+	http.Handle("/metrics", promhttp.Handler())
 
 	panic(http.ListenAndServe(serve, nil))
 }
 
+// setupLogging configures the global logger with a level name (e.g. "info") and a format ("json" or "text").
+func setupLogging(level, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
+	switch format {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
 // Code is a struct containing code with metadata.
 type Code struct {
 	Code     string `json:"code"`
@@ -76,6 +105,8 @@ func HandleHighlight(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(io.LimitReader(r.Body, 1024*1024)).Decode(&c)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("failed to load body: %s", err.Error()), http.StatusInternalServerError)
+		logrus.WithError(err).WithField("language", c.Language).Warn("failed to highlight code")
+		highlightRequests.WithLabelValues("error").Inc()
 		return
 	}
 
@@ -90,13 +121,18 @@ func HandleHighlight(w http.ResponseWriter, r *http.Request) {
 	iter, err := lexer.Tokenise(nil, c.Code)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("failed to tokenize: %s", err.Error()), http.StatusInternalServerError)
+		logrus.WithError(err).WithField("language", c.Language).Warn("failed to highlight code")
+		highlightRequests.WithLabelValues("error").Inc()
 		return
 	}
 	err = form.Format(w, style, iter)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("failed to format: %s", err.Error()), http.StatusInternalServerError)
+		logrus.WithError(err).WithField("language", c.Language).Warn("failed to highlight code")
+		highlightRequests.WithLabelValues("error").Inc()
 		return
 	}
+	highlightRequests.WithLabelValues("ok").Inc()
 }
 
 // HandleCSS handles a request for the example highlight stylesheet.
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// queryDuration tracks the latency of example search queries.
+	queryDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "openrepl",
+		Subsystem: "examples",
+		Name:      "query_duration_seconds",
+		Help:      "Latency of example search queries.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+	})
+
+	// highlightRequests counts highlight requests by result ("ok" or "error").
+	highlightRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "openrepl",
+		Subsystem: "examples",
+		Name:      "highlight_requests_total",
+		Help:      "Number of syntax highlighting requests, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(queryDuration, highlightRequests)
+}
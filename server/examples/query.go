@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // Query is a search query.
@@ -190,5 +191,9 @@ func (es ExampleSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	json.NewEncoder(w).Encode(es.SearchQuery(string(dat)))
+	start := time.Now()
+	res := es.SearchQuery(string(dat))
+	queryDuration.Observe(time.Since(start).Seconds())
+
+	json.NewEncoder(w).Encode(res)
 }
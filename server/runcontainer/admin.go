@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// adminOnly wraps an admin API handler, requiring the AdminToken as a bearer token.
+// If no AdminToken is configured, the admin API is disabled.
+func (cs *ContainerServer) adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cs.AdminToken == "" {
+			http.Error(w, "admin API disabled", http.StatusForbidden)
+			return
+		}
+		tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(cs.AdminToken)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// HandleListSessions serves a list of all running sessions as JSON.
+func (cs *ContainerServer) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cs.Sessions.List())
+}
+
+// HandleInspectSession serves the summary of the session with the ID in the "id" query parameter as JSON.
+func (cs *ContainerServer) HandleInspectSession(w http.ResponseWriter, r *http.Request) {
+	sess := cs.Sessions.Get(r.URL.Query().Get("id"))
+	if sess == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sess.Info())
+}
+
+// HandleTerminateSession forcibly ends the session with the ID in the "id" query parameter.
+func (cs *ContainerServer) HandleTerminateSession(w http.ResponseWriter, r *http.Request) {
+	// only allow POST requests
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	sess := cs.Sessions.Get(r.URL.Query().Get("id"))
+	if sess == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	sess.logger().Info("session terminated by admin")
+	sess.Terminate()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerAdmin registers the admin API handlers on a ServeMux.
+func (cs *ContainerServer) registerAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/sessions", cs.adminOnly(cs.HandleListSessions))
+	mux.HandleFunc("/admin/session", cs.adminOnly(cs.HandleInspectSession))
+	mux.HandleFunc("/admin/terminate", cs.adminOnly(cs.HandleTerminateSession))
+	mux.HandleFunc("/admin/pools", cs.adminOnly(cs.HandlePoolStats))
+}
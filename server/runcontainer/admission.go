@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdmissionLimits is a set of limits on concurrently running containers.
+// A zero value for any limit means that it is unset.
+type AdmissionLimits struct {
+	// MaxContainers is the maximum number of containers running at once across all clients.
+	MaxContainers int
+
+	// MaxPerClient is the maximum number of containers running at once for a single client IP.
+	MaxPerClient int
+
+	// Tokens is a map of API tokens to the maximum number of containers running at once for clients presenting them.
+	// Clients with a known token are limited by their token instead of by their IP.
+	Tokens map[string]int
+
+	// MaxQueue is the maximum number of requests waiting for admission.
+	// Requests over the limits are rejected once the queue is full.
+	MaxQueue int
+
+	// MaxQueuePerClient is the maximum number of requests of a single client waiting for admission.
+	// Requests over the limits are rejected once the client has this many requests queued.
+	MaxQueuePerClient int
+
+	// QueueTimeout is the maximum amount of time for which a request waits in the queue.
+	QueueTimeout time.Duration
+}
+
+var (
+	// errQueueFull is an error indicating that a request was rejected because the admission queue was full.
+	errQueueFull = errors.New("server busy: too many requests waiting")
+
+	// errClientQueueFull is an error indicating that a request was rejected because the client already had too many requests queued.
+	errClientQueueFull = errors.New("server busy: too many of your requests waiting")
+
+	// errQueueTimeout is an error indicating that a request waited in the admission queue for too long.
+	errQueueTimeout = errors.New("server busy: timed out waiting in queue")
+)
+
+// admissionTicket is a request waiting in the admission queue.
+type admissionTicket struct {
+	client string
+	max    int
+
+	// admitted is closed once the request is admitted.
+	admitted chan struct{}
+
+	// moved is signalled when the position of the request in the queue may have changed.
+	moved chan struct{}
+}
+
+// AdmissionController limits the number of concurrently running containers, queueing requests over the limits.
+type AdmissionController struct {
+	// Limits is the set of limits to enforce.
+	Limits AdmissionLimits
+
+	lck     sync.Mutex
+	running int
+	clients map[string]int
+	queue   []*admissionTicket
+}
+
+// queued returns the number of queued requests of a client.
+func (ac *AdmissionController) queued(client string) int {
+	n := 0
+	for _, t := range ac.queue {
+		if t.client == client {
+			n++
+		}
+	}
+	return n
+}
+
+// fits returns whether another container may be admitted for a client.
+func (ac *AdmissionController) fits(client string, max int) bool {
+	if ac.Limits.MaxContainers > 0 && ac.running >= ac.Limits.MaxContainers {
+		return false
+	}
+	if max > 0 && ac.clients[client] >= max {
+		return false
+	}
+	return true
+}
+
+// admit records a running container for a client.
+func (ac *AdmissionController) admit(client string) {
+	if ac.clients == nil {
+		ac.clients = map[string]int{}
+	}
+	ac.running++
+	ac.clients[client]++
+}
+
+// process admits queued requests which fit within the limits, in queue order.
+// The remaining requests are notified that their position may have changed.
+func (ac *AdmissionController) process() {
+	queue := ac.queue[:0]
+	for _, t := range ac.queue {
+		if ac.fits(t.client, t.max) {
+			ac.admit(t.client)
+			close(t.admitted)
+			continue
+		}
+		queue = append(queue, t)
+	}
+	for i := len(queue); i < len(ac.queue); i++ {
+		ac.queue[i] = nil
+	}
+	ac.queue = queue
+
+	for _, t := range ac.queue {
+		select {
+		case t.moved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// position returns the 1-based position of a ticket in the queue, or 0 if it is no longer queued.
+func (ac *AdmissionController) position(t *admissionTicket) int {
+	ac.lck.Lock()
+	defer ac.lck.Unlock()
+	for i, v := range ac.queue {
+		if v == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// cancel removes a ticket from the queue.
+// Returns false if the ticket was already admitted.
+func (ac *AdmissionController) cancel(t *admissionTicket) bool {
+	ac.lck.Lock()
+	defer ac.lck.Unlock()
+	for i, v := range ac.queue {
+		if v == t {
+			ac.queue = append(ac.queue[:i], ac.queue[i+1:]...)
+			ac.process()
+			return true
+		}
+	}
+	return false
+}
+
+// release releases the admission of a container for a client, admitting queued requests.
+func (ac *AdmissionController) release(client string) {
+	ac.lck.Lock()
+	defer ac.lck.Unlock()
+	ac.running--
+	ac.clients[client]--
+	if ac.clients[client] <= 0 {
+		delete(ac.clients, client)
+	}
+	ac.process()
+}
+
+// Acquire waits for admission of a container for a client, with a per-client limit of max.
+// While the request is queued, onQueue (if not nil) is called with its 1-based position in the queue whenever it changes.
+// If onQueue returns an error, the request is removed from the queue and the error is returned.
+// On success, the returned release function must be called once the container has been removed.
+func (ac *AdmissionController) Acquire(ctx context.Context, client string, max int, onQueue func(pos int) error) (release func(), err error) {
+	var once sync.Once
+	release = func() {
+		once.Do(func() { ac.release(client) })
+	}
+
+	// admit immediately if possible
+	ac.lck.Lock()
+	if ac.fits(client, max) {
+		ac.admit(client)
+		ac.lck.Unlock()
+		return release, nil
+	}
+	if ac.Limits.MaxQueue > 0 && len(ac.queue) >= ac.Limits.MaxQueue {
+		ac.lck.Unlock()
+		return nil, errQueueFull
+	}
+	if ac.Limits.MaxQueuePerClient > 0 && ac.queued(client) >= ac.Limits.MaxQueuePerClient {
+		ac.lck.Unlock()
+		return nil, errClientQueueFull
+	}
+
+	// join queue
+	t := &admissionTicket{
+		client:   client,
+		max:      max,
+		admitted: make(chan struct{}),
+		moved:    make(chan struct{}, 1),
+	}
+	ac.queue = append(ac.queue, t)
+	ac.lck.Unlock()
+
+	// apply queue timeout
+	qctx := ctx
+	if ac.Limits.QueueTimeout > 0 {
+		var cancel context.CancelFunc
+		qctx, cancel = context.WithTimeout(ctx, ac.Limits.QueueTimeout)
+		defer cancel()
+	}
+
+	// wait for admission, reporting position changes
+	var lastpos int
+	for {
+		if pos := ac.position(t); pos != 0 && pos != lastpos && onQueue != nil {
+			lastpos = pos
+			err = onQueue(pos)
+			if err != nil {
+				break
+			}
+		}
+		select {
+		case <-t.admitted:
+			return release, nil
+		case <-t.moved:
+			continue
+		case <-qctx.Done():
+			err = qctx.Err()
+			if ctx.Err() == nil {
+				err = errQueueTimeout
+			}
+		}
+		break
+	}
+
+	// leave queue
+	if !ac.cancel(t) {
+		// admitted while leaving
+		release()
+	}
+	return nil, err
+}
+
+// AdmissionStats is a set of statistics about admission control.
+type AdmissionStats struct {
+	// Running is the number of admitted containers.
+	Running int `json:"running"`
+
+	// Queued is the number of requests waiting for admission.
+	Queued int `json:"queued"`
+}
+
+// Stats returns the current admission statistics.
+func (ac *AdmissionController) Stats() AdmissionStats {
+	ac.lck.Lock()
+	defer ac.lck.Unlock()
+	return AdmissionStats{
+		Running: ac.running,
+		Queued:  len(ac.queue),
+	}
+}
+
+// clientIP returns the IP address of the client of a request.
+// If TrustProxy is set, the X-Real-IP header set by the reverse proxy is used.
+func (cs *ContainerServer) clientIP(r *http.Request) string {
+	if cs.TrustProxy {
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientKey identifies the client of a request for admission control, and returns its per-client limit.
+// Clients may present an API token with either a bearer Authorization header or the "apikey" query parameter.
+func (cs *ContainerServer) clientKey(r *http.Request) (string, int) {
+	tok := r.URL.Query().Get("apikey")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		tok = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if tok != "" {
+		if max, ok := cs.Admission.Limits.Tokens[tok]; ok {
+			return "token:" + tok, max
+		}
+	}
+	return "ip:" + cs.clientIP(r), cs.Admission.Limits.MaxPerClient
+}
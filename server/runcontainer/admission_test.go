@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmissionController(t *testing.T) {
+	ac := &AdmissionController{
+		Limits: AdmissionLimits{
+			MaxContainers: 2,
+			MaxPerClient:  1,
+			MaxQueue:      1,
+		},
+	}
+	ctx := context.Background()
+
+	// admit up to the per-client limit
+	releaseA, err := ac.Acquire(ctx, "a", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// queue a second container for the same client
+	posch := make(chan int, 4)
+	type result struct {
+		release func()
+		err     error
+	}
+	resch := make(chan result, 1)
+	go func() {
+		release, err := ac.Acquire(ctx, "a", 1, func(pos int) error {
+			posch <- pos
+			return nil
+		})
+		resch <- result{release, err}
+	}()
+	select {
+	case pos := <-posch:
+		if pos != 1 {
+			t.Errorf("expected queue position 1 but got %d", pos)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not queued")
+	}
+
+	// other clients are admitted while the queue waits on a per-client limit
+	releaseB, err := ac.Acquire(ctx, "b", 1, nil)
+	if err != nil {
+		t.Fatalf("failed to admit another client: %s", err.Error())
+	}
+
+	// requests over the global limit are rejected once the queue is full
+	_, err = ac.Acquire(ctx, "c", 1, nil)
+	if err != errQueueFull {
+		t.Errorf("expected %v but got %v", errQueueFull, err)
+	}
+	if st := ac.Stats(); st.Running != 2 || st.Queued != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	// releasing admits the queued request
+	releaseB()
+	releaseA()
+	releaseA()
+	var res result
+	select {
+	case res = <-resch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued request was not admitted")
+	}
+	if res.err != nil {
+		t.Fatalf("unexpected error: %s", res.err.Error())
+	}
+	res.release()
+	if st := ac.Stats(); st.Running != 0 || st.Queued != 0 {
+		t.Errorf("unexpected stats after release %+v", st)
+	}
+}
+
+func TestAdmissionControllerCancel(t *testing.T) {
+	ac := &AdmissionController{
+		Limits: AdmissionLimits{
+			MaxContainers: 1,
+			MaxQueue:      4,
+			QueueTimeout:  50 * time.Millisecond,
+		},
+	}
+	release, err := ac.Acquire(context.Background(), "a", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// queue timeout
+	_, err = ac.Acquire(context.Background(), "b", 0, nil)
+	if err != errQueueTimeout {
+		t.Errorf("expected %v but got %v", errQueueTimeout, err)
+	}
+
+	// queue update failure
+	errGone := errors.New("client gone")
+	_, err = ac.Acquire(context.Background(), "b", 0, func(int) error { return errGone })
+	if err != errGone {
+		t.Errorf("expected %v but got %v", errGone, err)
+	}
+
+	if st := ac.Stats(); st.Queued != 0 {
+		t.Errorf("cancelled requests were left in the queue: %+v", st)
+	}
+}
+
+func TestAdmissionControllerClientQueue(t *testing.T) {
+	ac := &AdmissionController{
+		Limits: AdmissionLimits{
+			MaxContainers:     1,
+			MaxQueuePerClient: 1,
+		},
+	}
+	release, err := ac.Acquire(context.Background(), "a", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// queue one request for a client
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan struct{})
+	errch := make(chan error, 1)
+	go func() {
+		_, err := ac.Acquire(ctx, "b", 0, func(int) error {
+			close(queued)
+			return nil
+		})
+		errch <- err
+	}()
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not queued")
+	}
+
+	// further requests of the client are rejected, while other clients may still join the unlimited queue
+	_, err = ac.Acquire(context.Background(), "b", 0, nil)
+	if err != errClientQueueFull {
+		t.Errorf("expected %v but got %v", errClientQueueFull, err)
+	}
+	_, err = ac.Acquire(context.Background(), "c", 0, func(int) error { return errors.New("gone") })
+	if err == errClientQueueFull || err == errQueueFull {
+		t.Errorf("another client was rejected: %v", err)
+	}
+
+	cancel()
+	if err := <-errch; err != context.Canceled {
+		t.Errorf("expected %v but got %v", context.Canceled, err)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	cs := &ContainerServer{
+		TrustProxy: true,
+		Admission: AdmissionController{
+			Limits: AdmissionLimits{
+				MaxPerClient: 2,
+				Tokens:       map[string]int{"secret": 10},
+			},
+		},
+	}
+	tbl := []struct {
+		url, auth, realip string
+		key               string
+		max               int
+	}{
+		{url: "/term", key: "ip:192.0.2.1", max: 2},
+		{url: "/term", realip: "198.51.100.7", key: "ip:198.51.100.7", max: 2},
+		{url: "/term?apikey=secret", key: "token:secret", max: 10},
+		{url: "/exec", auth: "Bearer secret", key: "token:secret", max: 10},
+		{url: "/term?apikey=bogus", key: "ip:192.0.2.1", max: 2},
+	}
+	for _, v := range tbl {
+		r := httptest.NewRequest("GET", v.url, nil)
+		if v.auth != "" {
+			r.Header.Set("Authorization", v.auth)
+		}
+		if v.realip != "" {
+			r.Header.Set("X-Real-IP", v.realip)
+		}
+		key, max := cs.clientKey(r)
+		if key != v.key || max != v.max {
+			t.Errorf("expected %q (max %d) for %+v but got %q (max %d)", v.key, v.max, v, key, max)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArtifactLimits is a set of limits on the files collected from the output directory of a run.
+type ArtifactLimits struct {
+	// MaxSize is the maximum total size of collected files.
+	MaxSize int64
+
+	// MaxFiles is the maximum number of collected files.
+	MaxFiles int
+}
+
+// Artifact is a file produced by a run.
+type Artifact struct {
+	// Path is the path of the file, relative to the output directory.
+	Path string `json:"path"`
+
+	// Content is the content of the file, encoded in JSON as base64.
+	Content []byte `json:"content"`
+}
+
+// toArtifacts converts collected files to Artifacts.
+func toArtifacts(files []projectFile) []Artifact {
+	arts := make([]Artifact, len(files))
+	for i, f := range files {
+		arts[i] = Artifact{Path: f.path, Content: f.dat}
+	}
+	return arts
+}
+
+// MakeDir makes a directory in the container world-writable, creating it if it does not exist.
+func (c *Container) MakeDir(ctx context.Context, dir string) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{
+		Name:     "./",
+		Typeflag: tar.TypeDir,
+		Mode:     0777,
+	})
+	if err != nil {
+		return err
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return c.rt.CopyTo(ctx, c.ID, dir, &buf)
+}
+
+// CollectArtifacts copies the regular files in dir out of the container.
+// Files beyond the limits are skipped, in which case truncated is true.
+func (c *Container) CollectArtifacts(ctx context.Context, dir string, lim ArtifactLimits) (files []projectFile, truncated bool, err error) {
+	rc, err := c.rt.CopyFrom(ctx, c.ID, dir)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rc.Close()
+
+	var size int64
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		// strip the name of the output directory
+		name := hdr.Name
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[i+1:]
+		}
+
+		// enforce limits
+		if len(files) >= lim.MaxFiles || size+hdr.Size > lim.MaxSize {
+			truncated = true
+			continue
+		}
+
+		// read file
+		dat, err := ioutil.ReadAll(io.LimitReader(tr, hdr.Size))
+		if err != nil {
+			return nil, false, err
+		}
+		size += int64(len(dat))
+		files = append(files, projectFile{path: name, dat: dat})
+	}
+
+	return files, truncated, nil
+}
+
+// prepareOutput creates the output directory of the container, if one is configured.
+func (cc ContainerConfig) prepareOutput(ctx context.Context, c *Container) error {
+	if cc.OutputDir == "" {
+		return nil
+	}
+	return c.MakeDir(ctx, cc.OutputDir)
+}
+
+// storedArtifacts is an entry in an ArtifactStore.
+type storedArtifacts struct {
+	files   []projectFile
+	size    int64
+	stored  time.Time
+	expires time.Time
+}
+
+// ArtifactStore holds the artifacts of finished run sessions for download.
+type ArtifactStore struct {
+	// TTL is the amount of time for which artifacts are kept.
+	TTL time.Duration
+
+	// MaxSize is the maximum total size of the stored files.
+	// The oldest artifacts are evicted to make room for new ones.
+	// If zero, the total size is unlimited.
+	MaxSize int64
+
+	lck   sync.Mutex
+	items map[string]storedArtifacts
+	size  int64
+}
+
+// remove removes the artifacts stored under a key, if any.
+// It must be called with lck held.
+func (as *ArtifactStore) remove(key string) {
+	if v, ok := as.items[key]; ok {
+		delete(as.items, key)
+		as.size -= v.size
+	}
+}
+
+// removeExpired removes the artifacts which have expired by now.
+// It must be called with lck held.
+func (as *ArtifactStore) removeExpired(now time.Time) {
+	for k, v := range as.items {
+		if now.After(v.expires) {
+			as.remove(k)
+		}
+	}
+}
+
+// removeOldest removes the artifacts which were stored first.
+// It must be called with lck held.
+func (as *ArtifactStore) removeOldest() {
+	var oldest string
+	var t time.Time
+	for k, v := range as.items {
+		if t.IsZero() || v.stored.Before(t) {
+			oldest, t = k, v.stored
+		}
+	}
+	as.remove(oldest)
+}
+
+// Put stores artifacts under a key, removing expired artifacts, and evicting the oldest artifacts if the store would exceed MaxSize.
+// Returns false if the artifacts alone exceed MaxSize, in which case they are not stored.
+func (as *ArtifactStore) Put(key string, files []projectFile) bool {
+	var size int64
+	for _, f := range files {
+		size += int64(len(f.dat))
+	}
+
+	as.lck.Lock()
+	defer as.lck.Unlock()
+	if as.items == nil {
+		as.items = map[string]storedArtifacts{}
+	}
+	if as.MaxSize > 0 && size > as.MaxSize {
+		return false
+	}
+
+	// make room
+	now := time.Now()
+	as.removeExpired(now)
+	as.remove(key)
+	for as.MaxSize > 0 && as.size+size > as.MaxSize {
+		as.removeOldest()
+	}
+
+	as.items[key] = storedArtifacts{
+		files:   files,
+		size:    size,
+		stored:  now,
+		expires: now.Add(as.TTL),
+	}
+	as.size += size
+	return true
+}
+
+// Get looks up the artifacts stored under a key, removing expired artifacts.
+func (as *ArtifactStore) Get(key string) ([]projectFile, bool) {
+	as.lck.Lock()
+	defer as.lck.Unlock()
+	as.removeExpired(time.Now())
+	v, ok := as.items[key]
+	if !ok {
+		return nil, false
+	}
+	return v.files, true
+}
+
+// writeZip writes files to w as a zip archive.
+func writeZip(w io.Writer, files []projectFile) error {
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		fw, err := zw.Create(f.path)
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(f.dat)
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// HandleArtifacts serves the artifacts of a finished run session as an archive.
+// The session is selected with the "token" query parameter.
+// The "format" query parameter selects either a "zip" (default) or "tar" archive.
+func (cs *ContainerServer) HandleArtifacts(w http.ResponseWriter, r *http.Request) {
+	// find artifacts
+	store := cs.SessionConfig.ArtifactStore
+	if store == nil {
+		http.Error(w, "artifacts not supported", http.StatusNotFound)
+		return
+	}
+	files, ok := store.Get(r.URL.Query().Get("token"))
+	if !ok {
+		http.Error(w, "artifacts not found", http.StatusNotFound)
+		return
+	}
+
+	// send archive
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="artifacts.zip"`)
+		writeZip(w, files)
+	case "tar":
+		tr := packTarball(files)
+		defer tr.Close()
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", `attachment; filename="artifacts.tar"`)
+		io.Copy(w, tr)
+	default:
+		http.Error(w, "unsupported archive format", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestArtifactStore(t *testing.T) {
+	as := &ArtifactStore{TTL: time.Hour}
+	files := []projectFile{{path: "plot.png", dat: []byte("png")}}
+	as.Put("a", files)
+	got, ok := as.Get("a")
+	if !ok || len(got) != 1 || got[0].path != "plot.png" {
+		t.Errorf("expected stored artifacts but got %+v (%v)", got, ok)
+	}
+	if _, ok := as.Get("b"); ok {
+		t.Errorf("unexpected artifacts for missing key")
+	}
+
+	// expire artifacts
+	as.TTL = -time.Second
+	as.Put("c", files)
+	if _, ok := as.Get("c"); ok {
+		t.Errorf("unexpected expired artifacts")
+	}
+	as.Put("d", files)
+	if _, ok := as.items["c"]; ok {
+		t.Errorf("expired artifacts were not removed")
+	}
+	as.Get("a")
+	if _, ok := as.items["d"]; ok || as.size != 3 {
+		t.Errorf("expired artifacts were not removed by lookup: %+v", as.items)
+	}
+}
+
+func TestArtifactStoreMaxSize(t *testing.T) {
+	as := &ArtifactStore{TTL: time.Hour, MaxSize: 8}
+	files := []projectFile{{path: "out", dat: []byte("abcd")}}
+
+	// the oldest artifacts are evicted to make room
+	for _, k := range []string{"a", "b", "c"} {
+		if !as.Put(k, files) {
+			t.Fatalf("failed to store %q", k)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := as.Get("a"); ok {
+		t.Errorf("oldest artifacts were not evicted")
+	}
+	for _, k := range []string{"b", "c"} {
+		if _, ok := as.Get(k); !ok {
+			t.Errorf("missing artifacts %q", k)
+		}
+	}
+	if as.size != 8 {
+		t.Errorf("expected total size 8 but got %d", as.size)
+	}
+
+	// artifacts larger than the store are rejected
+	if as.Put("d", []projectFile{{path: "big", dat: make([]byte, 9)}}) {
+		t.Errorf("stored artifacts larger than the store")
+	}
+	if _, ok := as.Get("b"); !ok {
+		t.Errorf("rejected artifacts evicted others")
+	}
+}
+
+func TestWriteZip(t *testing.T) {
+	files := []projectFile{
+		{path: "out.csv", dat: []byte("a,b\n1,2\n")},
+		{path: "plots/plot.svg", dat: []byte("<svg/>")},
+	}
+	var buf bytes.Buffer
+	err := writeZip(&buf, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(files) {
+		t.Fatalf("expected %d files but got %d", len(files), len(zr.File))
+	}
+	for i, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dat, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name != files[i].path || string(dat) != string(files[i].dat) {
+			t.Errorf("expected %s %q but got %s %q", files[i].path, files[i].dat, f.Name, dat)
+		}
+	}
+}
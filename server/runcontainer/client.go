@@ -0,0 +1,509 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sessionClient is a websocket client attached to a ContainerSession.
+type sessionClient struct {
+	// conn is the client websocket connection.
+	conn *websocket.Conn
+
+	// proto is the protocol used to communicate with the client.
+	proto protocol
+
+	// id is the participant ID of the client, assigned when it is added to a session.
+	id string
+
+	// name is the display name of the participant.
+	name string
+
+	// role is the role of the participant.
+	role Role
+
+	// sent is the output offset up to which output has been sent to the client.
+	// It is guarded by the clck of the session.
+	sent int64
+
+	// sendq is the queue of messages waiting to be written by the writer goroutine.
+	sendq sendQueue
+
+	// writedone is closed when the writer goroutine exits.
+	writedone chan struct{}
+
+	// readdone is closed when the input goroutine of the client exits.
+	// It is nil if the input goroutine was not started.
+	readdone chan struct{}
+
+	// pending receives the result of a read started by watchClose, which the next readMessage takes over.
+	// It is nil if no read is pending.
+	pending chan readResult
+
+	// pongch is signalled when the client sends a pong.
+	pongch chan struct{}
+}
+
+// readResult is the result of reading a message from a client.
+type readResult struct {
+	t   int
+	dat []byte
+	err error
+}
+
+// clientWriteTimeout is the time limit for writing a message to a client.
+const clientWriteTimeout = 10 * time.Second
+
+var (
+	// errClientLagging is an error indicating that a client did not keep up with the messages sent to it.
+	errClientLagging = errors.New("client is not keeping up with output")
+
+	// errClientClosed is an error indicating that the connection to a client was closed.
+	errClientClosed = errors.New("client connection closed")
+)
+
+// queuedMessage is a websocket message waiting to be written to a client.
+type queuedMessage struct {
+	t   int
+	dat []byte
+
+	// sent is closed once the message has been written, if not nil.
+	sent chan struct{}
+}
+
+// sendQueue is a queue of messages waiting to be written to a client or container, bounded by the total size of the messages.
+type sendQueue struct {
+	lck  sync.Mutex
+	msgs []queuedMessage
+	size int
+	max  int
+
+	// err is the error which stopped the queue, after which messages are rejected.
+	err error
+
+	// notify is signalled when messages are added or the queue is stopped.
+	notify chan struct{}
+}
+
+// push adds a message to the queue without blocking.
+// A message is always accepted into an empty queue, so that messages larger than the limit can be sent.
+func (q *sendQueue) push(msg queuedMessage) error {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	if q.err != nil {
+		return q.err
+	}
+	if q.max > 0 && len(q.msgs) > 0 && q.size+len(msg.dat) > q.max {
+		return errClientLagging
+	}
+	q.msgs = append(q.msgs, msg)
+	q.size += len(msg.dat)
+	q.signal()
+	return nil
+}
+
+// pop removes all queued messages, or returns the error which stopped the queue.
+func (q *sendQueue) pop() ([]queuedMessage, error) {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	msgs := q.msgs
+	q.msgs, q.size = nil, 0
+	return msgs, q.err
+}
+
+// stop stops the queue with an error, dropping queued messages.
+func (q *sendQueue) stop(err error) {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	if q.err == nil {
+		q.err = err
+	}
+	q.msgs, q.size = nil, 0
+	q.signal()
+}
+
+// signal wakes up the writer goroutine.
+// It must be called with lck held.
+func (q *sendQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// newSessionClient creates a sessionClient for a websocket connection of a participant, using the negotiated protocol.
+// Up to ClientQueueSize bytes of messages are queued for the client before it is disconnected for lagging.
+// The read side of the connection is configured here, as it must not change while a read started by watchClose is pending.
+func newSessionClient(ws *websocket.Conn, role Role, name string, cfg *ContainerSessionConfig) *sessionClient {
+	sc := &sessionClient{
+		conn:      ws,
+		proto:     selectProtocol(ws),
+		role:      role,
+		name:      cleanName(name),
+		sendq:     sendQueue{max: cfg.ClientQueueSize, notify: make(chan struct{}, 1)},
+		writedone: make(chan struct{}),
+		pongch:    make(chan struct{}, 1),
+	}
+	ws.SetReadLimit(cfg.messageLimit())
+	ws.SetPongHandler(func(appData string) error {
+		select {
+		case sc.pongch <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	go sc.runWriter()
+	return sc
+}
+
+// readMessage reads the next message from the client, taking over a read started by watchClose.
+// Only one goroutine may read from the client at a time.
+func (sc *sessionClient) readMessage() (int, []byte, error) {
+	if sc.pending != nil {
+		r := <-sc.pending
+		sc.pending = nil
+		return r.t, r.dat, r.err
+	}
+	return sc.conn.ReadMessage()
+}
+
+// watchClose starts reading the next message from the client in the background, so that a disconnect is noticed while nothing else reads from it.
+// Returns a channel which is closed if the read fails.
+// The result of the read is returned by the next call to readMessage.
+func (sc *sessionClient) watchClose() <-chan struct{} {
+	closech := make(chan struct{})
+	pending := make(chan readResult, 1)
+	sc.pending = pending
+	go func() {
+		t, dat, err := sc.conn.ReadMessage()
+		if err != nil {
+			close(closech)
+		}
+		pending <- readResult{t, dat, err}
+	}()
+	return closech
+}
+
+// runWriter writes queued messages to the client until the queue is stopped or a write fails.
+func (sc *sessionClient) runWriter() {
+	defer close(sc.writedone)
+	for range sc.sendq.notify {
+		msgs, err := sc.sendq.pop()
+		for _, msg := range msgs {
+			sc.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+			werr := sc.conn.WriteMessage(msg.t, msg.dat)
+			if werr != nil {
+				sc.closeConn(werr)
+				return
+			}
+			if msg.sent != nil {
+				close(msg.sent)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeMessage queues a message to be sent to the client.
+// It does not block, and returns an error if the client is disconnected or lagging.
+// It is safe to call concurrently.
+func (sc *sessionClient) writeMessage(t int, dat []byte) error {
+	return sc.sendq.push(queuedMessage{t: t, dat: dat})
+}
+
+// closeConn closes the websocket connection, dropping messages which have not been sent.
+func (sc *sessionClient) closeConn(err error) {
+	sc.sendq.stop(err)
+	sc.conn.Close()
+}
+
+// writeOutput sends container output from the given stream to the client.
+func (sc *sessionClient) writeOutput(stream byte, dat []byte) error {
+	t, frame := sc.proto.encodeOutput(stream, dat)
+	return sc.writeMessage(t, frame)
+}
+
+// writeStatus sends a StatusUpdate to the client.
+func (sc *sessionClient) writeStatus(status StatusUpdate) error {
+	t, dat, err := sc.proto.encodeStatus(status)
+	if err != nil {
+		return err
+	}
+	return sc.writeMessage(t, dat)
+}
+
+// close gracefully closes the websocket after sending queued messages, waiting up to timeout for the client to disconnect.
+func (sc *sessionClient) close(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// attempt to gracefully shutdown websocket
+	sent := make(chan struct{})
+	cerr := sc.sendq.push(queuedMessage{
+		t:    websocket.CloseMessage,
+		dat:  websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		sent: sent,
+	})
+	if cerr == nil {
+		select {
+		case <-sent:
+		case <-sc.writedone:
+			cerr = errClientClosed
+		case <-timer.C:
+			cerr = errClientLagging
+		}
+	}
+	if cerr == nil {
+		donech := sc.readdone
+		if donech == nil {
+			donech = make(chan struct{})
+			go func() {
+				defer close(donech)
+				// drain client messages and wait for disconnect
+				var e error
+				for e == nil {
+					_, _, e = sc.readMessage()
+				}
+			}()
+		}
+		select {
+		case <-donech:
+		case <-timer.C:
+		}
+	}
+
+	// close websocket
+	sc.closeConn(errClientClosed)
+}
+
+// clientError is an error from the I/O goroutines of a client.
+type clientError struct {
+	c   *sessionClient
+	err error
+}
+
+// reportClientError passes an error from a client to RunIO.
+func (cs *ContainerSession) reportClientError(c *sessionClient, err error) {
+	select {
+	case cs.clientch <- clientError{c, err}:
+	case <-cs.donech:
+	}
+}
+
+// runInput copies input from a client to the container.
+func (cs *ContainerSession) runInput(c *sessionClient) {
+	var err error
+	defer func() {
+		close(c.readdone)
+		cs.reportClientError(c, err)
+	}()
+	for err == nil {
+		var t int
+		var dat []byte
+
+		// read next websocket message
+		t, dat, err = c.readMessage()
+		if err != nil {
+			return
+		}
+
+		// handle close sent by client
+		if t == websocket.CloseMessage {
+			return
+		}
+
+		// decode message
+		msg, derr := c.proto.decodeMessage(t, dat)
+		if derr != nil {
+			cs.logger().WithError(derr).Warn("failed to decode client message")
+			continue
+		}
+
+		// handle control messages
+		if msg.control != nil {
+			cerr := cs.handleControl(c, *msg.control)
+			if cerr != nil {
+				cs.logger().WithError(cerr).WithField("control", msg.control.Type).Warn("failed to handle control message")
+			}
+			continue
+		}
+
+		// drop input from viewers
+		if !c.role.canWrite() {
+			continue
+		}
+
+		// queue input behind the stdin payload, so that the client is still read while the container is not reading
+		if cs.inputq.push(queuedMessage{dat: msg.input}) == errClientLagging {
+			cs.logger().Warn("dropped input which the container is not keeping up with")
+		}
+	}
+}
+
+// runPing checks that a client is still alive.
+func (cs *ContainerSession) runPing(c *sessionClient) {
+	// start playing ping-pong
+	go func() {
+		var err error
+		defer func() { cs.reportClientError(c, err) }()
+		tick := time.NewTicker(cs.Config.PingRate)
+		defer tick.Stop()
+		for range tick.C {
+			// send ping
+			err = c.conn.WriteControl(websocket.PingMessage, []byte{1}, time.Now().Add(10*time.Second))
+			if err != nil {
+				return
+			}
+
+			// wait for pong
+			select {
+			case <-c.pongch:
+				// we are good - client sent pong on time
+			case <-tick.C:
+				// timeout while waiting for pong - stalled client
+				err = errors.New("stalled client")
+				return
+			}
+		}
+	}()
+}
+
+// startClient starts the I/O goroutines of a client.
+func (cs *ContainerSession) startClient(c *sessionClient) {
+	c.readdone = make(chan struct{})
+	go cs.runInput(c)
+	cs.runPing(c)
+}
+
+// attach attaches a client to the session.
+// An owner replaces any previously attached owner, while other participants are added alongside the attached clients.
+// The client is sent a "running" status with its token, followed by the output it missed.
+// If c.sent is negative, output is replayed from where the previous owner left off, or from the start of the buffered output for other participants.
+// Returns false if the client was rejected because the session is full.
+func (cs *ContainerSession) attach(c *sessionClient) bool {
+	cs.clck.Lock()
+	defer cs.clck.Unlock()
+
+	if c.role == RoleOwner {
+		// replace old owner
+		if old := cs.owner(); old != nil {
+			cs.lastSent = old.sent
+			cs.removeClient(old)
+			old.closeConn(errClientClosed)
+		}
+		if c.sent < 0 {
+			c.sent = cs.lastSent
+		}
+	} else {
+		// limit the number of participants
+		if max := cs.Config.MaxParticipants; max > 0 && len(cs.clients) >= max {
+			c.writeStatus(StatusUpdate{Status: "error", Error: errSessionFull.Error()})
+			go c.close(cs.Config.ShutdownTimeout)
+			return false
+		}
+		if c.sent < 0 {
+			c.sent = 0
+		}
+	}
+	cs.addClient(c)
+
+	// send status
+	err := c.writeStatus(cs.runningStatus(c))
+	if err != nil {
+		c.closeConn(err)
+		return true
+	}
+
+	// replay missed output
+	for _, v := range cs.replay.since(c.sent) {
+		err = c.writeOutput(v.stream, v.dat)
+		if err != nil {
+			c.closeConn(err)
+			return true
+		}
+	}
+	c.sent = cs.replay.end
+	return true
+}
+
+// detach detaches a client from the session and closes its connection.
+// Returns false if the client was not attached.
+func (cs *ContainerSession) detach(c *sessionClient) bool {
+	cs.clck.Lock()
+	defer cs.clck.Unlock()
+	if !cs.removeClient(c) {
+		return false
+	}
+	if c.role == RoleOwner {
+		cs.lastSent = c.sent
+	}
+	c.closeConn(errClientClosed)
+	return true
+}
+
+// errSessionEnded is an error indicating that a client tried to reattach to a session which has already ended.
+var errSessionEnded = errors.New("session ended")
+
+// Reattach attaches a new client of a participant to a running session.
+// If offset is negative, output is replayed from where the previous owner left off, or from the start of the buffered output for other participants.
+// Otherwise, buffered output after offset bytes is replayed.
+// If an error is returned, the client is left to the caller to close.
+func (cs *ContainerSession) Reattach(c *sessionClient, offset int64) error {
+	cs.init()
+	c.sent = offset
+	select {
+	case cs.attachch <- c:
+		return nil
+	case <-cs.donech:
+		return errSessionEnded
+	}
+}
+
+// HandleReattach reattaches a client to a session after a disconnect, or joins a participant to a session.
+// The session is selected with the "token" query parameter, and the token determines the role of the participant.
+// The owner token is sent to the owner with the "running" status, along with the writer and viewer tokens with which others can join.
+// The client may pass the number of output bytes it received with the "offset" query parameter, and a display name with the "name" query parameter.
+func (cs *ContainerServer) HandleReattach(w http.ResponseWriter, r *http.Request) {
+	// find session
+	sess, role := cs.Sessions.GetByToken(r.URL.Query().Get("token"))
+	if sess == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	// parse output offset
+	offset := int64(-1)
+	if str := r.URL.Query().Get("offset"); str != "" {
+		o, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || o < 0 {
+			http.Error(w, fmt.Sprintf("invalid offset %q", str), http.StatusBadRequest)
+			return
+		}
+		offset = o
+	}
+
+	// upgrade websocket connection, offering the v2 protocol
+	upgrader := cs.SessionConfig.Upgrader
+	upgrader.Subprotocols = append([]string{ProtocolV2}, upgrader.Subprotocols...)
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		sess.logger().WithError(err).Warn("failed to upgrade reattaching client")
+		return
+	}
+
+	// hand off connection to the session
+	c := newSessionClient(ws, role, r.URL.Query().Get("name"), &cs.SessionConfig)
+	err = sess.Reattach(c, offset)
+	if err != nil {
+		c.writeStatus(StatusUpdate{Status: "error", Error: err.Error()})
+		c.close(cs.SessionConfig.ShutdownTimeout)
+	}
+}
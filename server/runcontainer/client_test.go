@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestSendQueue(t *testing.T) {
+	q := sendQueue{max: 4, notify: make(chan struct{}, 1)}
+
+	// a message larger than the limit is accepted into an empty queue
+	if err := q.push(queuedMessage{dat: []byte("hello")}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := q.push(queuedMessage{dat: []byte("a")}); err != errClientLagging {
+		t.Fatalf("expected %v but got %v", errClientLagging, err)
+	}
+
+	// popping makes room
+	msgs, err := q.pop()
+	if err != nil || len(msgs) != 1 || string(msgs[0].dat) != "hello" {
+		t.Fatalf("unexpected messages %v (error %v)", msgs, err)
+	}
+	for _, m := range []string{"ab", "cd"} {
+		if err := q.push(queuedMessage{dat: []byte(m)}); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	if err := q.push(queuedMessage{dat: []byte("e")}); err != errClientLagging {
+		t.Fatalf("expected %v but got %v", errClientLagging, err)
+	}
+
+	// a stopped queue drops messages and rejects new ones
+	q.stop(errClientClosed)
+	if msgs, err := q.pop(); err != errClientClosed || len(msgs) != 0 {
+		t.Errorf("unexpected messages %v (error %v) after stop", msgs, err)
+	}
+	if err := q.push(queuedMessage{dat: []byte("f")}); err != errClientClosed {
+		t.Errorf("expected %v but got %v", errClientClosed, err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// CompileConfig is the configuration of a separate compile phase for runs of a compiled language.
+// Code is compiled in its own container before the run container is started, and the build directory is then copied into the run container.
+type CompileConfig struct {
+	// Command is the command which compiles the code, used in place of the command of the run container.
+	// As in the run command, the argument "/code" is replaced with the entrypoint of a project.
+	Command []string `json:"cmd"`
+
+	// Limits overrides the resource limits of the run container while compiling.
+	Limits ResourceLimits `json:"limits"`
+
+	// Timeout is the time limit for compiling in seconds.
+	// If zero, the server default is used.
+	Timeout float64 `json:"timeout,omitempty"`
+
+	// BuildDir is the directory in which the compiler writes the program, which is copied into the run container.
+	// If empty, nothing is copied.
+	BuildDir string `json:"builddir,omitempty"`
+}
+
+// CompileLimits is a set of limits on the compile phase of runs.
+type CompileLimits struct {
+	// DefaultTimeout is the time limit for compiling used when a language does not set one.
+	DefaultTimeout time.Duration
+
+	// MaxOutputSize is the maximum number of bytes kept from the output of the compiler.
+	MaxOutputSize int
+
+	// MaxBuildSize is the maximum total size of the files copied from the build directory.
+	MaxBuildSize int64
+}
+
+// CompileResult is the result of compiling code.
+type CompileResult struct {
+	// Success is whether the code compiled successfully.
+	Success bool `json:"success"`
+
+	// ExitCode is the exit code of the compiler.
+	ExitCode int `json:"exitCode"`
+
+	// Output is the combined stdout and stderr of the compiler.
+	Output string `json:"output"`
+
+	// Truncated is whether the output exceeded the output size limit.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// TimedOut is whether the compiler was killed for exceeding the time limit.
+	TimedOut bool `json:"timedOut,omitempty"`
+
+	// OOMKilled is whether the compiler was killed for exceeding the memory limit.
+	OOMKilled bool `json:"oomKilled,omitempty"`
+
+	// Duration is the compile time in seconds.
+	Duration float64 `json:"duration"`
+
+	// Diagnostics are the errors and warnings parsed from the output, for languages with a diagnostic parser.
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+}
+
+var (
+	// errCompileFailed is an error indicating that the code of a run did not compile.
+	errCompileFailed = errors.New("compilation failed")
+
+	// errBuildTooLarge is an error indicating that the output of a compiler exceeded the build size limit.
+	errBuildTooLarge = errors.New("build output is too large")
+)
+
+// timeout returns the time limit for compiling.
+func (cc *CompileConfig) timeout(lim CompileLimits) time.Duration {
+	if cc.Timeout > 0 {
+		return time.Duration(cc.Timeout * float64(time.Second))
+	}
+	return lim.DefaultTimeout
+}
+
+// compileContainer returns the configuration of the container which compiles code for cc.
+// It keeps the upload directories of cc, so that they are mounted in the same way.
+func (cc ContainerConfig) compileContainer() ContainerConfig {
+	return ContainerConfig{
+		Image:      cc.Image,
+		Command:    cc.Compile.Command,
+		Entrypoint: cc.Entrypoint,
+		WorkDir:    cc.WorkDir,
+		Limits:     cc.Limits.Override(cc.Compile.Limits),
+		Security:   cc.Security,
+		CodeDir:    cc.CodeDir,
+		Project:    cc.Project,
+		Compile:    cc.Compile,
+	}
+}
+
+// packBuild copies the files in dir out of the container, and packs them into a tarball to be extracted into the same directory in another container.
+// File modes are kept so that compiled programs remain executable, while links and special files are skipped.
+func (c *Container) packBuild(ctx context.Context, dir string, max int64) ([]byte, error) {
+	rc, err := c.rt.CopyFrom(ctx, c.ID, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	// the archive is rooted at the base name of dir
+	base := path.Base(path.Clean(dir))
+
+	var buf bytes.Buffer
+	var size int64
+	tw := tar.NewWriter(&buf)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir:
+		default:
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if !strings.HasPrefix(name, base+"/") {
+			continue
+		}
+		name = strings.TrimPrefix(name, base+"/")
+		if name == ".." || strings.HasPrefix(name, "../") {
+			continue
+		}
+
+		// enforce size limit
+		size += hdr.Size
+		if size > max {
+			return nil, errBuildTooLarge
+		}
+
+		// copy file
+		err = tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     hdr.Mode,
+			Size:     hdr.Size,
+			ModTime:  hdr.ModTime,
+			Typeflag: hdr.Typeflag,
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(tw, tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UploadBuild copies a tarball produced by packBuild into the build directory of the container.
+func (c *Container) UploadBuild(ctx context.Context, dir string, build []byte) error {
+	return c.rt.CopyTo(ctx, c.ID, dir, bytes.NewReader(build))
+}
+
+// compileCode compiles code in a fresh container built from the compile configuration of cc, with the files uploaded to dir.
+// If the code compiles and the language has a build directory, a tarball of the build directory is also returned.
+// Code which fails to compile is not an error, but is reported in the CompileResult.
+func compileCode(ctx context.Context, cc ContainerConfig, sc *ContainerSessionConfig, dir string, files []projectFile) (CompileResult, []byte, error) {
+	start := time.Now()
+
+	// deploy compile container with code
+	startctx, scancel := context.WithTimeout(ctx, sc.StartTimeout)
+	defer scancel()
+	c, err := cc.compileContainer().Deploy(startctx, sc.Runtime, sc.Limits, sc.Security, sc.ContainerStopTimeout, false, func(ctx context.Context, c *Container) error {
+		err := c.UploadFiles(ctx, dir, files)
+		if err != nil {
+			return err
+		}
+		if cc.Compile.BuildDir == "" {
+			return nil
+		}
+		return c.MakeDir(ctx, cc.Compile.BuildDir)
+	})
+	if err != nil {
+		return CompileResult{}, nil, err
+	}
+	defer c.Close()
+	c.CloseWrite()
+
+	// collect output
+	out := &limitedBuffer{max: sc.Compile.MaxOutputSize}
+	outch := make(chan struct{})
+	go func() {
+		defer close(outch)
+		stdcopy.StdCopy(out, out, c)
+	}()
+
+	// wait for compiler to exit
+	status, timedout, err := c.waitTimeout(ctx, cc.Compile.timeout(sc.Compile), sc.ContainerStopTimeout)
+	if err != nil {
+		return CompileResult{}, nil, err
+	}
+	c.waitOutput(outch, sc.ShutdownTimeout)
+	res := CompileResult{
+		Success:   status.Code == 0 && !timedout && !status.OOMKilled,
+		ExitCode:  status.Code,
+		Output:    string(out.buf),
+		Truncated: out.truncated,
+		TimedOut:  timedout,
+		OOMKilled: status.OOMKilled,
+		Duration:  time.Since(start).Seconds(),
+	}
+	res.Diagnostics = parseDiagnostics(cc.Diagnostics, res.Output)
+	observePhase("compile", start)
+	if !res.Success || cc.Compile.BuildDir == "" {
+		return res, nil, nil
+	}
+
+	// collect program
+	bctx, bcancel := context.WithTimeout(ctx, sc.ContainerStopTimeout)
+	defer bcancel()
+	build, err := c.packBuild(bctx, cc.Compile.BuildDir, sc.Compile.MaxBuildSize)
+	if err != nil {
+		return CompileResult{}, nil, err
+	}
+
+	return res, build, nil
+}
+
+// compileBatch compiles a single file of code for a non-interactive run, if the language has a compile phase.
+// If it does not, the CompileResult is nil.
+func compileBatch(ctx context.Context, cc ContainerConfig, sc *ContainerSessionConfig, code []byte) (*CompileResult, []byte, error) {
+	if cc.Compile == nil {
+		return nil, nil, nil
+	}
+	res, build, err := compileCode(ctx, cc, sc, cc.codeDir(), []projectFile{{path: path.Base(codePath), dat: code}})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &res, build, nil
+}
+
+// compile compiles the code of a run session, and returns the build to copy into the run container.
+// The client is sent the "compiling" status, followed by the "diagnostics" status if the compiler reported any, and the "compiled" status with the CompileResult.
+// If the code does not compile, the client is instead sent an "error" status with the CompileResult, and errCompileFailed is returned.
+func (cs *ContainerSession) compile(ctx context.Context, cc ContainerConfig, dir string, files []projectFile) ([]byte, error) {
+	err := cs.UpdateStatus(StatusUpdate{Status: "compiling"})
+	if err != nil {
+		return nil, err
+	}
+
+	res, build, err := compileCode(ctx, cc, cs.Config, dir, files)
+	if err != nil {
+		cs.UpdateStatus(StatusUpdate{Status: "error", Error: err.Error()})
+		return nil, err
+	}
+	if len(res.Diagnostics) > 0 {
+		err = cs.UpdateStatus(StatusUpdate{Status: "diagnostics", Diagnostics: res.Diagnostics})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !res.Success {
+		cs.UpdateStatus(StatusUpdate{Status: "error", Error: errCompileFailed.Error(), Compile: &res})
+		return nil, errCompileFailed
+	}
+
+	err = cs.UpdateStatus(StatusUpdate{Status: "compiled", Compile: &res})
+	if err != nil {
+		return nil, err
+	}
+	return build, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newCompileServer starts a test server with a "compiled" language.
+// Its compiler writes the code to /build/prog, or fails if the code contains "error", and its run command prints the build.
+func newCompileServer() (*ContainerServer, *httptest.Server) {
+	srv, ts := newTestServer(func(stdin io.Reader, stdout io.Writer, files map[string][]byte) int {
+		if build, ok := files["/build/prog"]; ok {
+			stdout.Write(build)
+			return 0
+		}
+		src := string(files["/code"])
+		if dat, ok := files["/src/code"]; ok {
+			src = string(dat)
+		}
+		if strings.Contains(src, "error") {
+			io.WriteString(stdout, "code:1:1: error: bad code\n")
+			return 1
+		}
+		files["/build/prog"] = []byte("compiled " + src)
+		return 0
+	})
+	srv.Containers["compiled"] = Language{
+		RunContainer: ContainerConfig{
+			Image:   "test",
+			Command: []string{"--exec"},
+			Compile: &CompileConfig{
+				Command:  []string{"--compile", "/code"},
+				BuildDir: "/build",
+			},
+			Diagnostics: "gcc",
+		},
+	}
+	srv.SessionConfig.Compile = CompileLimits{
+		DefaultTimeout: time.Second,
+		MaxOutputSize:  1024,
+		MaxBuildSize:   1024,
+	}
+	return srv, ts
+}
+
+func TestContainerSessionCompile(t *testing.T) {
+	_, ts := newCompileServer()
+	defer ts.Close()
+
+	// upload sends code to a new run session
+	upload := func(code string) *websocket.Conn {
+		ws := dialTest(t, ts, "/run", url.Values{"lang": {"compiled"}})
+		expectStatus(t, ws, "starting")
+		expectStatus(t, ws, "ready")
+		err := ws.WriteMessage(websocket.BinaryMessage, append([]byte{frameCode}, code...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectStatus(t, ws, "compiling")
+		return ws
+	}
+
+	// the build is run
+	ws := upload("hi")
+	if su := expectStatus(t, ws, "compiled"); su.Compile == nil || !su.Compile.Success {
+		t.Errorf("unexpected compile result %+v", su.Compile)
+	}
+	expectStatus(t, ws, "uploading")
+	expectStatus(t, ws, "starting")
+	expectStatus(t, ws, "running")
+	expectOutput(t, ws, "compiled hi")
+	expectStatus(t, ws, "exited")
+	ws.Close()
+
+	// compiler errors are reported
+	ws = upload("error")
+	defer ws.Close()
+	diags := expectStatus(t, ws, "diagnostics").Diagnostics
+	if len(diags) != 1 || diags[0] != (Diagnostic{File: "code", Line: 1, Column: 1, Severity: "error", Message: "bad code"}) {
+		t.Errorf("unexpected diagnostics %+v", diags)
+	}
+	su := expectStatus(t, ws, "error")
+	if su.Compile == nil || su.Compile.Success || su.Compile.ExitCode != 1 || su.Compile.Output != "code:1:1: error: bad code\n" {
+		t.Errorf("unexpected compile result %+v", su.Compile)
+	}
+}
+
+func TestContainerSessionRunDiagnostics(t *testing.T) {
+	srv, ts := newTestServer(func(stdin io.Reader, stdout io.Writer, files map[string][]byte) int {
+		io.WriteString(fakeStderr(stdout), "code:2:1: error: from stderr\n")
+		io.WriteString(stdout, "code:1:1: error: from stdout\n")
+		io.WriteString(stdout, strings.Repeat("more output\n", 200))
+		return 1
+	})
+	defer ts.Close()
+
+	// the error is diagnosed even after it has left the replay buffer
+	srv.SessionConfig.ReplayBufferSize = 1024
+	lang := srv.Containers["test"]
+	lang.RunContainer.Diagnostics = "gcc"
+	srv.Containers["test"] = lang
+
+	// run sends code to a new run session and returns the first status after the output
+	run := func(query url.Values) (*websocket.Conn, StatusUpdate) {
+		ws := dialTest(t, ts, "/run", query)
+		expectStatus(t, ws, "starting")
+		expectStatus(t, ws, "ready")
+		err := ws.WriteMessage(websocket.BinaryMessage, append([]byte{frameCode}, "fail"...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectStatus(t, ws, "uploading")
+		expectStatus(t, ws, "starting")
+		expectStatus(t, ws, "running")
+		for {
+			ft, dat := readFrame(t, ws)
+			if ft == frameStdout || ft == frameStderr {
+				continue
+			}
+			var su StatusUpdate
+			err = json.Unmarshal(dat, &su)
+			if err != nil {
+				t.Fatalf("failed to decode status: %s", err.Error())
+			}
+			return ws, su
+		}
+	}
+
+	// only stderr is parsed
+	ws, su := run(url.Values{"lang": {"test"}, "tty": {"false"}})
+	if su.Status != "diagnostics" || len(su.Diagnostics) != 1 || su.Diagnostics[0].Message != "from stderr" {
+		t.Errorf("unexpected status %+v", su)
+	}
+	ws.Close()
+
+	// the output of TTY sessions is not parsed
+	ws, su = run(url.Values{"lang": {"test"}})
+	defer ws.Close()
+	if su.Status != "exited" {
+		t.Errorf("unexpected status %+v", su)
+	}
+}
+
+func TestHandleExecCompile(t *testing.T) {
+	srv, ts := newCompileServer()
+	ts.Close()
+	srv.Exec = ExecConfig{
+		MaxRequestSize: 1 << 20,
+		MaxOutputSize:  1024,
+		DefaultTimeout: time.Second,
+		MaxTimeout:     time.Second,
+	}
+
+	// the hardened profile uploads code and builds into volumes
+	readonly := srv.Containers["compiled"]
+	readonly.RunContainer.CodeDir = "/src"
+	readonly.RunContainer.Security.ReadOnlyRoot = setting(true)
+	srv.Containers["readonly"] = readonly
+
+	tbl := []struct {
+		lang    string
+		code    string
+		success bool
+		stdout  string
+		diags   int
+	}{
+		{"compiled", "hi", true, "compiled hi", 0},
+		{"compiled", "error", false, "", 1},
+		{"readonly", "hi", true, "compiled hi", 0},
+		{"readonly", "error", false, "", 1},
+	}
+	for _, v := range tbl {
+		dat, _ := json.Marshal(ExecRequest{Language: v.lang, Code: v.code})
+		w := httptest.NewRecorder()
+		srv.HandleExec(w, httptest.NewRequest(http.MethodPost, "/exec", bytes.NewReader(dat)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		var res ExecResult
+		err := json.NewDecoder(w.Body).Decode(&res)
+		if err != nil {
+			t.Fatalf("failed to decode result: %s", err.Error())
+		}
+		if res.Compile == nil || res.Compile.Success != v.success || res.Stdout != v.stdout || len(res.Compile.Diagnostics) != v.diags {
+			t.Errorf("unexpected result for %q in %s: %+v (compile %+v)", v.code, v.lang, res, res.Compile)
+		}
+	}
+}
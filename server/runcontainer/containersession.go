@@ -4,15 +4,16 @@ import (
 	"archive/tar"
 	"context"
 	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 )
 
 // ContainerSessionConfig is a configuration for a ContainerSession,
@@ -23,12 +24,18 @@ type ContainerSessionConfig struct {
 	// ShutdownTimeout is the timeout for shutting down a websocket.
 	ShutdownTimeout time.Duration
 
-	// DockerClient is the docker client to use to create containers.
-	DockerClient *client.Client
+	// Runtime is the container runtime used to run containers.
+	Runtime Runtime
 
 	// PingRate is the amount of time to wait between sending pings.
 	PingRate time.Duration
 
+	// Limits is the resource limit policy applied to all containers.
+	Limits LimitPolicy
+
+	// Security is the default security profile applied to all containers.
+	Security SecurityProfile
+
 	// ContainerStopTimeout is the timeout for stopping a container.
 	ContainerStopTimeout time.Duration
 
@@ -38,17 +45,93 @@ type ContainerSessionConfig struct {
 	// SessionTimeout is the timeout for the session if using HandleContainerSession.
 	SessionTimeout time.Duration
 
+	// TimeoutWarning is the amount of time before the session deadline at which the client is warned.
+	// If zero, no warning is sent.
+	TimeoutWarning time.Duration
+
+	// KillGracePeriod is the amount of time to wait after sending SIGTERM to a container before sending SIGKILL.
+	KillGracePeriod time.Duration
+
+	// ReconnectGrace is the amount of time for which a session is kept after the client disconnects, waiting for it to reattach.
+	// If zero, the session ends when the client disconnects.
+	ReconnectGrace time.Duration
+
+	// ReplayBufferSize is the amount of recent output buffered for replay to reattaching clients.
+	ReplayBufferSize int
+
+	// Projects is the set of limits on code uploaded to run sessions.
+	Projects ProjectLimits
+
+	// Artifacts is the set of limits on files collected from the output directory of runs.
+	Artifacts ArtifactLimits
+
+	// ArtifactStore holds the files produced by run sessions for download.
+	// If nil, files are not collected from run sessions.
+	ArtifactStore *ArtifactStore
+
 	// Upgrader is the websocket upgrader to use if using HandleContainerSession.
 	Upgrader websocket.Upgrader
+
+	// RecordingStore is the URL of the recording endpoint of the store service, to which session recordings are uploaded.
+	// If empty, sessions cannot be recorded.
+	RecordingStore string
+
+	// MaxRecordingSize is the maximum size of a session recording.
+	// Events past the limit are dropped.
+	MaxRecordingSize int
+
+	// Compile is the set of limits on the compile phase of runs.
+	Compile CompileLimits
+
+	// MaxParticipants is the maximum number of clients attached to a session at once, including the owner.
+	// If zero, the number of participants is unlimited.
+	MaxParticipants int
+
+	// ClientQueueSize is the maximum number of bytes of messages queued for a client.
+	// Clients which fall further behind are disconnected, and may reattach to catch up from the replay buffer.
+	// If zero, the queue is unbounded.
+	ClientQueueSize int
+
+	// MaxMessageSize is the maximum size of a message from a client, other than the code upload of a run.
+	// If zero, defaultMaxMessageSize is used.
+	MaxMessageSize int64
+
+	// InputQueueSize is the maximum number of bytes of client input queued for the container.
+	// Input is dropped while the container is too far behind reading it.
+	// If zero, the queue is unbounded.
+	InputQueueSize int
+}
+
+// defaultMaxMessageSize is the maximum size of a message from a client if the configuration does not set one.
+const defaultMaxMessageSize = 64 << 10
+
+// messageLimit returns the maximum size of a message from a client.
+func (sc *ContainerSessionConfig) messageLimit() int64 {
+	if sc.MaxMessageSize > 0 {
+		return sc.MaxMessageSize
+	}
+	return defaultMaxMessageSize
 }
 
 // ContainerSession is a terminal session with a container over a websocket.
 type ContainerSession struct {
-	// Container is the container being controlled.
-	Container io.ReadWriteCloser
+	// byte counters, accessed atomically
+	bytesIn, bytesOut uint64
+
+	// ID is the unique ID of the session.
+	ID string
+
+	// Language is the name of the language of the session.
+	Language string
 
-	// Client is the client websocket connection.
-	Client *websocket.Conn
+	// StartTime is the time at which the session started.
+	StartTime time.Time
+
+	// ClientAddr is the remote address of the client.
+	ClientAddr string
+
+	// Container is the container being controlled.
+	Container *Container
 
 	// Config is the configuration of the ContainerSession.
 	Config *ContainerSessionConfig
@@ -59,6 +142,82 @@ type ContainerSession struct {
 	// ContainerConfig is the ContainerConfig to be used to create the container.
 	// Only necessary when using CreateContainer.
 	ContainerConfig ContainerConfig
+
+	// Pool is a pool of pre-created containers to use in CreateContainer.
+	// If nil or empty, CreateContainer deploys a new container.
+	Pool *ContainerPool
+
+	// Cols and Rows are the initial terminal size applied by CreateContainer.
+	// If zero, the terminal size is left at the default.
+	Cols, Rows uint
+
+	// Tty is whether the container runs with a TTY.
+	// Without a TTY, stdout and stderr are sent separately to clients using the v2 protocol.
+	Tty bool
+
+	// Token is the secret token with which the owner can reattach to the session after a disconnect.
+	Token string
+
+	// WriteToken and ViewToken are the secret tokens with which others can join the session as writers or viewers.
+	WriteToken, ViewToken string
+
+	// Recorder records the session if not nil.
+	// The recording is uploaded to Config.RecordingStore when the session ends.
+	Recorder *Recorder
+
+	// stdin is the payload written to the standard input of a run before interactive input.
+	stdin []byte
+
+	// closeStdin is whether standard input is closed once the stdin payload has been written.
+	// Interactive input is dropped afterwards.
+	closeStdin bool
+
+	// cancel cancels the session context, terminating the session.
+	cancel context.CancelFunc
+
+	// clck guards the attached clients and the replay buffer.
+	clck sync.Mutex
+
+	// clients is the list of attached clients, in the order in which they joined.
+	clients []*sessionClient
+
+	// nextParticipant is the last participant ID assigned to a client.
+	nextParticipant int
+
+	// lastSent is the output offset sent to the last detached owner.
+	lastSent int64
+
+	// replay is the buffer of recent output replayed to reattaching clients.
+	replay replayBuffer
+
+	// stderr is the start of the standard error of the container, from which the diagnostics of a failed run are parsed.
+	// It is empty unless the language has a diagnostic parser.
+	stderr limitedBuffer
+
+	initOnce sync.Once
+	attachch chan *sessionClient
+	clientch chan clientError
+	donech   chan struct{}
+
+	// inputq is the queue of client input waiting to be written to the container after the stdin payload.
+	inputq sendQueue
+}
+
+// init initializes the channels used to communicate with RunIO.
+func (cs *ContainerSession) init() {
+	cs.initOnce.Do(func() {
+		cs.attachch = make(chan *sessionClient)
+		cs.clientch = make(chan clientError)
+		cs.donech = make(chan struct{})
+		cs.inputq = sendQueue{max: cs.Config.InputQueueSize, notify: make(chan struct{}, 1)}
+	})
+}
+
+// Attached returns whether the owner is currently attached to the session.
+func (cs *ContainerSession) Attached() bool {
+	cs.clck.Lock()
+	defer cs.clck.Unlock()
+	return cs.owner() != nil
 }
 
 // Close closes the ContainerSession.
@@ -68,34 +227,84 @@ func (cs *ContainerSession) Close() {
 		cs.Container.Close()
 	}
 
-	// attempt to gracefully shutdown websocket
-	cerr := cs.Client.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-	if cerr == nil {
-		donech := make(chan struct{})
-		go func() {
-			defer close(donech)
-			// drain client messages and wait for disconnect
-			var e error
-			for e == nil {
-				_, _, e = cs.Client.ReadMessage()
-			}
-		}()
-		timer := time.NewTimer(cs.Config.ShutdownTimeout)
-		defer timer.Stop()
-		select {
-		case <-donech:
-		case <-timer.C:
+	// close clients
+	cs.clck.Lock()
+	clients := cs.clients
+	cs.clients = nil
+	cs.clck.Unlock()
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *sessionClient) {
+			defer wg.Done()
+			c.close(cs.Config.ShutdownTimeout)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// errExited is an error indicating that the output of the container ended because it exited.
+var errExited = errors.New("container exited")
+
+// writeOutput records container output from the given stream and sends it to the attached clients.
+// Output is queued for each client without blocking. If a client has disconnected or fallen too far behind, its connection is closed, and the output is kept for replay when it reattaches.
+func (cs *ContainerSession) writeOutput(stream byte, dat []byte) error {
+	cs.clck.Lock()
+	defer cs.clck.Unlock()
+
+	// record output
+	cs.replay.write(stream, dat)
+	if stream == frameStderr {
+		cs.stderr.Write(dat)
+	}
+	if cs.Recorder != nil {
+		cs.Recorder.Output(dat)
+	}
+	atomic.AddUint64(&cs.bytesOut, uint64(len(dat)))
+	sessionBytes.WithLabelValues("out").Add(float64(len(dat)))
+
+	// send output to clients
+	for _, c := range cs.clients {
+		err := c.writeOutput(stream, dat)
+		if err != nil {
+			// the input goroutine of the client reports the disconnect
+			c.closeConn(err)
+			continue
 		}
+		c.sent = cs.replay.end
 	}
 
-	// close websocket
-	cs.Client.Close()
+	return nil
+}
+
+// streamWriter is an io.Writer which sends output from a stream to the client.
+type streamWriter struct {
+	cs     *ContainerSession
+	stream byte
+}
+
+func (sw streamWriter) Write(dat []byte) (int, error) {
+	err := sw.cs.writeOutput(sw.stream, dat)
+	if err != nil {
+		return 0, err
+	}
+	return len(dat), nil
 }
 
 // runOutput copies output from the container to the client.
 func (cs *ContainerSession) runOutput(errch chan<- error) {
 	var err error
 	defer func() { errch <- err }()
+
+	// demultiplex output if there is no TTY
+	if !cs.Tty {
+		_, err = stdcopy.StdCopy(streamWriter{cs, frameStdout}, streamWriter{cs, frameStderr}, cs.Container)
+		if err == nil {
+			err = errExited
+		}
+		return
+	}
+
 	buf := make([]byte, cs.Config.OutputBufferSize)
 	for err == nil {
 		var n int
@@ -103,103 +312,274 @@ func (cs *ContainerSession) runOutput(errch chan<- error) {
 		// run read
 		n, err = cs.Container.Read(buf)
 		if err != nil {
+			if err == io.EOF {
+				err = errExited
+			}
 			return
 		}
 
 		// send data to client
-		err = cs.Client.WriteMessage(websocket.TextMessage, buf[:n])
+		err = cs.writeOutput(frameStdout, buf[:n])
 		if err != nil {
 			return
 		}
 	}
 }
 
-// runInput copies input from the client to the container.
-func (cs *ContainerSession) runInput(errch chan<- error) {
-	var err error
-	defer func() { errch <- err }()
-	for err == nil {
-		var t int
-		var r io.Reader
-
-		// get next websocket message reader
-		t, r, err = cs.Client.NextReader()
+// feedStdin writes the stdin payload of a run to the container, followed by the input queued by clients until the input queue is stopped.
+// The container is written to only from here, so that clients are still read while it is not reading its input.
+func (cs *ContainerSession) feedStdin() {
+	open := cs.writePayload()
+	for range cs.inputq.notify {
+		msgs, err := cs.inputq.pop()
+		for _, msg := range msgs {
+			// drop input once stdin is closed
+			if !open {
+				continue
+			}
+			werr := cs.writeInput(msg.dat)
+			if werr != nil {
+				cs.logger().WithError(werr).Warn("failed to write input")
+				open = false
+			}
+		}
 		if err != nil {
 			return
 		}
+	}
+}
 
-		// handle close sent by client
-		if t == websocket.CloseMessage {
-			io.Copy(ioutil.Discard, r)
-			return
-		}
+// writeInput records input and writes it to the container.
+func (cs *ContainerSession) writeInput(dat []byte) error {
+	// record input before the program can read it, as it may exit before the write returns
+	if cs.Recorder != nil {
+		cs.Recorder.Input(dat)
+	}
+
+	n, err := cs.Container.Write(dat)
+	atomic.AddUint64(&cs.bytesIn, uint64(n))
+	sessionBytes.WithLabelValues("in").Add(float64(n))
+	return err
+}
 
-		// copy to container
-		_, err = io.Copy(cs.Container, r)
+// writePayload writes the stdin payload of a run to the container, then closes standard input if requested.
+// Without a TTY, standard input is closed for writing, while with a TTY the terminal EOF character is sent instead.
+// Returns whether standard input is still open for interactive input.
+func (cs *ContainerSession) writePayload() bool {
+	// write payload
+	if len(cs.stdin) > 0 {
+		err := cs.writeInput(cs.stdin)
 		if err != nil {
-			return
+			cs.logger().WithError(err).Warn("failed to write stdin payload")
+			return false
 		}
 	}
+
+	// close stdin
+	if !cs.closeStdin {
+		return true
+	}
+	var err error
+	if cs.Tty {
+		// a partial line is flushed by the first EOF character, so it takes a second one to end the input
+		eof := "\x04"
+		if n := len(cs.stdin); n > 0 && cs.stdin[n-1] != '\n' {
+			eof = "\x04\x04"
+		}
+		_, err = io.WriteString(cs.Container, eof)
+	} else {
+		err = cs.Container.CloseWrite()
+	}
+	if err != nil {
+		cs.logger().WithError(err).Warn("failed to close stdin")
+	}
+	return false
 }
 
-func (cs *ContainerSession) runPing(errch chan<- error) {
-	// record pong messages
-	pongch := make(chan struct{}, 1)
-	cs.Client.SetPongHandler(func(appData string) error {
+// stopContainer stops the container after the session context ends.
+// The container is sent SIGTERM, and then SIGKILL if the output goroutine has not stopped after the grace period.
+// Returns whether an error was received from the output goroutine, and the error.
+func (cs *ContainerSession) stopContainer(errch <-chan error) (bool, error) {
+	for _, sig := range []string{"SIGTERM", "SIGKILL"} {
+		// send signal
+		kctx, cancel := context.WithTimeout(context.Background(), cs.Config.ContainerStopTimeout)
+		err := cs.Container.Kill(kctx, sig)
+		cancel()
+		if err != nil {
+			cs.logger().WithError(err).WithField("signal", sig).Warn("failed to signal container")
+		}
+
+		// wait for the container to stop
+		timer := time.NewTimer(cs.Config.KillGracePeriod)
 		select {
-		case pongch <- struct{}{}:
+		case err = <-errch:
+			timer.Stop()
+			return true, err
+		case <-timer.C:
 		}
-		return nil
-	})
+	}
+	return false, nil
+}
 
-	// start playing ping-pong
-	go func() {
-		var err error
-		defer func() { errch <- err }()
-		tick := time.NewTicker(cs.Config.PingRate)
-		defer tick.Stop()
-		for range tick.C {
-			// send ping
-			err = cs.Client.WriteControl(websocket.PingMessage, []byte{1}, time.Now().Add(10*time.Second))
-			if err != nil {
-				return
-			}
+// errReconnectTimeout is an error indicating that the client did not reattach within the reconnect grace period.
+var errReconnectTimeout = errors.New("client did not reconnect")
 
-			// wait for pong
-			select {
-			case <-pongch:
-				// we are good - client sent pong on time
-			case <-tick.C:
-				// timeout while waiting for pong - stalled client
-				err = errors.New("stalled client")
-				return
-			}
-		}
-	}()
+// isDeliberateClose returns whether a client error is the client deliberately closing the session.
+func isDeliberateClose(err error) bool {
+	return websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived)
 }
 
 // RunIO runs input and output for the session, closing afterwards.
+// When ctx is done, the container is stopped and the session is closed.
+// If ctx has a deadline, the client is warned Config.TimeoutWarning before it.
+// If the owner disconnects without closing the session, the session is kept for Config.ReconnectGrace, during which the owner may reattach.
+// Other participants may join and leave at any time without ending the session.
 func (cs *ContainerSession) RunIO(ctx context.Context) error {
-	errch := make(chan error, 2)
+	cs.init()
+	defer close(cs.donech)
+	defer cs.inputq.stop(errSessionEnded)
+	errch := make(chan error, 1)
+	pending := 1
 
 	// start output
 	go cs.runOutput(errch)
 
-	// start input
-	go cs.runInput(errch)
+	// deliver stdin payload before interactive input
+	go cs.feedStdin()
+
+	// start I/O for the initial clients
+	cs.clck.Lock()
+	clients := append([]*sessionClient(nil), cs.clients...)
+	cs.clck.Unlock()
+	for _, c := range clients {
+		cs.startClient(c)
+	}
+
+	// schedule timeout warning
+	var warnch <-chan time.Time
+	if deadline, ok := ctx.Deadline(); ok && cs.Config.TimeoutWarning > 0 {
+		warn := time.NewTimer(time.Until(deadline.Add(-cs.Config.TimeoutWarning)))
+		defer warn.Stop()
+		warnch = warn.C
+	}
+
+	// wait for error or end of session
+	var err error
+	var grace *time.Timer
+	var gracech <-chan time.Time
+	defer func() {
+		if grace != nil {
+			grace.Stop()
+		}
+	}()
+wait:
+	for {
+		select {
+		case err = <-errch:
+			pending--
+			break wait
+		case ce := <-cs.clientch:
+			// ignore errors from clients which were already replaced
+			if !cs.detach(ce.c) {
+				continue
+			}
+
+			// other participants leave without ending the session
+			if ce.c.role != RoleOwner {
+				cs.logger().WithError(ce.err).WithField("participant", ce.c.id).Info("participant left")
+				cs.broadcastParticipants()
+				continue
+			}
 
-	// start ping-pong
-	cs.runPing(errch)
+			// end the session if the owner closed it or reconnection is disabled
+			if cs.Config.ReconnectGrace <= 0 || isDeliberateClose(ce.err) {
+				err = ce.err
+				break wait
+			}
+
+			// wait for the owner to reconnect
+			cs.logger().WithError(ce.err).Info("client disconnected")
+			cs.broadcastParticipants()
+			if grace == nil {
+				grace = time.NewTimer(cs.Config.ReconnectGrace)
+				gracech = grace.C
+			}
+		case c := <-cs.attachch:
+			if c.role == RoleOwner {
+				// cancel reconnect timeout
+				if grace != nil {
+					grace.Stop()
+					grace, gracech = nil, nil
+				}
+				cs.logger().Info("client reattached")
+			} else {
+				cs.logger().WithFields(logrus.Fields{
+					"role": c.role,
+					"name": c.name,
+				}).Info("participant joined")
+			}
+
+			// add new client
+			if !cs.attach(c) {
+				continue
+			}
+			cs.startClient(c)
+			cs.broadcastParticipants()
+		case <-gracech:
+			err = errReconnectTimeout
+			break wait
+		case <-warnch:
+			warnch = nil
+			werr := cs.UpdateStatus(StatusUpdate{
+				Status:  "warning",
+				Message: fmt.Sprintf("session will time out in %s", cs.Config.TimeoutWarning),
+			})
+			if werr != nil {
+				cs.logger().WithError(werr).Warn("failed to send timeout warning")
+			}
+		case <-ctx.Done():
+			// notify client
+			status := StatusUpdate{Status: "terminated"}
+			if ctx.Err() == context.DeadlineExceeded {
+				status = StatusUpdate{Status: "timeout"}
+			}
+			serr := cs.UpdateStatus(status)
+			if serr != nil {
+				cs.logger().WithError(serr).WithField("status", status.Status).Warn("failed to send status")
+			}
+
+			// stop container
+			var ok bool
+			ok, err = cs.stopContainer(errch)
+			if ok {
+				pending--
+			} else {
+				err = ctx.Err()
+			}
+			break wait
+		}
+	}
+
+	// report exit status if the container exited
+	if err == errExited {
+		err = cs.reportExit(ctx)
+	}
 
-	// wait for error
-	err := <-errch
+	// save recording
+	if cs.Recorder != nil {
+		rerr := cs.saveRecording()
+		if rerr != nil {
+			cs.logger().WithError(rerr).Error("failed to save recording")
+		}
+	}
 
 	// close session
 	cs.Close()
 
-	// ignore second/third error
-	<-errch
-	<-errch
+	// ignore remaining errors
+	for ; pending > 0; pending-- {
+		<-errch
+	}
 
 	return err
 }
@@ -208,15 +588,147 @@ func (cs *ContainerSession) RunIO(ctx context.Context) error {
 type StatusUpdate struct {
 	Status string `json:"status"`
 	Error  string `json:"err,omitempty"`
+
+	// ID is the session ID, sent with the first status update and to the owner with the "running" status.
+	ID string `json:"id,omitempty"`
+
+	// Token is the token with which the client can reattach to the session, sent with the "running" status.
+	// Clients which joined as writers or viewers are sent the token they joined with.
+	Token string `json:"token,omitempty"`
+
+	// Code is the exit code of the container, sent with the "exited" status.
+	Code *int `json:"code,omitempty"`
+
+	// Role is the role of the client in the session, sent with the "running" status.
+	Role Role `json:"role,omitempty"`
+
+	// Participant is the participant ID of the client, sent with the "running" status.
+	Participant string `json:"participant,omitempty"`
+
+	// WriteToken and ViewToken are the tokens with which others can join the session as writers or viewers, sent to the owner with the "running" status.
+	WriteToken string `json:"writeToken,omitempty"`
+	ViewToken  string `json:"viewToken,omitempty"`
+
+	// Compile is the result of compiling the code of a run, sent with the "compiled" status, or with the "error" status if compilation failed.
+	Compile *CompileResult `json:"compile,omitempty"`
+
+	// Diagnostics are the errors parsed from the output of the compiler, or of a run which failed, sent with the "diagnostics" status.
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+
+	// Participants is the list of participants attached to the session, sent with the "participants" status.
+	Participants []ParticipantInfo `json:"participants,omitempty"`
+
+	// Message is a human-readable message, such as the time remaining sent with the "warning" status.
+	Message string `json:"msg,omitempty"`
+
+	// Position is the 1-based position of the session in the admission queue, sent with the "queued" status.
+	Position int `json:"position,omitempty"`
+
+	// Recording is the key with which the recording of the session can be loaded from the store service, sent with the "recorded" status.
+	Recording string `json:"recording,omitempty"`
+
+	// Artifacts is the number of files produced by a run, sent with the "exited" status.
+	// The files may be downloaded using the reattach token.
+	Artifacts int `json:"artifacts,omitempty"`
+
+	// Reason is the reason for the exit of the container, sent with the "exited" status.
+	// One of "success", "error", "signal", "oom" or "timeout".
+	Reason string `json:"reason,omitempty"`
+}
+
+// exitReason classifies the exit of a container.
+func exitReason(status ExitStatus, timedout bool) string {
+	switch {
+	case timedout:
+		return "timeout"
+	case status.OOMKilled:
+		return "oom"
+	case status.Code > 128:
+		return "signal"
+	case status.Code != 0:
+		return "error"
+	default:
+		return "success"
+	}
 }
 
-// UpdateStatus sends a StatusUpdate to the client.
+// reportExit waits for the container to exit and sends its exit status to the client.
+func (cs *ContainerSession) reportExit(ctx context.Context) error {
+	// get exit status
+	wctx, cancel := context.WithTimeout(context.Background(), cs.Config.ContainerStopTimeout)
+	defer cancel()
+	status, err := cs.Container.Wait(wctx)
+	if err != nil {
+		return err
+	}
+
+	// collect files produced by the run
+	var nart int
+	if cs.IsRun && cs.ContainerConfig.OutputDir != "" && cs.Config.ArtifactStore != nil {
+		files, truncated, aerr := cs.Container.CollectArtifacts(wctx, cs.ContainerConfig.OutputDir, cs.Config.Artifacts)
+		if aerr != nil {
+			cs.logger().WithError(aerr).Error("failed to collect artifacts")
+		} else if len(files) > 0 {
+			if truncated {
+				cs.logger().WithField("artifacts", len(files)).Warn("artifacts truncated")
+			}
+			if cs.Config.ArtifactStore.Put(cs.Token, files) {
+				nart = len(files)
+			} else {
+				cs.logger().WithField("artifacts", len(files)).Warn("artifacts too large to store")
+			}
+		}
+	}
+
+	// send diagnostics of failed runs, parsed from stderr
+	// with a TTY, stderr is mixed into stdout, so the output is not parsed
+	if cs.IsRun && !cs.Tty && status.Code != 0 && cs.ContainerConfig.Diagnostics != "" {
+		cs.clck.Lock()
+		out := cs.stderr.buf
+		cs.clck.Unlock()
+		if diags := parseDiagnostics(cs.ContainerConfig.Diagnostics, string(out)); len(diags) > 0 {
+			err = cs.UpdateStatus(StatusUpdate{Status: "diagnostics", Diagnostics: diags})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// send exit status
+	return cs.UpdateStatus(StatusUpdate{
+		Status:    "exited",
+		Code:      &status.Code,
+		Reason:    exitReason(status, ctx.Err() == context.DeadlineExceeded),
+		Artifacts: nart,
+	})
+}
+
+// UpdateStatus sends a StatusUpdate to all attached clients.
+// If no client is attached, the update is dropped.
+// Returns an error if the owner has disconnected or fallen too far behind, while the connections of other participants are closed on failure.
+// It is safe to call concurrently.
 func (cs *ContainerSession) UpdateStatus(status StatusUpdate) error {
-	return cs.Client.WriteJSON(status)
+	cs.clck.Lock()
+	clients := append([]*sessionClient(nil), cs.clients...)
+	cs.clck.Unlock()
+	var err error
+	for _, c := range clients {
+		werr := c.writeStatus(status)
+		if werr == nil {
+			continue
+		}
+		if c.role == RoleOwner {
+			err = werr
+		} else {
+			// the input goroutine of the client reports the disconnect
+			c.closeConn(werr)
+		}
+	}
+	return err
 }
 
-// packCodeTarball generates a tarball containing dat as a file called "code".
-func packCodeTarball(dat []byte) io.ReadCloser {
+// packTarball generates a tarball containing files, with paths relative to the directory which it is extracted into.
+func packTarball(files []projectFile) io.ReadCloser {
 	// create pipe
 	r, w := io.Pipe()
 	go func() {
@@ -239,52 +751,79 @@ func packCodeTarball(dat []byte) io.ReadCloser {
 			}
 		}()
 
-		// write tar header
-		err = tw.WriteHeader(&tar.Header{
-			Name: "code",
-			Mode: 0444,
-			Size: int64(len(dat)),
-		})
-		if err != nil {
-			return
-		}
+		for _, f := range files {
+			// write tar header
+			err = tw.WriteHeader(&tar.Header{
+				Name: f.path,
+				Mode: 0444,
+				Size: int64(len(f.dat)),
+			})
+			if err != nil {
+				return
+			}
 
-		// add file to tarball
-		_, err = tw.Write(dat)
-		if err != nil {
-			return
+			// add file to tarball
+			_, err = tw.Write(f.dat)
+			if err != nil {
+				return
+			}
 		}
 	}()
 	return r
 }
 
-// sendCode sends client code to the container.
-func (cs *ContainerSession) sendCode(ctx context.Context, c *Container) error {
+// receiveCode accepts code from the client.
+// Multi-file projects are accepted if pc is not nil.
+func (cs *ContainerSession) receiveCode(pc *ProjectConfig) (project, error) {
 	// update status to ready
 	err := cs.UpdateStatus(StatusUpdate{Status: "ready"})
 	if err != nil {
-		return err
+		return project{}, err
 	}
 
-	// accept user code
-	t, dat, err := cs.Client.ReadMessage()
+	// accept user code from the owner
+	cs.clck.Lock()
+	cl := cs.owner()
+	cs.clck.Unlock()
+	if cl == nil {
+		return project{}, errors.New("client disconnected")
+	}
+	lim := cs.Config.Projects
+	if lim.MaxUploadSize > 0 && cl.pending == nil {
+		// a reattached owner was not set up for the upload
+		cl.conn.SetReadLimit(lim.MaxUploadSize)
+	}
+	t, msg, err := cl.readMessage()
 	if err != nil {
-		return err
+		return project{}, err
 	}
-	if t != websocket.BinaryMessage && t != websocket.TextMessage {
-		return err
+	cl.conn.SetReadLimit(cs.Config.messageLimit())
+	dat, err := cl.proto.decodeCode(t, msg)
+	if err != nil {
+		cs.UpdateStatus(StatusUpdate{Status: "error", Error: err.Error()})
+		return project{}, err
 	}
 
+	// decode upload
+	proj, err := parseUpload(dat, pc, lim)
+	if err != nil {
+		cs.UpdateStatus(StatusUpdate{Status: "error", Error: err.Error()})
+		return project{}, err
+	}
+
+	return proj, nil
+}
+
+// sendCode sends client code to the container.
+func (cs *ContainerSession) sendCode(ctx context.Context, c *Container, dir string, files []projectFile) error {
 	// update status to uploading
-	err = cs.UpdateStatus(StatusUpdate{Status: "uploading"})
+	err := cs.UpdateStatus(StatusUpdate{Status: "uploading"})
 	if err != nil {
 		return err
 	}
 
 	// send code to Docker
-	tr := packCodeTarball(dat)
-	err = c.cli.CopyToContainer(ctx, c.ID, "/", tr, types.CopyToContainerOptions{})
-	tr.Close()
+	err = c.UploadFiles(ctx, dir, files)
 	if err != nil {
 		cs.UpdateStatus(StatusUpdate{Status: "error", Error: err.Error()})
 		return err
@@ -301,69 +840,272 @@ func (cs *ContainerSession) sendCode(ctx context.Context, c *Container) error {
 
 // CreateContainer creates and starts a container.
 func (cs *ContainerSession) CreateContainer(ctx context.Context) error {
+	cc := cs.ContainerConfig
+	pool := cs.Pool
+
 	// select prestart hook
 	var prestart func(context.Context, *Container) error
 	if cs.IsRun {
-		prestart = cs.sendCode
+		// receive code before creating the container, as projects change the container command
+		proj, err := cs.receiveCode(cc.Project)
+		if err != nil {
+			return err
+		}
+		cs.stdin, cs.closeStdin = proj.stdin, proj.closeStdin
+		dir := cc.codeDir()
+		if !proj.single {
+			cc = cc.forProject(proj.entry)
+			dir = cc.Project.Dir
+
+			// pooled containers run single files
+			pool = nil
+		}
+
+		// compile code in a separate container
+		var build []byte
+		if cc.Compile != nil {
+			build, err = cs.compile(ctx, cc, dir, proj.files)
+			if err != nil {
+				return err
+			}
+		}
+
+		prestart = func(ctx context.Context, c *Container) error {
+			err := cs.sendCode(ctx, c, dir, proj.files)
+			if err != nil {
+				return err
+			}
+			if build != nil {
+				err = c.UploadBuild(ctx, cc.Compile.BuildDir, build)
+				if err != nil {
+					return err
+				}
+			}
+			return cc.prepareOutput(ctx, c)
+		}
 	}
 
-	// deploy container
-	c, err := cs.ContainerConfig.Deploy(ctx, cs.Config.DockerClient, cs.Config.ContainerStopTimeout, prestart)
-	if err != nil {
-		return err
+	// use a pooled container if available
+	var c *Container
+	if pool != nil && cs.Tty {
+		c = pool.Get()
+	}
+	if c != nil {
+		err := c.Start(ctx, prestart)
+		if err != nil {
+			return err
+		}
+	} else {
+		// deploy container
+		var err error
+		c, err = cc.Deploy(ctx, cs.Config.Runtime, cs.Config.Limits, cs.Config.Security, cs.Config.ContainerStopTimeout, cs.Tty, prestart)
+		if err != nil {
+			return err
+		}
 	}
 
 	// save container for I/O
 	cs.Container = c
 
+	// set initial terminal size
+	if cs.Tty && cs.Cols != 0 && cs.Rows != 0 {
+		err := c.Resize(ctx, cs.Cols, cs.Rows)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-// HandleContainerSession processes a container session.
-func HandleContainerSession(w http.ResponseWriter, r *http.Request, isrun bool, cc ContainerConfig, sc *ContainerSessionConfig) {
-	// upgrade websocket connection
-	ws, err := sc.Upgrader.Upgrade(w, r, nil)
+// HandleContainerSession processes a container session for a language.
+// Clients may request the v2 protocol with the ProtocolV2 websocket subprotocol.
+// Clients using the v2 protocol may request a container without a TTY using the query parameter "tty=false".
+// Clients may request a recording of the session using the query parameter "record=true".
+func (cs *ContainerServer) HandleContainerSession(w http.ResponseWriter, r *http.Request, lang string, isrun bool) {
+	// get language
+	l, ok := cs.Containers[lang]
+	if !ok {
+		http.Error(w, "language not supported", http.StatusBadRequest)
+		return
+	}
+	cc := l.TermContainer
+	if isrun {
+		cc = l.RunContainer
+	}
+	sc := &cs.SessionConfig
+
+	// reject sessions while shutting down
+	if !cs.drain.enter() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer cs.drain.leave()
+	stopch, killch := cs.drain.channels()
+
+	// generate session ID
+	id, err := newSessionID()
 	if err != nil {
-		log.Printf("failed to upgrade: %s", err.Error())
+		http.Error(w, fmt.Sprintf("failed to generate session ID: %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
 
+	// generate tokens for the owner to reattach and for others to join as writers or viewers
+	var tokens [3]string
+	for i := range tokens {
+		tokens[i], err = newSessionID()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to generate session token: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// get initial terminal size
+	cols, rows, err := parseTermSize(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid terminal size: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// check whether recording is requested
+	record := r.URL.Query().Get("record") == "true"
+	if record && sc.RecordingStore == "" {
+		http.Error(w, "recording is not enabled", http.StatusBadRequest)
+		return
+	}
+
+	// upgrade websocket connection, offering the v2 protocol
+	upgrader := sc.Upgrader
+	upgrader.Subprotocols = append([]string{ProtocolV2}, upgrader.Subprotocols...)
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"session":  id,
+			"language": lang,
+			"mode":     sessionMode(isrun),
+		}).Warn("failed to upgrade")
+		errorsTotal.WithLabelValues("upgrade").Inc()
+		return
+	}
+	client := newSessionClient(ws, RoleOwner, r.URL.Query().Get("name"), sc)
+	if isrun && sc.Projects.MaxUploadSize > 0 {
+		// the first message of a run is the upload, which receiveCode reads
+		ws.SetReadLimit(sc.Projects.MaxUploadSize)
+	}
+	sessionsTotal.WithLabelValues(lang, sessionMode(isrun)).Inc()
+
+	// the raw protocol cannot separate stdout and stderr, so it always uses a TTY
+	_, israw := client.proto.(rawProtocol)
+	tty := israw || r.URL.Query().Get("tty") != "false"
+
 	// create ContainerSession
-	cs := &ContainerSession{
-		Client:          ws,
+	sess := &ContainerSession{
+		ID:              id,
+		Language:        lang,
+		StartTime:       time.Now(),
+		ClientAddr:      r.RemoteAddr,
+		Token:           tokens[0],
+		WriteToken:      tokens[1],
+		ViewToken:       tokens[2],
 		Config:          sc,
 		IsRun:           isrun,
 		ContainerConfig: cc,
+		Pool:            cs.pools[poolKey(lang, isrun)],
+		Cols:            cols,
+		Rows:            rows,
+		Tty:             tty,
+		replay:          replayBuffer{max: sc.ReplayBufferSize},
 	}
-	defer cs.Close()
+	sess.addClient(client)
+	if isrun && cc.Diagnostics != "" {
+		sess.stderr.max = maxDiagnosticOutput
+	}
+	if record {
+		sess.Recorder = newRecorder(fmt.Sprintf("%s %s", lang, sessionMode(isrun)), cols, rows, sc.MaxRecordingSize)
+	}
+	defer sess.Close()
 
-	// set status to "starting"
-	err = cs.UpdateStatus(StatusUpdate{Status: "starting"})
+	// wait for admission, reporting the queue position
+	// the client is read in the background so that the wait ends if it disconnects
+	key, max := cs.clientKey(r)
+	gonech := client.watchClose()
+	qctx, qcancel := cancelOn(context.Background(), stopch)
+	qctx, gcancel := cancelOn(qctx, gonech)
+	release, err := cs.Admission.Acquire(qctx, key, max, func(pos int) error {
+		return sess.UpdateStatus(StatusUpdate{Status: "queued", ID: id, Position: pos})
+	})
+	gcancel()
+	qcancel()
+	if err == context.Canceled {
+		select {
+		case <-gonech:
+			return
+		default:
+			err = errShuttingDown
+		}
+	}
 	if err != nil {
+		sess.UpdateStatus(StatusUpdate{Status: "error", Error: err.Error()})
+		errorsTotal.WithLabelValues("admission").Inc()
 		return
 	}
+	defer release()
 
-	// start container
-	startctx, scancel := context.WithTimeout(context.Background(), sc.StartTimeout)
+	// set status to "starting", passing the session ID
+	err = sess.UpdateStatus(StatusUpdate{Status: "starting", ID: id})
+	if err != nil {
+		return
+	}
+
+	// start container, allowing extra time to compile code
+	killctx, kcancel := cancelOn(context.Background(), killch)
+	defer kcancel()
+	timeout := sc.StartTimeout
+	if isrun && cc.Compile != nil {
+		timeout += sc.StartTimeout + cc.Compile.timeout(sc.Compile)
+	}
+	startctx, scancel := context.WithTimeout(killctx, timeout)
 	defer scancel()
-	err = cs.CreateContainer(startctx)
+	err = sess.CreateContainer(startctx)
+	if err == errCompileFailed {
+		sess.logger().Info("compilation failed")
+		return
+	}
 	if err != nil {
-		cs.UpdateStatus(StatusUpdate{Status: "error", Error: err.Error()})
-		log.Printf("failed to start: %s", err.Error())
+		sess.UpdateStatus(StatusUpdate{Status: "error", Error: err.Error()})
+		sess.logger().WithError(err).Error("failed to start session")
+		errorsTotal.WithLabelValues("start").Inc()
 		return
 	}
 
-	// set status to "running"
-	err = cs.UpdateStatus(StatusUpdate{Status: "running"})
+	// register session
+	sessctx, cancel := context.WithTimeout(killctx, sc.SessionTimeout)
+	defer cancel()
+	sess.cancel = cancel
+	cs.Sessions.Add(sess)
+	defer cs.Sessions.Remove(id)
+
+	// set status to "running", passing the reattach token
+	err = sess.UpdateStatus(sess.runningStatus(client))
 	if err != nil {
 		return
 	}
+	sess.logger().WithField("client", sess.ClientAddr).Info("session started")
+
+	// warn the client if the server started shutting down while the session was starting
+	if warning, ok := cs.drain.warning(); ok {
+		sess.UpdateStatus(warning)
+	}
 
 	// run session IO
-	sessctx, cancel := context.WithTimeout(context.Background(), sc.SessionTimeout)
-	defer cancel()
-	err = cs.RunIO(sessctx)
+	err = sess.RunIO(sessctx)
 	if err != nil {
-		log.Printf("I/O stopped with error: %s", err.Error())
+		sess.logger().WithError(err).Warn("session I/O stopped with error")
+		errorsTotal.WithLabelValues("io").Inc()
 	}
+	sess.logger().WithFields(logrus.Fields{
+		"duration": time.Since(sess.StartTime).Seconds(),
+		"bytesIn":  atomic.LoadUint64(&sess.bytesIn),
+		"bytesOut": atomic.LoadUint64(&sess.bytesOut),
+	}).Info("session ended")
 }
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer starts a ContainerServer serving a "test" language, which runs prog in a fakeRuntime.
+func newTestServer(prog fakeProgram) (*ContainerServer, *httptest.Server) {
+	srv := &ContainerServer{
+		Containers: map[string]Language{
+			"test": {
+				RunContainer:  ContainerConfig{Image: "test", Command: []string{"/code"}},
+				TermContainer: ContainerConfig{Image: "test"},
+			},
+		},
+		SessionConfig: ContainerSessionConfig{
+			OutputBufferSize:     1024,
+			ShutdownTimeout:      time.Second,
+			Runtime:              &fakeRuntime{program: prog},
+			PingRate:             time.Minute,
+			ContainerStopTimeout: time.Second,
+			StartTimeout:         time.Second,
+			SessionTimeout:       time.Minute,
+			KillGracePeriod:      100 * time.Millisecond,
+			ReconnectGrace:       5 * time.Second,
+			ReplayBufferSize:     1024,
+			Projects: ProjectLimits{
+				MaxSize:  1024,
+				MaxFiles: 4,
+			},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/term", srv.HandleTerminal)
+	mux.HandleFunc("/run", srv.HandleRun)
+	mux.HandleFunc("/attach", srv.HandleReattach)
+	return srv, httptest.NewServer(mux)
+}
+
+// dialTest connects to a test server using the v2 protocol.
+func dialTest(t *testing.T, ts *httptest.Server, path string, query url.Values) *websocket.Conn {
+	u := "ws" + strings.TrimPrefix(ts.URL, "http") + path + "?" + query.Encode()
+	d := websocket.Dialer{Subprotocols: []string{ProtocolV2}}
+	ws, _, err := d.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %s", u, err.Error())
+	}
+	return ws
+}
+
+// readFrame reads a v2 frame from the server.
+func readFrame(t *testing.T, ws *websocket.Conn) (byte, []byte) {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, dat, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read frame: %s", err.Error())
+	}
+	if len(dat) == 0 {
+		t.Fatalf("empty frame")
+	}
+	return dat[0], dat[1:]
+}
+
+// expectStatus reads a status or exit frame and checks its status.
+func expectStatus(t *testing.T, ws *websocket.Conn, status string) StatusUpdate {
+	ft, dat := readFrame(t, ws)
+	if ft != frameStatus && ft != frameExit {
+		t.Fatalf("expected %q status but got frame %d: %q", status, ft, dat)
+	}
+	var su StatusUpdate
+	err := json.Unmarshal(dat, &su)
+	if err != nil {
+		t.Fatalf("failed to decode status: %s", err.Error())
+	}
+	if su.Status != status {
+		t.Fatalf("expected %q status but got %+v", status, su)
+	}
+	return su
+}
+
+// expectOutput reads stdout frames until the expected output has been received.
+func expectOutput(t *testing.T, ws *websocket.Conn, expect string) {
+	var out string
+	for len(out) < len(expect) {
+		ft, dat := readFrame(t, ws)
+		if ft != frameStdout {
+			t.Fatalf("expected output %q but got frame %d: %q", expect, ft, dat)
+		}
+		out += string(dat)
+	}
+	if out != expect {
+		t.Fatalf("expected output %q but got %q", expect, out)
+	}
+}
+
+// sendInput sends a stdin frame.
+func sendInput(t *testing.T, ws *websocket.Conn, dat string) {
+	err := ws.WriteMessage(websocket.BinaryMessage, append([]byte{frameStdin}, dat...))
+	if err != nil {
+		t.Fatalf("failed to send input: %s", err.Error())
+	}
+}
+
+// echoProgram echoes lines of input until stdin is closed.
+func echoProgram(stdin io.Reader, stdout io.Writer, files map[string][]byte) int {
+	br := bufio.NewReader(stdin)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return 0
+		}
+		_, err = io.WriteString(stdout, line)
+		if err != nil {
+			return 1
+		}
+	}
+}
+
+func TestContainerSessionTerm(t *testing.T) {
+	_, ts := newTestServer(func(stdin io.Reader, stdout io.Writer, files map[string][]byte) int {
+		line, _ := bufio.NewReader(stdin).ReadString('\n')
+		io.WriteString(stdout, "echo: "+line)
+		return 3
+	})
+	defer ts.Close()
+
+	ws := dialTest(t, ts, "/term", url.Values{"lang": {"test"}})
+	defer ws.Close()
+	if su := expectStatus(t, ws, "starting"); su.ID == "" {
+		t.Errorf("missing session ID")
+	}
+	if su := expectStatus(t, ws, "running"); su.Token == "" {
+		t.Errorf("missing reattach token")
+	}
+	sendInput(t, ws, "hello\n")
+	expectOutput(t, ws, "echo: hello\n")
+	su := expectStatus(t, ws, "exited")
+	if su.Code == nil || *su.Code != 3 || su.Reason != "error" {
+		t.Errorf("unexpected exit status %+v", su)
+	}
+}
+
+func TestContainerSessionMessageLimit(t *testing.T) {
+	srv, ts := newTestServer(echoProgram)
+	defer ts.Close()
+	srv.SessionConfig.MaxMessageSize = 16
+
+	ws := dialTest(t, ts, "/term", url.Values{"lang": {"test"}})
+	defer ws.Close()
+	expectStatus(t, ws, "starting")
+	expectStatus(t, ws, "running")
+	sendInput(t, ws, "a\n")
+	expectOutput(t, ws, "a\n")
+
+	// an oversized message disconnects the client
+	sendInput(t, ws, strings.Repeat("b", 32)+"\n")
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		ft, dat, err := ws.ReadMessage()
+		if err == nil {
+			if ft == websocket.BinaryMessage && len(dat) > 0 && dat[0] == frameStdout {
+				t.Fatalf("unexpected output %q", dat[1:])
+			}
+			continue
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("client was not disconnected")
+		}
+		break
+	}
+}
+
+func TestContainerSessionQueueDisconnect(t *testing.T) {
+	srv, ts := newTestServer(echoProgram)
+	defer ts.Close()
+	srv.Admission.Limits = AdmissionLimits{MaxContainers: 1, MaxQueue: 4}
+
+	ws := dialTest(t, ts, "/term", url.Values{"lang": {"test"}})
+	defer ws.Close()
+	expectStatus(t, ws, "starting")
+	expectStatus(t, ws, "running")
+
+	// a queued client which disconnects leaves the queue
+	qws := dialTest(t, ts, "/term", url.Values{"lang": {"test"}})
+	expectStatus(t, qws, "queued")
+	qws.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Admission.Stats().Queued != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("disconnected client was left in the queue")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the running session is unaffected
+	sendInput(t, ws, "a\n")
+	expectOutput(t, ws, "a\n")
+}
+
+func TestContainerSessionRun(t *testing.T) {
+	_, ts := newTestServer(func(stdin io.Reader, stdout io.Writer, files map[string][]byte) int {
+		stdout.Write(files["/code"])
+		return 0
+	})
+	defer ts.Close()
+
+	ws := dialTest(t, ts, "/run", url.Values{"lang": {"test"}})
+	defer ws.Close()
+	expectStatus(t, ws, "starting")
+	expectStatus(t, ws, "ready")
+	err := ws.WriteMessage(websocket.BinaryMessage, append([]byte{frameCode}, "print('hi')"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, ws, "uploading")
+	expectStatus(t, ws, "starting")
+	expectStatus(t, ws, "running")
+	expectOutput(t, ws, "print('hi')")
+	su := expectStatus(t, ws, "exited")
+	if su.Code == nil || *su.Code != 0 || su.Reason != "success" {
+		t.Errorf("unexpected exit status %+v", su)
+	}
+}
+
+func TestContainerSessionStdin(t *testing.T) {
+	_, ts := newTestServer(echoProgram)
+	defer ts.Close()
+
+	// startRun starts a run session and uploads code with a stdin payload.
+	startRun := func(query url.Values, upload string) *websocket.Conn {
+		ws := dialTest(t, ts, "/run", query)
+		expectStatus(t, ws, "starting")
+		expectStatus(t, ws, "ready")
+		err := ws.WriteMessage(websocket.BinaryMessage, append([]byte{frameCode}, upload...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectStatus(t, ws, "uploading")
+		expectStatus(t, ws, "starting")
+		expectStatus(t, ws, "running")
+		return ws
+	}
+
+	// the payload is followed by interactive input
+	ws := startRun(url.Values{"lang": {"test"}}, `{"code":"echo","stdin":"a\n"}`)
+	expectOutput(t, ws, "a\n")
+	sendInput(t, ws, "b\n")
+	expectOutput(t, ws, "b\n")
+	ws.Close()
+
+	// stdin is closed after the payload
+	ws = startRun(url.Values{"lang": {"test"}, "tty": {"false"}}, `{"code":"echo","stdin":"a\nb\n","closeStdin":true}`)
+	defer ws.Close()
+	sendInput(t, ws, "c\n")
+	expectOutput(t, ws, "a\nb\n")
+	su := expectStatus(t, ws, "exited")
+	if su.Code == nil || *su.Code != 0 || su.Reason != "success" {
+		t.Errorf("unexpected exit status %+v", su)
+	}
+}
+
+func TestContainerSessionSlowStdin(t *testing.T) {
+	srv, ts := newTestServer(func(stdin io.Reader, stdout io.Writer, files map[string][]byte) int {
+		time.Sleep(300 * time.Millisecond)
+		return echoProgram(stdin, stdout, files)
+	})
+	defer ts.Close()
+	srv.SessionConfig.PingRate = 20 * time.Millisecond
+
+	// the client keeps answering pings while its input waits behind the payload
+	ws := dialTest(t, ts, "/run", url.Values{"lang": {"test"}})
+	defer ws.Close()
+	expectStatus(t, ws, "starting")
+	expectStatus(t, ws, "ready")
+	err := ws.WriteMessage(websocket.BinaryMessage, append([]byte{frameCode}, `{"code":"echo","stdin":"a\n"}`...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, ws, "uploading")
+	expectStatus(t, ws, "starting")
+	expectStatus(t, ws, "running")
+	sendInput(t, ws, "b\n")
+	expectOutput(t, ws, "a\nb\n")
+}
+
+func TestContainerSessionReattach(t *testing.T) {
+	srv, ts := newTestServer(echoProgram)
+	defer ts.Close()
+
+	// start session
+	ws := dialTest(t, ts, "/term", url.Values{"lang": {"test"}})
+	expectStatus(t, ws, "starting")
+	token := expectStatus(t, ws, "running").Token
+	sendInput(t, ws, "a\n")
+	expectOutput(t, ws, "a\n")
+
+	// drop connection
+	ws.UnderlyingConn().Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		infos := srv.Sessions.List()
+		if len(infos) != 1 {
+			t.Fatalf("expected session to survive disconnect")
+		}
+		if !infos[0].Attached {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session did not notice disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// reattach and replay output
+	ws = dialTest(t, ts, "/attach", url.Values{"token": {token}, "offset": {"0"}})
+	defer ws.Close()
+	expectStatus(t, ws, "running")
+	expectOutput(t, ws, "a\n")
+	expectStatus(t, ws, "participants")
+	sendInput(t, ws, "b\n")
+	expectOutput(t, ws, "b\n")
+
+	// a bad token is rejected
+	u := ts.URL + "/attach?token=bad"
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d for bad token but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
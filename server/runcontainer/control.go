@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// maxTermSize is the maximum number of rows or columns of a terminal.
+const maxTermSize = 1000
+
+// ControlMessage is a control message sent by the client.
+// In the raw protocol, control messages are sent as JSON in binary websocket messages, while input is sent in text messages.
+// In the v2 protocol, control messages are sent in resize and signal frames.
+type ControlMessage struct {
+	// Type is the type of the control message.
+	// Either "resize" or "signal".
+	Type string `json:"type"`
+
+	// Cols is the number of columns of the client terminal, sent with "resize".
+	Cols uint `json:"cols,omitempty"`
+
+	// Rows is the number of rows of the client terminal, sent with "resize".
+	Rows uint `json:"rows,omitempty"`
+
+	// Signal is the name of the signal to send to the program, sent with "signal".
+	// One of "SIGINT", "SIGTERM" or "SIGKILL".
+	Signal string `json:"signal,omitempty"`
+}
+
+// parseControlMessage attempts to parse a control message from a binary websocket message.
+// Binary messages which are not control messages are treated as input, so older clients sending binary input continue to work.
+func parseControlMessage(dat []byte) (ControlMessage, bool) {
+	var cm ControlMessage
+	err := json.Unmarshal(dat, &cm)
+	if err != nil || cm.Type == "" {
+		return ControlMessage{}, false
+	}
+	return cm, true
+}
+
+// checkTermSize checks that a terminal size is valid.
+func checkTermSize(cols, rows uint) error {
+	if cols == 0 || rows == 0 || cols > maxTermSize || rows > maxTermSize {
+		return fmt.Errorf("invalid terminal size %dx%d", cols, rows)
+	}
+	return nil
+}
+
+// parseTermSize parses an initial terminal size from the "cols" and "rows" query parameters.
+// If neither is set, returns zeroes.
+func parseTermSize(q url.Values) (cols uint, rows uint, err error) {
+	if q.Get("cols") == "" && q.Get("rows") == "" {
+		return 0, 0, nil
+	}
+	c, err := strconv.ParseUint(q.Get("cols"), 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	r, err := strconv.ParseUint(q.Get("rows"), 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = checkTermSize(uint(c), uint(r))
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint(c), uint(r), nil
+}
+
+// errForbidden is an error indicating that a participant is not allowed to send a control message.
+var errForbidden = errors.New("not allowed for this participant")
+
+// handleControl handles a control message from a client.
+// Only the owner may resize the terminal, and viewers may not send signals.
+func (cs *ContainerSession) handleControl(c *sessionClient, cm ControlMessage) error {
+	switch cm.Type {
+	case "resize":
+		if c.role != RoleOwner {
+			return errForbidden
+		}
+		err := checkTermSize(cm.Cols, cm.Rows)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cs.Config.ContainerStopTimeout)
+		defer cancel()
+		err = cs.Container.Resize(ctx, cm.Cols, cm.Rows)
+		if err == nil && cs.Recorder != nil {
+			cs.Recorder.Resize(cm.Cols, cm.Rows)
+		}
+		return err
+	case "signal":
+		if !c.role.canWrite() {
+			return errForbidden
+		}
+		return cs.Signal(cm.Signal)
+	default:
+		return fmt.Errorf("unrecognized control message type %q", cm.Type)
+	}
+}
@@ -3,26 +3,63 @@ package main
 import (
 	"context"
 	"io"
-	"log"
+	"path"
 	"sync"
 	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
+	"github.com/sirupsen/logrus"
 )
 
 // ContainerConfig is a container configuration.
 type ContainerConfig struct {
 	Image   string   `json:"image"`
 	Command []string `json:"cmd"`
+
+	// Limits overrides the server default resource limits for the container.
+	Limits ResourceLimits `json:"limits"`
+
+	// Pool is the size of the pool of pre-created containers.
+	// By default, containers are not pooled.
+	Pool PoolSize `json:"pool"`
+
+	// WorkDir is the working directory of the container.
+	// If empty, the working directory of the image is used.
+	WorkDir string `json:"workdir,omitempty"`
+
+	// OutputDir is the directory in the container from which files produced by a run are collected.
+	// If empty, no files are collected.
+	OutputDir string `json:"outdir,omitempty"`
+
+	// Project is the configuration for multi-file project uploads.
+	// If nil, only single files of code are accepted.
+	Project *ProjectConfig `json:"project,omitempty"`
+
+	// Entrypoint is the command which runs the language outside of its image, to which Command is appended.
+	// It is only used by runtimes which do not run images, such as ProcessRuntime.
+	Entrypoint []string `json:"entrypoint,omitempty"`
+
+	// Security overrides settings of the server default security profile for the container.
+	Security SecurityProfile `json:"security"`
+
+	// Compile is the configuration of a separate compile phase for runs.
+	// If nil, the code is run directly.
+	Compile *CompileConfig `json:"compile,omitempty"`
+
+	// CodeDir is the directory into which single files of code are uploaded, as a file named "code".
+	// The "/code" argument of the command is replaced with the path of the uploaded file.
+	// If empty, code is uploaded to "/code", which requires a writable root filesystem.
+	CodeDir string `json:"codedir,omitempty"`
+
+	// Diagnostics is the name of the parser which extracts diagnostics from the output of the compiler, and of failed runs.
+	// If empty, output is not parsed.
+	Diagnostics string `json:"diagnostics,omitempty"`
 }
 
 // Container is a running container.
 type Container struct {
 	clck         sync.Mutex
 	closed       bool
-	cli          *client.Client
+	rt           Runtime
 	ID           string
 	IO           io.ReadWriteCloser
 	closetimeout time.Duration
@@ -36,6 +73,79 @@ func (c *Container) Read(dat []byte) (int, error) {
 	return c.IO.Read(dat)
 }
 
+// CloseWrite closes the input stream of the container.
+func (c *Container) CloseWrite() error {
+	if cw, ok := c.IO.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// UploadCode copies code into the given directory of the container as a file called "code".
+func (c *Container) UploadCode(ctx context.Context, dir string, dat []byte) error {
+	return c.UploadFiles(ctx, dir, []projectFile{{path: path.Base(codePath), dat: dat}})
+}
+
+// codeDir returns the directory into which single files of code are uploaded.
+func (cc ContainerConfig) codeDir() string {
+	if cc.CodeDir == "" {
+		return "/"
+	}
+	return cc.CodeDir
+}
+
+// uploadDirs returns the directories which files are copied into or out of.
+// They are mounted as volumes, so that they exist to be copied into, even if the root filesystem is read-only.
+func (cc ContainerConfig) uploadDirs() []string {
+	var dirs []string
+	if cc.CodeDir != "" {
+		dirs = append(dirs, cc.CodeDir)
+	}
+	if cc.Project != nil {
+		dirs = append(dirs, cc.Project.Dir)
+	}
+	if cc.OutputDir != "" {
+		dirs = append(dirs, cc.OutputDir)
+	}
+	if cc.Compile != nil && cc.Compile.BuildDir != "" {
+		dirs = append(dirs, cc.Compile.BuildDir)
+	}
+	return dirs
+}
+
+// UploadFiles copies files into the given directory in the container.
+func (c *Container) UploadFiles(ctx context.Context, dir string, files []projectFile) error {
+	tr := packTarball(files)
+	defer tr.Close()
+	return c.rt.CopyTo(ctx, c.ID, dir, tr)
+}
+
+// ExitStatus is the exit status of a container.
+type ExitStatus struct {
+	// Code is the exit code of the container's process.
+	Code int
+
+	// OOMKilled is whether the container was killed for exceeding its memory limit.
+	OOMKilled bool
+}
+
+// Wait waits for the container to exit and returns its exit status.
+func (c *Container) Wait(ctx context.Context) (ExitStatus, error) {
+	return c.rt.Wait(ctx, c.ID)
+}
+
+// Kill sends a signal to the container.
+func (c *Container) Kill(ctx context.Context, signal string) error {
+	return c.rt.Kill(ctx, c.ID, signal)
+}
+
+// Resize resizes the TTY of the container.
+func (c *Container) Resize(ctx context.Context, cols, rows uint) error {
+	return c.rt.Resize(ctx, c.ID, cols, rows)
+}
+
 // Close closes and removes the container.
 func (c *Container) Close() error {
 	// lock closed field
@@ -47,94 +157,126 @@ func (c *Container) Close() error {
 		return nil
 	}
 	defer func() { c.closed = true }()
+	containersActive.Dec()
+	liveContainers.remove(c.ID)
 
-	// close websocket
-	cerr := c.IO.Close()
+	// close websocket if attached
+	var cerr error
+	if c.IO != nil {
+		cerr = c.IO.Close()
+	}
 
 	// remove container
 	ctx, cancel := context.WithTimeout(context.Background(), c.closetimeout)
 	defer cancel()
-	rerr := c.cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{
-		Force: true,
-	})
+	rerr := c.rt.Remove(ctx, c.ID)
 
 	// handle errors
 	if rerr != nil {
-		log.Printf("failed to remove container: %s", rerr.Error())
+		logrus.WithError(rerr).WithField("container", c.ID).Error("failed to remove container")
 	}
 	err := cerr
-	if err != nil {
+	if err == nil {
 		err = rerr
 	}
 	return err
 }
 
-// Deploy deploys a container with this configuration.
-func (cc ContainerConfig) Deploy(ctx context.Context, cli *client.Client, stoptimeout time.Duration, prestart func(context.Context, *Container) error) (cont *Container, err error) {
+// Create creates a container with this configuration without starting it.
+// The resource limits of the container are resolved against the given LimitPolicy, and its security settings are applied over the given default profile.
+// If tty is false, the output of the container is multiplexed with stdcopy and stdin is closed when the attached stream is closed for writing.
+func (cc ContainerConfig) Create(ctx context.Context, rt Runtime, limits LimitPolicy, security SecurityProfile, stoptimeout time.Duration, tty bool) (*Container, error) {
+	// resolve resource limits
+	lim, err := limits.Resolve(cc.Limits)
+	if err != nil {
+		return nil, err
+	}
+
+	// mount upload directories as volumes
+	sp := security.Override(cc.Security)
+	sp.Volumes = append(append([]string(nil), sp.Volumes...), cc.uploadDirs()...)
+
 	// create container
-	c, err := cli.ContainerCreate(ctx, &container.Config{
-		Image:           cc.Image,
-		Cmd:             cc.Command,
-		Tty:             true,
-		OpenStdin:       true,
-		NetworkDisabled: true,
-	}, &container.HostConfig{
-		Resources: container.Resources{
-			NanoCPUs: int64(time.Second/time.Nanosecond) / 2, // 1/2 CPU cap
-			Memory:   1 << 27,                                // cap at 128MB
-		},
-	}, nil, "")
+	start := time.Now()
+	id, err := rt.Create(ctx, CreateOptions{
+		Image:      cc.Image,
+		Command:    replaceCode(cc.Command, path.Join(cc.codeDir(), path.Base(codePath))),
+		Entrypoint: cc.Entrypoint,
+		WorkDir:    cc.WorkDir,
+		Limits:     lim,
+		Security:   sp,
+		Tty:        tty,
+	})
 	if err != nil {
 		return nil, err
 	}
+	observePhase("create", start)
+	containersActive.Inc()
+	liveContainers.add(id)
 
+	return &Container{
+		rt:           rt,
+		ID:           id,
+		closetimeout: stoptimeout,
+	}, nil
+}
+
+// Start runs the prestart hook, then attaches to and starts the container.
+// If startup fails, the container is removed.
+func (c *Container) Start(ctx context.Context, prestart func(context.Context, *Container) error) (err error) {
 	// cleanup container on failed startup
 	defer func() {
 		if err != nil {
-			delctx, cancel := context.WithTimeout(context.Background(), stoptimeout)
-			defer cancel()
-			rerr := cli.ContainerRemove(delctx, c.ID, types.ContainerRemoveOptions{
-				Force: true,
-			})
-			if rerr != nil {
-				log.Printf("failed to remove container: %s", rerr.Error())
-			}
+			c.Close()
 		}
 	}()
 
-	cont = &Container{
-		cli:          cli,
-		ID:           c.ID,
-		closetimeout: stoptimeout,
-	}
-
 	// run prestart hook
 	if prestart != nil {
-		err = prestart(ctx, cont)
+		start := time.Now()
+		err = prestart(ctx, c)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		observePhase("prestart", start)
 	}
 
 	// attach to container
-	resp, err := cli.ContainerAttach(ctx, c.ID, types.ContainerAttachOptions{
-		Stream: true,
-		Stdin:  true,
-		Stdout: true,
-		Stderr: true,
-	})
+	start := time.Now()
+	stream, err := c.rt.Attach(ctx, c.ID)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	observePhase("attach", start)
 
 	// start container
-	err = cli.ContainerStart(ctx, c.ID, types.ContainerStartOptions{})
+	start = time.Now()
+	err = c.rt.Start(ctx, c.ID)
+	if err != nil {
+		stream.Close()
+		return err
+	}
+	observePhase("start", start)
+
+	c.IO = stream
+
+	return nil
+}
+
+// Deploy deploys a container with this configuration.
+// The resource limits of the container are resolved against the given LimitPolicy, and its security settings are applied over the given default profile.
+func (cc ContainerConfig) Deploy(ctx context.Context, rt Runtime, limits LimitPolicy, security SecurityProfile, stoptimeout time.Duration, tty bool, prestart func(context.Context, *Container) error) (*Container, error) {
+	// create container
+	c, err := cc.Create(ctx, rt, limits, security, stoptimeout, tty)
 	if err != nil {
 		return nil, err
 	}
 
-	// convert to websocket
-	cont.IO = resp.Conn
+	// start container
+	err = c.Start(ctx, prestart)
+	if err != nil {
+		return nil, err
+	}
 
-	return cont, nil
+	return c, nil
 }
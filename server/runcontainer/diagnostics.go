@@ -0,0 +1,252 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic is an error or warning reported by a compiler or interpreter, located in the code.
+type Diagnostic struct {
+	// File is the path of the file as reported by the compiler.
+	File string `json:"file"`
+
+	// Line is the 1-based line number.
+	Line int `json:"line"`
+
+	// Column is the 1-based column number, or 0 if unknown.
+	Column int `json:"column,omitempty"`
+
+	// Severity is one of "error", "warning" or "note".
+	Severity string `json:"severity"`
+
+	Message string `json:"message"`
+}
+
+// maxDiagnostics is the maximum number of diagnostics parsed from output.
+const maxDiagnostics = 100
+
+// maxDiagnosticOutput is the maximum number of bytes from the start of the stderr of a run which are kept for parsing diagnostics.
+const maxDiagnosticOutput = 64 << 10
+
+// diagnosticParser parses diagnostics from the output of a compiler or interpreter.
+type diagnosticParser func(lines []string) []Diagnostic
+
+// diagnosticParsers are the diagnostic parsers which a language can select with the "diagnostics" field of langs.json.
+var diagnosticParsers = map[string]diagnosticParser{
+	"gcc":    parseGCC,
+	"go":     parseGo,
+	"ghc":    parseGHC,
+	"tsc":    parseTSC,
+	"python": parsePython,
+	"lua":    parseLua,
+}
+
+// ansiEscape matches terminal escape sequences such as colors.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// parseDiagnostics parses the diagnostics in output with the named parser.
+// Returns nil if there is no such parser.
+func parseDiagnostics(parser string, output string) []Diagnostic {
+	p, ok := diagnosticParsers[parser]
+	if !ok {
+		return nil
+	}
+	output = ansiEscape.ReplaceAllString(output, "")
+	output = strings.Replace(output, "\r", "", -1)
+	diags := p(strings.Split(output, "\n"))
+	if len(diags) > maxDiagnostics {
+		diags = diags[:maxDiagnostics]
+	}
+	return diags
+}
+
+// atoi parses a number matched by a regular expression, or returns 0 for an empty match.
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// gccDiagnostic matches "file:line:col: severity: message", as printed by gcc and clang.
+var gccDiagnostic = regexp.MustCompile(`^(.+?):(\d+):(?:(\d+):)? (fatal error|error|warning|note): (.*)$`)
+
+// parseGCC parses diagnostics from gcc or clang.
+func parseGCC(lines []string) []Diagnostic {
+	var diags []Diagnostic
+	for _, l := range lines {
+		m := gccDiagnostic.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		sev := m[4]
+		if sev == "fatal error" {
+			sev = "error"
+		}
+		diags = append(diags, Diagnostic{
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Column:   atoi(m[3]),
+			Severity: sev,
+			Message:  m[5],
+		})
+	}
+	return diags
+}
+
+// goDiagnostic matches "file.go:line:col: message", as printed by the go tool.
+var goDiagnostic = regexp.MustCompile(`^(?:\./)?(\S+?\.go):(\d+)(?::(\d+))?: (.*)$`)
+
+// parseGo parses diagnostics from the go tool.
+func parseGo(lines []string) []Diagnostic {
+	var diags []Diagnostic
+	for _, l := range lines {
+		m := goDiagnostic.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		diags = append(diags, Diagnostic{
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Column:   atoi(m[3]),
+			Severity: "error",
+			Message:  m[4],
+		})
+	}
+	return diags
+}
+
+var (
+	// ghcDiagnostic matches "file:line:col: severity:" or "file:line:col-end: severity:", as printed by ghc.
+	// The message follows on indented lines, and older versions of ghc leave out the severity of errors.
+	ghcDiagnostic = regexp.MustCompile(`^(\S.*?):(\d+):(\d+)(?:-\d+)?:(?: (error|warning))?:?(.*)$`)
+
+	// ghcSpanDiagnostic matches "file:(line,col)-(line,col): severity:", as printed by ghc for multi-line spans.
+	ghcSpanDiagnostic = regexp.MustCompile(`^(\S.*?):\((\d+),(\d+)\)-\(\d+,\d+\):(?: (error|warning))?:?(.*)$`)
+)
+
+// parseGHC parses diagnostics from ghc.
+func parseGHC(lines []string) []Diagnostic {
+	var diags []Diagnostic
+	for i := 0; i < len(lines); i++ {
+		m := ghcDiagnostic.FindStringSubmatch(lines[i])
+		if m == nil {
+			m = ghcSpanDiagnostic.FindStringSubmatch(lines[i])
+		}
+		if m == nil {
+			continue
+		}
+		sev := m[4]
+		if sev == "" {
+			sev = "error"
+			if strings.HasPrefix(strings.TrimSpace(m[5]), "Warning:") {
+				sev = "warning"
+			}
+		}
+
+		// collect the indented message lines, leaving out warning flags such as [-Wunused-imports]
+		var msg []string
+		if rest := strings.TrimSpace(m[5]); rest != "" && !strings.HasPrefix(rest, "[") {
+			msg = append(msg, rest)
+		}
+		for i+1 < len(lines) && strings.HasPrefix(lines[i+1], " ") {
+			i++
+			l := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), "•"))
+			if l == "" || strings.HasPrefix(l, "|") {
+				continue
+			}
+			msg = append(msg, l)
+		}
+
+		diags = append(diags, Diagnostic{
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Column:   atoi(m[3]),
+			Severity: sev,
+			Message:  strings.Join(msg, "\n"),
+		})
+	}
+	return diags
+}
+
+var (
+	// tscDiagnostic matches "file(line,col): severity TSnnnn: message", as printed by tsc and ts-node.
+	tscDiagnostic = regexp.MustCompile(`^(.+?)\((\d+),(\d+)\): (error|warning) (TS\d+: .*)$`)
+
+	// tscPrettyDiagnostic matches "file:line:col - severity TSnnnn: message", as printed by tsc with --pretty.
+	tscPrettyDiagnostic = regexp.MustCompile(`^(.+?):(\d+):(\d+) - (error|warning) (TS\d+: .*)$`)
+)
+
+// parseTSC parses diagnostics from the TypeScript compiler.
+func parseTSC(lines []string) []Diagnostic {
+	var diags []Diagnostic
+	for _, l := range lines {
+		m := tscDiagnostic.FindStringSubmatch(l)
+		if m == nil {
+			m = tscPrettyDiagnostic.FindStringSubmatch(l)
+		}
+		if m == nil {
+			continue
+		}
+		diags = append(diags, Diagnostic{
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Column:   atoi(m[3]),
+			Severity: m[4],
+			Message:  m[5],
+		})
+	}
+	return diags
+}
+
+var (
+	// pythonFrame matches a frame of a python traceback, or the location of a syntax error.
+	pythonFrame = regexp.MustCompile(`^\s+File "(.+)", line (\d+)`)
+
+	// pythonException matches the exception which ends a python traceback.
+	pythonException = regexp.MustCompile(`^[A-Za-z_][\w.]*(?:: .*)?$`)
+)
+
+// parsePython parses python tracebacks, locating each exception at the innermost frame.
+func parsePython(lines []string) []Diagnostic {
+	var diags []Diagnostic
+	var frame []string
+	for _, l := range lines {
+		if m := pythonFrame.FindStringSubmatch(l); m != nil {
+			frame = m
+			continue
+		}
+		if frame == nil || !pythonException.MatchString(l) {
+			continue
+		}
+		diags = append(diags, Diagnostic{
+			File:     frame[1],
+			Line:     atoi(frame[2]),
+			Severity: "error",
+			Message:  l,
+		})
+		frame = nil
+	}
+	return diags
+}
+
+// luaDiagnostic matches "lua: file:line: message", as printed by the lua interpreter for errors.
+// Lines of the stack traceback are indented, so they do not match.
+var luaDiagnostic = regexp.MustCompile(`^(?:[\w.]+: )?([^\s:]+):(\d+): (.*)$`)
+
+// parseLua parses errors from the lua interpreter.
+func parseLua(lines []string) []Diagnostic {
+	var diags []Diagnostic
+	for _, l := range lines {
+		m := luaDiagnostic.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		diags = append(diags, Diagnostic{
+			File:     m[1],
+			Line:     atoi(m[2]),
+			Severity: "error",
+			Message:  m[3],
+		})
+	}
+	return diags
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	tbl := []struct {
+		parser string
+		output string
+		expect []Diagnostic
+	}{
+		{
+			parser: "gcc",
+			output: "/code:3:5: \x1b[0;1;31merror: \x1b[0muse of undeclared identifier 'x'\r\n" +
+				"    x = 1;\n    ^\n" +
+				"main.cpp:7: warning: unused variable 'y'\n" +
+				"/code:1:10: fatal error: 'foo.h' file not found\n" +
+				"1 error generated.\n",
+			expect: []Diagnostic{
+				{File: "/code", Line: 3, Column: 5, Severity: "error", Message: "use of undeclared identifier 'x'"},
+				{File: "main.cpp", Line: 7, Severity: "warning", Message: "unused variable 'y'"},
+				{File: "/code", Line: 1, Column: 10, Severity: "error", Message: "'foo.h' file not found"},
+			},
+		},
+		{
+			parser: "go",
+			output: "# command-line-arguments\n" +
+				"./code.go:4:2: undefined: x\n" +
+				"/code.go:6: missing return\n" +
+				"panic: oops\n\ngoroutine 1 [running]:\nmain.main()\n\t/code.go:5 +0x39\n",
+			expect: []Diagnostic{
+				{File: "code.go", Line: 4, Column: 2, Severity: "error", Message: "undefined: x"},
+				{File: "/code.go", Line: 6, Severity: "error", Message: "missing return"},
+			},
+		},
+		{
+			parser: "ghc",
+			output: "[1 of 1] Compiling Main             ( /code.hs, /tmp/ghc/Main.o )\n\n" +
+				"/code.hs:3:8: error:\n" +
+				"    • Variable not in scope: foo :: IO ()\n" +
+				"    • Perhaps you meant ‘for’\n" +
+				"  |\n3 | main = foo\n  |        ^^^\n\n" +
+				"/code.hs:1:1: warning: [-Wunused-imports]\n" +
+				"    The import of ‘Data.List’ is redundant\n" +
+				"/code.hs:(5,1)-(6,9): error:\n" +
+				"    Parse error\n",
+			expect: []Diagnostic{
+				{File: "/code.hs", Line: 3, Column: 8, Severity: "error", Message: "Variable not in scope: foo :: IO ()\nPerhaps you meant ‘for’"},
+				{File: "/code.hs", Line: 1, Column: 1, Severity: "warning", Message: "The import of ‘Data.List’ is redundant"},
+				{File: "/code.hs", Line: 5, Column: 1, Severity: "error", Message: "Parse error"},
+			},
+		},
+		{
+			parser: "tsc",
+			output: "TSError: ⨯ Unable to compile TypeScript:\n" +
+				"script.ts(2,7): error TS2322: Type '\"a\"' is not assignable to type 'number'.\n" +
+				"main.ts:4:1 - error TS2304: Cannot find name 'foo'.\n",
+			expect: []Diagnostic{
+				{File: "script.ts", Line: 2, Column: 7, Severity: "error", Message: "TS2322: Type '\"a\"' is not assignable to type 'number'."},
+				{File: "main.ts", Line: 4, Column: 1, Severity: "error", Message: "TS2304: Cannot find name 'foo'."},
+			},
+		},
+		{
+			parser: "python",
+			output: "Traceback (most recent call last):\n" +
+				"  File \"/code\", line 5, in <module>\n    f()\n" +
+				"  File \"/code\", line 2, in f\n    return 1 / 0\n" +
+				"ZeroDivisionError: division by zero\n" +
+				"  File \"/code\", line 1\n    print(\n         ^\n" +
+				"SyntaxError: unexpected EOF while parsing\n",
+			expect: []Diagnostic{
+				{File: "/code", Line: 2, Severity: "error", Message: "ZeroDivisionError: division by zero"},
+				{File: "/code", Line: 1, Severity: "error", Message: "SyntaxError: unexpected EOF while parsing"},
+			},
+		},
+		{
+			parser: "lua",
+			output: "lua5.3: /code:3: attempt to call a nil value (global 'foo')\n" +
+				"stack traceback:\n\t/code:3: in main chunk\n\t[C]: in ?\n",
+			expect: []Diagnostic{
+				{File: "/code", Line: 3, Severity: "error", Message: "attempt to call a nil value (global 'foo')"},
+			},
+		},
+		{
+			parser: "none",
+			output: "/code:1:1: error: bad\n",
+		},
+	}
+	for _, v := range tbl {
+		diags := parseDiagnostics(v.parser, v.output)
+		if !reflect.DeepEqual(diags, v.expect) {
+			t.Errorf("%s: expected %+v but got %+v", v.parser, v.expect, diags)
+		}
+	}
+}
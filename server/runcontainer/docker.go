@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// DockerRuntime is a Runtime which runs containers with Docker.
+type DockerRuntime struct {
+	// Client is the Docker client used to manage containers.
+	Client *client.Client
+
+	// Instance is the ID of this instance of the service, with which created containers are labeled.
+	Instance string
+}
+
+// Create creates a container without starting it, and returns its ID.
+func (dr *DockerRuntime) Create(ctx context.Context, opts CreateOptions) (string, error) {
+	cfg := &container.Config{
+		Image:           opts.Image,
+		Cmd:             opts.Command,
+		WorkingDir:      opts.WorkDir,
+		Tty:             opts.Tty,
+		OpenStdin:       true,
+		StdinOnce:       !opts.Tty,
+		NetworkDisabled: true,
+		Labels: map[string]string{
+			labelManaged:  "true",
+			labelInstance: dr.Instance,
+		},
+	}
+	hc := &container.HostConfig{}
+	opts.Limits.apply(hc)
+	err := opts.Security.apply(cfg, hc, opts.Limits)
+	if err != nil {
+		return "", err
+	}
+	c, err := dr.Client.ContainerCreate(ctx, cfg, hc, nil, "")
+	if err != nil {
+		return "", err
+	}
+	return c.ID, nil
+}
+
+// CopyTo extracts a tar archive into a directory in the filesystem of a container.
+func (dr *DockerRuntime) CopyTo(ctx context.Context, id string, dir string, tarball io.Reader) error {
+	return dr.Client.CopyToContainer(ctx, id, dir, tarball, types.CopyToContainerOptions{})
+}
+
+// CopyFrom returns a tar archive of a path in the filesystem of a container.
+func (dr *DockerRuntime) CopyFrom(ctx context.Context, id string, path string) (io.ReadCloser, error) {
+	rc, _, err := dr.Client.CopyFromContainer(ctx, id, path)
+	return rc, err
+}
+
+// hijackedStream is an io.ReadWriteCloser over a hijacked Docker attach connection.
+type hijackedStream struct {
+	types.HijackedResponse
+}
+
+func (hs *hijackedStream) Read(dat []byte) (int, error) {
+	return hs.Reader.Read(dat)
+}
+
+func (hs *hijackedStream) Write(dat []byte) (int, error) {
+	return hs.Conn.Write(dat)
+}
+
+func (hs *hijackedStream) Close() error {
+	return hs.Conn.Close()
+}
+
+// Attach attaches to the standard streams of a container.
+func (dr *DockerRuntime) Attach(ctx context.Context, id string) (io.ReadWriteCloser, error) {
+	resp, err := dr.Client.ContainerAttach(ctx, id, types.ContainerAttachOptions{
+		Stream: true,
+		Stdin:  true,
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &hijackedStream{resp}, nil
+}
+
+// Start starts a container.
+func (dr *DockerRuntime) Start(ctx context.Context, id string) error {
+	return dr.Client.ContainerStart(ctx, id, types.ContainerStartOptions{})
+}
+
+// Resize resizes the TTY of a container.
+func (dr *DockerRuntime) Resize(ctx context.Context, id string, cols, rows uint) error {
+	return dr.Client.ContainerResize(ctx, id, types.ResizeOptions{
+		Width:  cols,
+		Height: rows,
+	})
+}
+
+// Kill sends a signal to a container.
+func (dr *DockerRuntime) Kill(ctx context.Context, id string, signal string) error {
+	return dr.Client.ContainerKill(ctx, id, signal)
+}
+
+// Wait waits for a container to exit and returns its exit status.
+func (dr *DockerRuntime) Wait(ctx context.Context, id string) (ExitStatus, error) {
+	_, err := dr.Client.ContainerWait(ctx, id)
+	if err != nil {
+		return ExitStatus{}, err
+	}
+	inf, err := dr.Client.ContainerInspect(ctx, id)
+	if err != nil {
+		return ExitStatus{}, err
+	}
+	return ExitStatus{
+		Code:      inf.State.ExitCode,
+		OOMKilled: inf.State.OOMKilled,
+	}, nil
+}
+
+// Remove forcibly removes a container.
+func (dr *DockerRuntime) Remove(ctx context.Context, id string) error {
+	return dr.Client.ContainerRemove(ctx, id, types.ContainerRemoveOptions{
+		Force:         true,
+		RemoveVolumes: true,
+	})
+}
+
+// List returns the containers created by the service, including those left behind by previous instances.
+func (dr *DockerRuntime) List(ctx context.Context) ([]ContainerInfo, error) {
+	args := filters.NewArgs()
+	args.Add("label", labelManaged+"=true")
+	cs, err := dr.Client.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: args,
+	})
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]ContainerInfo, len(cs))
+	for i, c := range cs {
+		infos[i] = ContainerInfo{
+			ID:       c.ID,
+			Instance: c.Labels[labelInstance],
+			Created:  time.Unix(c.Created, 0),
+		}
+	}
+	return infos, nil
+}
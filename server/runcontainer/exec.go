@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/sirupsen/logrus"
+)
+
+// ExecConfig is a configuration for non-interactive runs.
+type ExecConfig struct {
+	// MaxRequestSize is the maximum size of an exec request body.
+	MaxRequestSize int64
+
+	// MaxOutputSize is the maximum number of bytes kept from each of stdout and stderr.
+	MaxOutputSize int
+
+	// DefaultTimeout is the run timeout used when a request does not specify one.
+	DefaultTimeout time.Duration
+
+	// MaxTimeout is the maximum run timeout which a request may specify.
+	MaxTimeout time.Duration
+
+	// MaxCases is the maximum number of test cases in a judge request.
+	// If zero, the number of test cases is unlimited.
+	MaxCases int
+}
+
+// timeout returns the run timeout for a requested number of seconds, using DefaultTimeout if it is not positive and capping it at MaxTimeout.
+func (ec ExecConfig) timeout(secs float64) time.Duration {
+	timeout := ec.DefaultTimeout
+	if secs > 0 {
+		// compare before converting, as large values overflow a Duration
+		if secs >= ec.MaxTimeout.Seconds() {
+			return ec.MaxTimeout
+		}
+		timeout = time.Duration(secs * float64(time.Second))
+	}
+	if timeout > ec.MaxTimeout {
+		timeout = ec.MaxTimeout
+	}
+	return timeout
+}
+
+// ExecRequest is a request to run code non-interactively.
+type ExecRequest struct {
+	// Language is the name of the language to run the code in.
+	Language string `json:"lang"`
+
+	// Code is the code to run.
+	Code string `json:"code"`
+
+	// Stdin is the input passed to the program.
+	Stdin string `json:"stdin"`
+
+	// Timeout is the run timeout in seconds.
+	Timeout float64 `json:"timeout"`
+
+	// Artifacts is whether to return the files produced by the program in the result.
+	Artifacts bool `json:"artifacts"`
+}
+
+// ExecResult is the result of a non-interactive run.
+type ExecResult struct {
+	// ID is the unique ID of the run, which is also sent in the X-Request-ID header and used in logs.
+	ID string `json:"id"`
+
+	// Stdout is the standard output of the program.
+	Stdout string `json:"stdout"`
+
+	// Stderr is the standard error of the program.
+	Stderr string `json:"stderr"`
+
+	// Truncated is whether stdout or stderr exceeded the output size limit.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// ExitCode is the exit code of the program.
+	ExitCode int `json:"exitCode"`
+
+	// WallTime is the run time of the program in seconds.
+	WallTime float64 `json:"wallTime"`
+
+	// TimedOut is whether the program was killed for exceeding the timeout.
+	TimedOut bool `json:"timedOut"`
+
+	// OOMKilled is whether the program was killed for exceeding the memory limit.
+	OOMKilled bool `json:"oomKilled"`
+
+	// Artifacts are the files written by the program to the output directory, if requested.
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+
+	// ArtifactsTruncated is whether some files were left out for exceeding the artifact limits.
+	ArtifactsTruncated bool `json:"artifactsTruncated,omitempty"`
+
+	// stdoutTruncated is whether stdout exceeded the output size limit.
+	stdoutTruncated bool
+
+	// Compile is the result of compiling the code, for languages with a compile phase.
+	// If compilation failed, the code was not run, and ExitCode is the exit code of the compiler.
+	Compile *CompileResult `json:"compile,omitempty"`
+
+	// Diagnostics are the errors parsed from stderr if the program failed, for languages with a diagnostic parser.
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// limitedBuffer is an io.Writer which keeps up to max bytes and discards the rest.
+type limitedBuffer struct {
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (lb *limitedBuffer) Write(dat []byte) (int, error) {
+	n := len(dat)
+	if rem := lb.max - len(lb.buf); n > rem {
+		dat = dat[:rem]
+		lb.truncated = true
+	}
+	lb.buf = append(lb.buf, dat...)
+	return n, nil
+}
+
+// waitTimeout waits for the container to exit, killing it if it runs for longer than timeout.
+// Returns whether the container was killed for timing out.
+func (c *Container) waitTimeout(ctx context.Context, timeout, stoptimeout time.Duration) (ExitStatus, bool, error) {
+	runctx, rcancel := context.WithTimeout(ctx, timeout)
+	defer rcancel()
+	status, err := c.Wait(runctx)
+	if err == nil {
+		return status, false, nil
+	}
+	if runctx.Err() != context.DeadlineExceeded || ctx.Err() != nil {
+		return ExitStatus{}, false, err
+	}
+
+	// kill container after timeout
+	killctx, kcancel := context.WithTimeout(ctx, stoptimeout)
+	defer kcancel()
+	err = c.Kill(killctx, "SIGKILL")
+	if err != nil {
+		return ExitStatus{}, false, err
+	}
+	status, err = c.Wait(killctx)
+	if err != nil {
+		return ExitStatus{}, false, err
+	}
+	return status, true, nil
+}
+
+// waitOutput waits for the output of an exited container to be collected, closing the stream if it takes longer than timeout.
+// outch must be closed once the output has been collected.
+func (c *Container) waitOutput(outch <-chan struct{}, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-outch:
+	case <-timer.C:
+		c.IO.Close()
+		<-outch
+	}
+}
+
+// runBatch runs code non-interactively in a fresh container built from cc.
+// If build is not nil, it is a compiled program from compileCode, which is copied into the container alongside the code.
+// The output of the program is captured without a TTY, with stdout and stderr kept separate.
+// If artifacts is set, files in the output directory of the container are returned with the result.
+func runBatch(ctx context.Context, cc ContainerConfig, sc *ContainerSessionConfig, code, build, stdin []byte, timeout time.Duration, maxout int, artifacts bool) (ExecResult, error) {
+	// deploy container with code
+	startctx, scancel := context.WithTimeout(ctx, sc.StartTimeout)
+	defer scancel()
+	c, err := cc.Deploy(startctx, sc.Runtime, sc.Limits, sc.Security, sc.ContainerStopTimeout, false, func(ctx context.Context, c *Container) error {
+		err := c.UploadCode(ctx, cc.codeDir(), code)
+		if err != nil {
+			return err
+		}
+		if build != nil {
+			err = c.UploadBuild(ctx, cc.Compile.BuildDir, build)
+			if err != nil {
+				return err
+			}
+		}
+		return cc.prepareOutput(ctx, c)
+	})
+	if err != nil {
+		return ExecResult{}, err
+	}
+	defer c.Close()
+	start := time.Now()
+
+	// send stdin
+	go func() {
+		c.Write(stdin)
+		c.CloseWrite()
+	}()
+
+	// collect output
+	stdout := &limitedBuffer{max: maxout}
+	stderr := &limitedBuffer{max: maxout}
+	outch := make(chan struct{})
+	go func() {
+		defer close(outch)
+		stdcopy.StdCopy(stdout, stderr, c)
+	}()
+
+	// wait for exit
+	status, timedout, err := c.waitTimeout(ctx, timeout, sc.ContainerStopTimeout)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	wall := time.Since(start)
+
+	// wait for output to finish
+	c.waitOutput(outch, sc.ShutdownTimeout)
+
+	res := ExecResult{
+		Stdout:    string(stdout.buf),
+		Stderr:    string(stderr.buf),
+		Truncated: stdout.truncated || stderr.truncated,
+		ExitCode:  status.Code,
+		WallTime:  wall.Seconds(),
+		TimedOut:  timedout,
+		OOMKilled: status.OOMKilled,
+
+		stdoutTruncated: stdout.truncated,
+	}
+
+	// collect files produced by the program
+	if artifacts && cc.OutputDir != "" {
+		actx, acancel := context.WithTimeout(ctx, sc.ContainerStopTimeout)
+		defer acancel()
+		files, truncated, err := c.CollectArtifacts(actx, cc.OutputDir, sc.Artifacts)
+		if err != nil {
+			return ExecResult{}, err
+		}
+		res.Artifacts = toArtifacts(files)
+		res.ArtifactsTruncated = truncated
+	}
+
+	return res, nil
+}
+
+// HandleExec runs code non-interactively and responds with an ExecResult as JSON.
+func (cs *ContainerServer) HandleExec(w http.ResponseWriter, r *http.Request) {
+	// only allow POST requests
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// reject runs while shutting down
+	if !cs.drain.enter() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer cs.drain.leave()
+	stopch, killch := cs.drain.channels()
+
+	// parse request
+	var req ExecRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, cs.Exec.MaxRequestSize)).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	// generate run ID
+	id, err := newSessionID()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to generate run ID: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Request-ID", id)
+	log := logrus.WithFields(logrus.Fields{
+		"session":  id,
+		"language": req.Language,
+		"mode":     "exec",
+	})
+
+	// get language
+	lang, ok := cs.Containers[req.Language]
+	if !ok {
+		http.Error(w, "language not supported", http.StatusBadRequest)
+		return
+	}
+
+	// select timeout
+	timeout := cs.Exec.timeout(req.Timeout)
+
+	// wait for admission
+	key, max := cs.clientKey(r)
+	qctx, qcancel := cancelOn(r.Context(), stopch)
+	release, err := cs.Admission.Acquire(qctx, key, max, nil)
+	qcancel()
+	if err == context.Canceled && r.Context().Err() == nil {
+		err = errShuttingDown
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		log.WithError(err).Warn("run rejected by admission control")
+		errorsTotal.WithLabelValues("admission").Inc()
+		return
+	}
+	defer release()
+	sessionsTotal.WithLabelValues(req.Language, "exec").Inc()
+
+	// run code, stopping if the server is shutting down
+	ctx, cancel := cancelOn(r.Context(), killch)
+	defer cancel()
+	cc := lang.RunContainer
+	cres, build, err := compileBatch(ctx, cc, &cs.SessionConfig, []byte(req.Code))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to compile: %s", err.Error()), http.StatusInternalServerError)
+		log.WithError(err).Error("failed to compile")
+		errorsTotal.WithLabelValues("compile").Inc()
+		return
+	}
+	var res ExecResult
+	if cres == nil || cres.Success {
+		res, err = runBatch(ctx, cc, &cs.SessionConfig, []byte(req.Code), build, []byte(req.Stdin), timeout, cs.Exec.MaxOutputSize, req.Artifacts)
+	} else {
+		res.ExitCode = cres.ExitCode
+	}
+	res.Compile = cres
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to run: %s", err.Error()), http.StatusInternalServerError)
+		log.WithError(err).Error("failed to run")
+		errorsTotal.WithLabelValues("exec").Inc()
+		return
+	}
+	if res.ExitCode != 0 && (cres == nil || cres.Success) {
+		res.Diagnostics = parseDiagnostics(cc.Diagnostics, res.Stderr)
+	}
+	res.ID = id
+	log.WithFields(logrus.Fields{
+		"exitCode": res.ExitCode,
+		"wallTime": res.WallTime,
+	}).Info("run finished")
+
+	// send result
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// fakeProgram is a program run in a fake container.
+// Files written to the files map are kept in the container when the program exits.
+// It returns the exit code of the container.
+type fakeProgram func(stdin io.Reader, stdout io.Writer, files map[string][]byte) int
+
+// fakeStdout is the stdout of a fakeProgram, which carries its stderr.
+type fakeStdout struct {
+	io.Writer
+	stderr io.Writer
+}
+
+// fakeStderr returns the stderr of a fakeProgram from its stdout.
+// With a TTY, stderr is the same as stdout.
+func fakeStderr(stdout io.Writer) io.Writer {
+	return stdout.(fakeStdout).stderr
+}
+
+// fakeContainer is a container in a fakeRuntime.
+type fakeContainer struct {
+	opts       CreateOptions
+	instance   string
+	created    time.Time
+	files      map[string][]byte
+	stdinr     *io.PipeReader
+	stdinw     *io.PipeWriter
+	stdoutr    *io.PipeReader
+	stdoutw    *io.PipeWriter
+	cols, rows uint
+	signals    []string
+	started    bool
+	removed    bool
+	exitonce   sync.Once
+	status     ExitStatus
+	done       chan struct{}
+}
+
+// exit marks the container as exited with the given code.
+func (fc *fakeContainer) exit(code int) {
+	fc.exitonce.Do(func() {
+		fc.status.Code = code
+		fc.stdinr.CloseWithError(errors.New("container exited"))
+		fc.stdoutw.Close()
+		close(fc.done)
+	})
+}
+
+// fakeStream is the attached stream of a fakeContainer.
+type fakeStream struct {
+	fc *fakeContainer
+}
+
+func (fs fakeStream) Read(dat []byte) (int, error) {
+	return fs.fc.stdoutr.Read(dat)
+}
+
+func (fs fakeStream) Write(dat []byte) (int, error) {
+	return fs.fc.stdinw.Write(dat)
+}
+
+func (fs fakeStream) CloseWrite() error {
+	return fs.fc.stdinw.Close()
+}
+
+func (fs fakeStream) Close() error {
+	fs.fc.stdinw.Close()
+	return fs.fc.stdoutr.Close()
+}
+
+// fakeRuntime is an in-process Runtime which runs a fakeProgram in each container.
+type fakeRuntime struct {
+	program fakeProgram
+
+	// instance is the instance ID reported for created containers.
+	instance string
+
+	lck        sync.Mutex
+	containers map[string]*fakeContainer
+	next       int
+}
+
+// get looks up a container by ID.
+func (fr *fakeRuntime) get(id string) (*fakeContainer, error) {
+	fr.lck.Lock()
+	defer fr.lck.Unlock()
+	fc, ok := fr.containers[id]
+	if !ok || fc.removed {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+	return fc, nil
+}
+
+func (fr *fakeRuntime) Create(ctx context.Context, opts CreateOptions) (string, error) {
+	fr.lck.Lock()
+	defer fr.lck.Unlock()
+	if fr.containers == nil {
+		fr.containers = map[string]*fakeContainer{}
+	}
+	fr.next++
+	id := fmt.Sprintf("fake%d", fr.next)
+	fc := &fakeContainer{
+		opts:     opts,
+		instance: fr.instance,
+		created:  time.Now(),
+		files:    map[string][]byte{},
+		done:     make(chan struct{}),
+	}
+	fc.stdinr, fc.stdinw = io.Pipe()
+	fc.stdoutr, fc.stdoutw = io.Pipe()
+	fr.containers[id] = fc
+	return id, nil
+}
+
+// CopyTo extracts a tarball into dir, which must be in a volume if the root filesystem is read-only, as with Docker.
+func (fr *fakeRuntime) CopyTo(ctx context.Context, id string, dir string, tarball io.Reader) error {
+	fc, err := fr.get(id)
+	if err != nil {
+		return err
+	}
+	if isSet(fc.opts.Security.ReadOnlyRoot) && !inVolume(dir, fc.opts.Security.Volumes) {
+		return fmt.Errorf("container rootfs is marked read-only: cannot copy to %s", dir)
+	}
+	tr := tar.NewReader(tarball)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		dat, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		fr.lck.Lock()
+		fc.files[path.Join(dir, hdr.Name)] = dat
+		fr.lck.Unlock()
+	}
+}
+
+// inVolume returns whether a path is in one of the volumes.
+func inVolume(p string, volumes []string) bool {
+	for _, v := range volumes {
+		if p == v || strings.HasPrefix(p, v+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (fr *fakeRuntime) CopyFrom(ctx context.Context, id string, dir string) (io.ReadCloser, error) {
+	fc, err := fr.get(id)
+	if err != nil {
+		return nil, err
+	}
+	fr.lck.Lock()
+	defer fr.lck.Unlock()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, dat := range fc.files {
+		if !strings.HasPrefix(name, dir+"/") {
+			continue
+		}
+		tw.WriteHeader(&tar.Header{
+			Name:     path.Base(dir) + strings.TrimPrefix(name, dir),
+			Mode:     0644,
+			Size:     int64(len(dat)),
+			Typeflag: tar.TypeReg,
+		})
+		tw.Write(dat)
+	}
+	tw.Close()
+	return ioutil.NopCloser(&buf), nil
+}
+
+func (fr *fakeRuntime) Attach(ctx context.Context, id string) (io.ReadWriteCloser, error) {
+	fc, err := fr.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return fakeStream{fc}, nil
+}
+
+func (fr *fakeRuntime) Start(ctx context.Context, id string) error {
+	fc, err := fr.get(id)
+	if err != nil {
+		return err
+	}
+	fr.lck.Lock()
+	fc.started = true
+	files := map[string][]byte{}
+	for k, v := range fc.files {
+		files[k] = v
+	}
+	fr.lck.Unlock()
+	// multiplex output if there is no TTY
+	stdout := fakeStdout{fc.stdoutw, fc.stdoutw}
+	if !fc.opts.Tty {
+		stdout = fakeStdout{stdcopy.NewStdWriter(fc.stdoutw, stdcopy.Stdout), stdcopy.NewStdWriter(fc.stdoutw, stdcopy.Stderr)}
+	}
+	go func() {
+		code := fr.program(fc.stdinr, stdout, files)
+		fr.lck.Lock()
+		fc.files = files
+		fr.lck.Unlock()
+		fc.exit(code)
+	}()
+	return nil
+}
+
+func (fr *fakeRuntime) Resize(ctx context.Context, id string, cols, rows uint) error {
+	fc, err := fr.get(id)
+	if err != nil {
+		return err
+	}
+	fr.lck.Lock()
+	defer fr.lck.Unlock()
+	fc.cols, fc.rows = cols, rows
+	return nil
+}
+
+func (fr *fakeRuntime) Kill(ctx context.Context, id string, signal string) error {
+	fc, err := fr.get(id)
+	if err != nil {
+		return err
+	}
+	fr.lck.Lock()
+	fc.signals = append(fc.signals, signal)
+	fr.lck.Unlock()
+	fc.exit(137)
+	return nil
+}
+
+func (fr *fakeRuntime) Wait(ctx context.Context, id string) (ExitStatus, error) {
+	fc, err := fr.get(id)
+	if err != nil {
+		return ExitStatus{}, err
+	}
+	select {
+	case <-fc.done:
+		return fc.status, nil
+	case <-ctx.Done():
+		return ExitStatus{}, ctx.Err()
+	}
+}
+
+func (fr *fakeRuntime) Remove(ctx context.Context, id string) error {
+	fc, err := fr.get(id)
+	if err != nil {
+		return err
+	}
+	fr.lck.Lock()
+	fc.removed = true
+	fr.lck.Unlock()
+	fc.exit(137)
+	return nil
+}
+
+func (fr *fakeRuntime) List(ctx context.Context) ([]ContainerInfo, error) {
+	fr.lck.Lock()
+	defer fr.lck.Unlock()
+	var infos []ContainerInfo
+	for id, fc := range fr.containers {
+		if fc.removed {
+			continue
+		}
+		infos = append(infos, ContainerInfo{
+			ID:       id,
+			Instance: fc.instance,
+			Created:  fc.created,
+		})
+	}
+	return infos, nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Verdict is the outcome of running a test case.
+type Verdict string
+
+const (
+	// VerdictPassed is the verdict of a test case whose output matched the expected output.
+	VerdictPassed Verdict = "passed"
+
+	// VerdictWrongAnswer is the verdict of a test case whose output did not match the expected output.
+	VerdictWrongAnswer Verdict = "wrong_answer"
+
+	// VerdictRuntimeError is the verdict of a test case in which the program exited with a non-zero exit code.
+	VerdictRuntimeError Verdict = "runtime_error"
+
+	// VerdictTimeLimit is the verdict of a test case in which the program exceeded the time limit.
+	VerdictTimeLimit Verdict = "time_limit"
+
+	// VerdictMemoryLimit is the verdict of a test case in which the program exceeded the memory limit.
+	VerdictMemoryLimit Verdict = "memory_limit"
+
+	// VerdictCompileError is the verdict of every test case if the code did not compile.
+	VerdictCompileError Verdict = "compile_error"
+)
+
+// Comparator selects how the output of a program is compared to the expected output.
+type Comparator string
+
+const (
+	// CompareExact requires the output to match exactly.
+	CompareExact Comparator = "exact"
+
+	// CompareWhitespace ignores differences in whitespace between tokens and at the ends of the output.
+	CompareWhitespace Comparator = "whitespace"
+
+	// CompareFloat compares numeric tokens within a tolerance, and other tokens exactly.
+	CompareFloat Comparator = "float"
+)
+
+// defaultTolerance is the tolerance of CompareFloat when a request does not specify one.
+const defaultTolerance = 1e-6
+
+// maxDiffLines is the maximum number of differing lines included in a diff.
+const maxDiffLines = 20
+
+// JudgeCase is a test case of a judge request.
+type JudgeCase struct {
+	// Stdin is the input passed to the program.
+	Stdin string `json:"stdin"`
+
+	// Expected is the expected standard output of the program.
+	Expected string `json:"expected"`
+
+	// TimeLimit is the time limit of the test case in seconds.
+	TimeLimit float64 `json:"timeLimit"`
+}
+
+// JudgeRequest is a request to run code against a list of test cases.
+type JudgeRequest struct {
+	// Language is the name of the language to run the code in.
+	Language string `json:"lang"`
+
+	// Code is the code to run.
+	Code string `json:"code"`
+
+	// Cases are the test cases to run the code against.
+	Cases []JudgeCase `json:"cases"`
+
+	// Compare is the comparator used to check the output.
+	// The default is CompareExact.
+	Compare Comparator `json:"compare"`
+
+	// Tolerance is the absolute or relative tolerance of CompareFloat.
+	Tolerance float64 `json:"tolerance"`
+}
+
+// CaseResult is the result of a test case.
+type CaseResult struct {
+	Verdict Verdict `json:"verdict"`
+
+	// Diff shows the lines in which the output differs from the expected output, for wrong answers.
+	Diff string `json:"diff,omitempty"`
+
+	// ExitCode is the exit code of the program.
+	ExitCode int `json:"exitCode"`
+
+	// WallTime is the run time of the program in seconds.
+	WallTime float64 `json:"wallTime"`
+
+	// Stderr is the standard error of the program.
+	Stderr string `json:"stderr,omitempty"`
+}
+
+// JudgeResult is the result of a judge request.
+type JudgeResult struct {
+	// ID is the unique ID of the request, which is also sent in the X-Request-ID header and used in logs.
+	ID string `json:"id"`
+
+	// Passed is the number of test cases which passed.
+	Passed int `json:"passed"`
+
+	// Cases are the results of the test cases, in the order of the request.
+	Cases []CaseResult `json:"cases"`
+
+	// Compile is the result of compiling the code, for languages with a compile phase.
+	Compile *CompileResult `json:"compile,omitempty"`
+}
+
+// floatEqual returns whether two tokens are equal, comparing numbers with an absolute or relative tolerance.
+func floatEqual(a, b string, tol float64) bool {
+	if a == b {
+		return true
+	}
+	x, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return false
+	}
+	y, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return false
+	}
+	d := math.Abs(x - y)
+	return d <= tol || d <= tol*math.Abs(y)
+}
+
+// match returns whether the output of a program matches the expected output.
+func (cmp Comparator) match(output, expected string, tol float64) bool {
+	switch cmp {
+	case CompareWhitespace, CompareFloat:
+		out, exp := strings.Fields(output), strings.Fields(expected)
+		if len(out) != len(exp) {
+			return false
+		}
+		for i := range out {
+			if cmp == CompareFloat && floatEqual(out[i], exp[i], tol) {
+				continue
+			}
+			if out[i] != exp[i] {
+				return false
+			}
+		}
+		return true
+	default:
+		return output == expected
+	}
+}
+
+// valid returns whether the comparator is supported.
+func (cmp Comparator) valid() bool {
+	switch cmp {
+	case CompareExact, CompareWhitespace, CompareFloat:
+		return true
+	default:
+		return false
+	}
+}
+
+// diffLines returns the lines in which the output differs from the expected output.
+// Each differing line is shown with its line number, the expected line prefixed with "-" and the actual line prefixed with "+".
+func diffLines(output, expected string) string {
+	out := strings.Split(output, "\n")
+	exp := strings.Split(expected, "\n")
+	n := len(out)
+	if len(exp) > n {
+		n = len(exp)
+	}
+	var lines []string
+	shown := 0
+	for i := 0; i < n; i++ {
+		var o, e string
+		if i < len(out) {
+			o = out[i]
+		}
+		if i < len(exp) {
+			e = exp[i]
+		}
+		if o == e && (i < len(out)) == (i < len(exp)) {
+			continue
+		}
+		if shown == maxDiffLines {
+			lines = append(lines, "...")
+			break
+		}
+		shown++
+		lines = append(lines, fmt.Sprintf("@@ line %d @@", i+1))
+		if i < len(exp) {
+			lines = append(lines, "-"+e)
+		}
+		if i < len(out) {
+			lines = append(lines, "+"+o)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// judgeCase determines the verdict of a test case from the result of running it.
+func judgeCase(res ExecResult, tc JudgeCase, cmp Comparator, tol float64) CaseResult {
+	cr := CaseResult{
+		ExitCode: res.ExitCode,
+		WallTime: res.WallTime,
+		Stderr:   res.Stderr,
+	}
+	switch {
+	case res.TimedOut:
+		cr.Verdict = VerdictTimeLimit
+	case res.OOMKilled:
+		cr.Verdict = VerdictMemoryLimit
+	case res.ExitCode != 0:
+		cr.Verdict = VerdictRuntimeError
+	case res.stdoutTruncated || !cmp.match(res.Stdout, tc.Expected, tol):
+		cr.Verdict = VerdictWrongAnswer
+		cr.Diff = diffLines(res.Stdout, tc.Expected)
+	default:
+		cr.Verdict = VerdictPassed
+	}
+	return cr
+}
+
+// HandleJudge runs code against a list of test cases and responds with a JudgeResult as JSON.
+// Each test case is run in a fresh container built from the RunContainer of the language.
+// For languages with a compile phase, the code is compiled once before running the test cases.
+func (cs *ContainerServer) HandleJudge(w http.ResponseWriter, r *http.Request) {
+	// only allow POST requests
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// reject runs while shutting down
+	if !cs.drain.enter() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer cs.drain.leave()
+	stopch, killch := cs.drain.channels()
+
+	// parse request
+	var req JudgeRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, cs.Exec.MaxRequestSize)).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if len(req.Cases) == 0 {
+		http.Error(w, "no test cases", http.StatusBadRequest)
+		return
+	}
+	if cs.Exec.MaxCases > 0 && len(req.Cases) > cs.Exec.MaxCases {
+		http.Error(w, fmt.Sprintf("too many test cases (maximum is %d)", cs.Exec.MaxCases), http.StatusBadRequest)
+		return
+	}
+	if req.Compare == "" {
+		req.Compare = CompareExact
+	}
+	if !req.Compare.valid() {
+		http.Error(w, fmt.Sprintf("unsupported comparator %q", req.Compare), http.StatusBadRequest)
+		return
+	}
+	tol := req.Tolerance
+	if tol <= 0 {
+		tol = defaultTolerance
+	}
+
+	// generate request ID
+	id, err := newSessionID()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to generate request ID: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Request-ID", id)
+	log := logrus.WithFields(logrus.Fields{
+		"session":  id,
+		"language": req.Language,
+		"mode":     "judge",
+	})
+
+	// get language
+	lang, ok := cs.Containers[req.Language]
+	if !ok {
+		http.Error(w, "language not supported", http.StatusBadRequest)
+		return
+	}
+
+	// wait for admission
+	key, max := cs.clientKey(r)
+	qctx, qcancel := cancelOn(r.Context(), stopch)
+	release, err := cs.Admission.Acquire(qctx, key, max, nil)
+	qcancel()
+	if err == context.Canceled && r.Context().Err() == nil {
+		err = errShuttingDown
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		log.WithError(err).Warn("judge rejected by admission control")
+		errorsTotal.WithLabelValues("admission").Inc()
+		return
+	}
+	defer release()
+	sessionsTotal.WithLabelValues(req.Language, "judge").Inc()
+
+	// run test cases one at a time, stopping if the server is shutting down
+	ctx, cancel := cancelOn(r.Context(), killch)
+	defer cancel()
+	res := JudgeResult{
+		ID:    id,
+		Cases: make([]CaseResult, len(req.Cases)),
+	}
+
+	// compile code
+	cc := lang.RunContainer
+	cres, build, err := compileBatch(ctx, cc, &cs.SessionConfig, []byte(req.Code))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to compile: %s", err.Error()), http.StatusInternalServerError)
+		log.WithError(err).Error("failed to compile")
+		errorsTotal.WithLabelValues("compile").Inc()
+		return
+	}
+	res.Compile = cres
+
+	for i, tc := range req.Cases {
+		// skip cases if the code did not compile
+		if cres != nil && !cres.Success {
+			res.Cases[i] = CaseResult{Verdict: VerdictCompileError}
+			continue
+		}
+
+		// select time limit
+		timeout := cs.Exec.timeout(tc.TimeLimit)
+
+		// run case
+		er, err := runBatch(ctx, cc, &cs.SessionConfig, []byte(req.Code), build, []byte(tc.Stdin), timeout, cs.Exec.MaxOutputSize, false)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to run test case %d: %s", i+1, err.Error()), http.StatusInternalServerError)
+			log.WithError(err).WithField("case", i+1).Error("failed to run test case")
+			errorsTotal.WithLabelValues("judge").Inc()
+			return
+		}
+		res.Cases[i] = judgeCase(er, tc, req.Compare, tol)
+		if res.Cases[i].Verdict == VerdictPassed {
+			res.Passed++
+		}
+	}
+	log.WithFields(logrus.Fields{
+		"cases":  len(res.Cases),
+		"passed": res.Passed,
+	}).Info("judge finished")
+
+	// send result
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComparator(t *testing.T) {
+	tbl := []struct {
+		cmp      Comparator
+		output   string
+		expected string
+		match    bool
+	}{
+		{CompareExact, "3\n", "3\n", true},
+		{CompareExact, "3", "3\n", false},
+		{CompareWhitespace, "1  2\n3 \n", "1 2\n3", true},
+		{CompareWhitespace, "1 2", "1 2 3", false},
+		{CompareWhitespace, "1.0", "1", false},
+		{CompareFloat, "0.3333333 x\n", "0.33333333 x", true},
+		{CompareFloat, "1000000.5", "1000000", true},
+		{CompareFloat, "0.34", "0.33", false},
+		{CompareFloat, "1 y", "1 x", false},
+	}
+	for _, v := range tbl {
+		if match := v.cmp.match(v.output, v.expected, defaultTolerance); match != v.match {
+			t.Errorf("%s comparison of %q with %q: expected %v but got %v", v.cmp, v.output, v.expected, v.match, match)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tbl := []struct {
+		output   string
+		expected string
+		diff     string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{"a\nc\n", "a\nb\n", "@@ line 2 @@\n-b\n+c"},
+		{"a\n", "a\nb\n", "@@ line 2 @@\n-b\n+\n@@ line 3 @@\n-"},
+	}
+	for _, v := range tbl {
+		if diff := diffLines(v.output, v.expected); diff != v.diff {
+			t.Errorf("diff of %q and %q: expected %q but got %q", v.output, v.expected, v.diff, diff)
+		}
+	}
+}
+
+func TestJudgeCase(t *testing.T) {
+	tbl := []struct {
+		res     ExecResult
+		verdict Verdict
+	}{
+		{ExecResult{Stdout: "3\n"}, VerdictPassed},
+		{ExecResult{Stdout: "3\n", Stderr: "warning", Truncated: true}, VerdictPassed},
+		{ExecResult{Stdout: "3\n", Truncated: true, stdoutTruncated: true}, VerdictWrongAnswer},
+		{ExecResult{Stdout: "3\n", ExitCode: 1}, VerdictRuntimeError},
+		{ExecResult{TimedOut: true}, VerdictTimeLimit},
+		{ExecResult{OOMKilled: true, ExitCode: 137}, VerdictMemoryLimit},
+	}
+	for _, v := range tbl {
+		if cr := judgeCase(v.res, JudgeCase{Expected: "3\n"}, CompareExact, defaultTolerance); cr.Verdict != v.verdict {
+			t.Errorf("expected %q for %+v but got %q", v.verdict, v.res, cr.Verdict)
+		}
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	ec := ExecConfig{DefaultTimeout: time.Second, MaxTimeout: 10 * time.Second}
+	tbl := []struct {
+		secs    float64
+		timeout time.Duration
+	}{
+		{0, time.Second},
+		{-1, time.Second},
+		{0.5, 500 * time.Millisecond},
+		{20, 10 * time.Second},
+		{1e12, 10 * time.Second},
+	}
+	for _, v := range tbl {
+		if timeout := ec.timeout(v.secs); timeout != v.timeout {
+			t.Errorf("expected %v for %v seconds but got %v", v.timeout, v.secs, timeout)
+		}
+	}
+}
+
+func TestHandleJudge(t *testing.T) {
+	// the program adds two numbers, or misbehaves on request
+	srv, ts := newTestServer(func(stdin io.Reader, stdout io.Writer, files map[string][]byte) int {
+		dat, _ := ioutil.ReadAll(stdin)
+		switch strings.TrimSpace(string(dat)) {
+		case "crash":
+			return 1
+		case "loop":
+			for {
+				_, err := io.WriteString(stdout, ".")
+				if err != nil {
+					return 1
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		var a, b int
+		fmt.Sscan(string(dat), &a, &b)
+		fmt.Fprintln(stdout, a+b)
+		return 0
+	})
+	ts.Close()
+	srv.Exec = ExecConfig{
+		MaxRequestSize: 1 << 20,
+		MaxOutputSize:  1024,
+		DefaultTimeout: time.Second,
+		MaxTimeout:     time.Second,
+		MaxCases:       4,
+	}
+
+	// judge sends a judge request and decodes the result
+	judge := func(req JudgeRequest) (int, JudgeResult) {
+		dat, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		srv.HandleJudge(w, httptest.NewRequest(http.MethodPost, "/judge", bytes.NewReader(dat)))
+		var res JudgeResult
+		if w.Code == http.StatusOK {
+			err := json.NewDecoder(w.Body).Decode(&res)
+			if err != nil {
+				t.Fatalf("failed to decode result: %s", err.Error())
+			}
+		}
+		return w.Code, res
+	}
+
+	code, res := judge(JudgeRequest{
+		Language: "test",
+		Code:     "add",
+		Cases: []JudgeCase{
+			{Stdin: "1 2", Expected: "3\n"},
+			{Stdin: "2 2", Expected: "5\n"},
+			{Stdin: "crash"},
+			{Stdin: "loop", TimeLimit: 0.05},
+		},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	expect := []Verdict{VerdictPassed, VerdictWrongAnswer, VerdictRuntimeError, VerdictTimeLimit}
+	if len(res.Cases) != len(expect) {
+		t.Fatalf("expected %d results but got %+v", len(expect), res.Cases)
+	}
+	for i, v := range expect {
+		if res.Cases[i].Verdict != v {
+			t.Errorf("expected case %d to be %q but got %+v", i+1, v, res.Cases[i])
+		}
+	}
+	if res.Passed != 1 {
+		t.Errorf("expected 1 passed case but got %d", res.Passed)
+	}
+	if res.Cases[1].Diff != "@@ line 1 @@\n-5\n+4" {
+		t.Errorf("unexpected diff %q", res.Cases[1].Diff)
+	}
+
+	// invalid requests are rejected
+	for _, req := range []JudgeRequest{
+		{Language: "test"},
+		{Language: "test", Cases: make([]JudgeCase, 5)},
+		{Language: "test", Cases: make([]JudgeCase, 1), Compare: "fuzzy"},
+		{Language: "none", Cases: make([]JudgeCase, 1)},
+	} {
+		if code, _ := judge(req); code != http.StatusBadRequest {
+			t.Errorf("expected status %d for %+v but got %d", http.StatusBadRequest, req, code)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+)
+
+// ByteSize is a size in bytes.
+// In JSON, it may be either a number of bytes or a human-readable string such as "256m".
+type ByteSize int64
+
+// UnmarshalJSON unmarshals a ByteSize from a JSON number or string.
+func (bs *ByteSize) UnmarshalJSON(dat []byte) error {
+	// handle raw number of bytes
+	var n int64
+	if err := json.Unmarshal(dat, &n); err == nil {
+		*bs = ByteSize(n)
+		return nil
+	}
+
+	// parse human-readable size
+	var str string
+	err := json.Unmarshal(dat, &str)
+	if err != nil {
+		return err
+	}
+	n, err = units.RAMInBytes(str)
+	if err != nil {
+		return err
+	}
+	*bs = ByteSize(n)
+
+	return nil
+}
+
+func (bs ByteSize) String() string {
+	return units.BytesSize(float64(bs))
+}
+
+// ResourceLimits is a set of resource limits for a container.
+// A zero value for any limit means that it is unset.
+type ResourceLimits struct {
+	// CPU is the number of CPUs which the container may use.
+	CPU float64 `json:"cpu,omitempty"`
+
+	// Memory is the memory limit of the container.
+	Memory ByteSize `json:"memory,omitempty"`
+
+	// Pids is the maximum number of processes in the container.
+	Pids int64 `json:"pids,omitempty"`
+
+	// Tmpfs is the size of a tmpfs mounted at /tmp.
+	Tmpfs ByteSize `json:"tmpfs,omitempty"`
+
+	// Disk is the size limit of the container's writable layer.
+	// This is only supported by some Docker storage drivers.
+	Disk ByteSize `json:"disk,omitempty"`
+}
+
+// Override returns a copy of rl with all limits set in o replacing those in rl.
+func (rl ResourceLimits) Override(o ResourceLimits) ResourceLimits {
+	if o.CPU != 0 {
+		rl.CPU = o.CPU
+	}
+	if o.Memory != 0 {
+		rl.Memory = o.Memory
+	}
+	if o.Pids != 0 {
+		rl.Pids = o.Pids
+	}
+	if o.Tmpfs != 0 {
+		rl.Tmpfs = o.Tmpfs
+	}
+	if o.Disk != 0 {
+		rl.Disk = o.Disk
+	}
+	return rl
+}
+
+// Check returns an error if any limit in rl exceeds the corresponding ceiling in max.
+// Ceilings which are unset in max are not enforced.
+func (rl ResourceLimits) Check(max ResourceLimits) error {
+	switch {
+	case rl.CPU < 0, rl.Memory < 0, rl.Pids < 0, rl.Tmpfs < 0, rl.Disk < 0:
+		return fmt.Errorf("negative resource limit in %+v", rl)
+	case max.CPU != 0 && rl.CPU > max.CPU:
+		return fmt.Errorf("cpu limit %v exceeds maximum %v", rl.CPU, max.CPU)
+	case max.Memory != 0 && rl.Memory > max.Memory:
+		return fmt.Errorf("memory limit %s exceeds maximum %s", rl.Memory, max.Memory)
+	case max.Pids != 0 && rl.Pids > max.Pids:
+		return fmt.Errorf("pids limit %d exceeds maximum %d", rl.Pids, max.Pids)
+	case max.Tmpfs != 0 && rl.Tmpfs > max.Tmpfs:
+		return fmt.Errorf("tmpfs limit %s exceeds maximum %s", rl.Tmpfs, max.Tmpfs)
+	case max.Disk != 0 && rl.Disk > max.Disk:
+		return fmt.Errorf("disk limit %s exceeds maximum %s", rl.Disk, max.Disk)
+	}
+	return nil
+}
+
+// apply applies the limits to a container HostConfig.
+func (rl ResourceLimits) apply(hc *container.HostConfig) {
+	if rl.CPU != 0 {
+		hc.NanoCPUs = int64(rl.CPU * 1e9)
+	}
+	if rl.Memory != 0 {
+		hc.Memory = int64(rl.Memory)
+	}
+	if rl.Pids != 0 {
+		hc.PidsLimit = rl.Pids
+	}
+	if rl.Tmpfs != 0 {
+		if hc.Tmpfs == nil {
+			hc.Tmpfs = map[string]string{}
+		}
+		hc.Tmpfs["/tmp"] = "rw,exec,size=" + strconv.FormatInt(int64(rl.Tmpfs), 10)
+	}
+	if rl.Disk != 0 {
+		if hc.StorageOpt == nil {
+			hc.StorageOpt = map[string]string{}
+		}
+		hc.StorageOpt["size"] = strconv.FormatInt(int64(rl.Disk), 10)
+	}
+}
+
+// LimitPolicy is a server-wide policy for container resource limits.
+type LimitPolicy struct {
+	// Default is the set of limits used where a language does not set its own.
+	Default ResourceLimits `json:"default"`
+
+	// Max is the set of ceilings which the limits of a container may not exceed.
+	Max ResourceLimits `json:"max"`
+}
+
+// Resolve applies a language's limits over the defaults and checks them against the ceilings.
+func (lp LimitPolicy) Resolve(rl ResourceLimits) (ResourceLimits, error) {
+	rl = lp.Default.Override(rl)
+	err := rl.Check(lp.Max)
+	if err != nil {
+		return ResourceLimits{}, err
+	}
+	return rl, nil
+}
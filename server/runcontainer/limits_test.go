@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestByteSizeJSON(t *testing.T) {
+	tbl := []struct {
+		json   string
+		expect ByteSize
+	}{
+		{`1024`, 1024},
+		{`"1k"`, 1 << 10},
+		{`"128m"`, 128 << 20},
+		{`"2GB"`, 2 << 30},
+	}
+	for _, v := range tbl {
+		var bs ByteSize
+		err := json.Unmarshal([]byte(v.json), &bs)
+		if err != nil {
+			t.Errorf("failed to unmarshal %s: %s", v.json, err.Error())
+			continue
+		}
+		if bs != v.expect {
+			t.Errorf("expected %d from %s but got %d", v.expect, v.json, bs)
+		}
+	}
+	var bs ByteSize
+	if err := json.Unmarshal([]byte(`"lots"`), &bs); err == nil {
+		t.Errorf("expected error for invalid size")
+	}
+}
+
+func TestLimitPolicy(t *testing.T) {
+	lp := LimitPolicy{
+		Default: ResourceLimits{
+			CPU:    0.5,
+			Memory: 128 << 20,
+		},
+		Max: ResourceLimits{
+			CPU:    2,
+			Memory: 1 << 30,
+		},
+	}
+	tbl := []struct {
+		lang   ResourceLimits
+		expect ResourceLimits
+		err    bool
+	}{
+		{
+			lang:   ResourceLimits{},
+			expect: lp.Default,
+		},
+		{
+			lang: ResourceLimits{Memory: 512 << 20, Pids: 64},
+			expect: ResourceLimits{
+				CPU:    0.5,
+				Memory: 512 << 20,
+				Pids:   64,
+			},
+		},
+		{
+			lang: ResourceLimits{Memory: 2 << 30},
+			err:  true,
+		},
+		{
+			lang: ResourceLimits{CPU: 4},
+			err:  true,
+		},
+		{
+			lang: ResourceLimits{Tmpfs: -1},
+			err:  true,
+		},
+	}
+	for _, v := range tbl {
+		got, err := lp.Resolve(v.lang)
+		switch {
+		case v.err && err == nil:
+			t.Errorf("expected error for %+v but got %+v", v.lang, got)
+		case !v.err && err != nil:
+			t.Errorf("unexpected error for %+v: %s", v.lang, err.Error())
+		case !v.err && got != v.expect:
+			t.Errorf("expected %+v but got %+v", v.expect, got)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// setupLogging configures the global logger with a level name (e.g. "info") and a format ("json" or "text").
+func setupLogging(level, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
+	switch format {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// logger returns a logger with fields identifying the session.
+// The session ID is sent to the client with the first status update, so that reports can be matched to logs.
+func (cs *ContainerSession) logger() *logrus.Entry {
+	fields := logrus.Fields{
+		"session":  cs.ID,
+		"language": cs.Language,
+		"mode":     sessionMode(cs.IsRun),
+	}
+	if cs.Container != nil {
+		fields["container"] = cs.Container.ID
+	}
+	return logrus.WithFields(fields)
+}
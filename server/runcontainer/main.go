@@ -1,28 +1,161 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/docker/docker/client"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 func main() {
-	dcli, err := client.NewEnvClient()
+	// the process runtime re-executes the server to start sandboxed processes
+	if len(os.Args) > 1 && os.Args[1] == sandboxInitArg {
+		sandboxInit(os.Args[2:])
+		return
+	}
+
+	var admintok, rtname, sandboxdir, seccomp, ociruntime, tokensfile string
+	var loglevel, logformat string
+	var nons, trustproxy bool
+	var maxcontainers, maxperclient int
+	var draintimeout, reapinterval time.Duration
+	var recordingstore string
+	flag.StringVar(&admintok, "admin-token", os.Getenv("OPENREPL_ADMIN_TOKEN"), "bearer token for the admin API (disabled if empty)")
+	flag.StringVar(&rtname, "runtime", "docker", "container runtime (docker or process)")
+	flag.StringVar(&sandboxdir, "sandbox-dir", "", "directory for the files of the process runtime (default is the system temporary directory)")
+	flag.BoolVar(&nons, "sandbox-no-namespaces", false, "disable namespace isolation in the process runtime")
+	flag.StringVar(&seccomp, "seccomp", "", "path of a seccomp profile for containers (default is the Docker profile)")
+	flag.StringVar(&ociruntime, "oci-runtime", "", "OCI runtime for containers, such as runsc (default is the Docker default)")
+	flag.IntVar(&maxcontainers, "max-containers", 64, "maximum number of concurrently running containers (0 for unlimited)")
+	flag.IntVar(&maxperclient, "max-per-client", 4, "maximum number of concurrently running containers per client IP (0 for unlimited)")
+	flag.StringVar(&tokensfile, "api-tokens", "", "JSON file of API tokens mapped to their concurrent container limits")
+	flag.BoolVar(&trustproxy, "trust-proxy", true, "identify clients by the X-Real-IP header set by the reverse proxy")
+	flag.StringVar(&loglevel, "log-level", "info", "minimum level of logged messages (debug, info, warning or error)")
+	flag.StringVar(&logformat, "log-format", "json", "log format (json or text)")
+	flag.DurationVar(&draintimeout, "drain-timeout", time.Minute, "amount of time for which running sessions may continue after a shutdown signal")
+	flag.StringVar(&recordingstore, "recording-store", "http://store/recording", "URL of the recording endpoint of the store service (recording is disabled if empty)")
+	flag.DurationVar(&reapinterval, "reap-interval", 5*time.Minute, "amount of time between checks for orphaned containers")
+	flag.Parse()
+	err := setupLogging(loglevel, logformat)
+	if err != nil {
+		panic(err)
+	}
+
+	// generate instance ID, with which containers are labeled
+	instance, err := newSessionID()
 	if err != nil {
 		panic(err)
 	}
+
+	// set up container runtime
+	var rt Runtime
+	switch rtname {
+	case "docker":
+		dcli, err := client.NewEnvClient()
+		if err != nil {
+			panic(err)
+		}
+		rt = &DockerRuntime{Client: dcli, Instance: instance}
+	case "process":
+		rt, err = newProcessRuntime(sandboxdir, nons, instance)
+		if err != nil {
+			panic(err)
+		}
+	default:
+		panic(fmt.Errorf("unknown runtime %q", rtname))
+	}
 	srv := &ContainerServer{
+		AdminToken:     admintok,
+		TrustProxy:     trustproxy,
+		PoolMaxAge:     10 * time.Minute,
+		PoolRefillRate: 5 * time.Second,
+		Exec: ExecConfig{
+			MaxRequestSize: 1 << 20,
+			MaxOutputSize:  1 << 20,
+			DefaultTimeout: 10 * time.Second,
+			MaxTimeout:     time.Minute,
+			MaxCases:       64,
+		},
+		Admission: AdmissionController{
+			Limits: AdmissionLimits{
+				MaxContainers:     maxcontainers,
+				MaxPerClient:      maxperclient,
+				MaxQueue:          256,
+				MaxQueuePerClient: 4,
+				QueueTimeout:      5 * time.Minute,
+			},
+		},
 		SessionConfig: ContainerSessionConfig{
 			OutputBufferSize:     1024,
 			ShutdownTimeout:      10 * time.Second,
-			DockerClient:         dcli,
+			Runtime:              rt,
 			ContainerStopTimeout: time.Minute,
 			StartTimeout:         time.Minute,
 			SessionTimeout:       time.Hour,
+			TimeoutWarning:       5 * time.Minute,
+			KillGracePeriod:      5 * time.Second,
 			PingRate:             30 * time.Second,
+			ReconnectGrace:       time.Minute,
+			ReplayBufferSize:     64 << 10,
+			RecordingStore:       recordingstore,
+			MaxRecordingSize:     8 << 20,
+			MaxParticipants:      16,
+			ClientQueueSize:      1 << 20,
+			MaxMessageSize:       64 << 10,
+			InputQueueSize:       1 << 20,
+			Compile: CompileLimits{
+				DefaultTimeout: time.Minute,
+				MaxOutputSize:  1 << 20,
+				MaxBuildSize:   256 << 20,
+			},
+			Projects: ProjectLimits{
+				MaxUploadSize: 8 << 20,
+				MaxSize:       8 << 20,
+				MaxFiles:      256,
+				MaxStdinSize:  1 << 20,
+			},
+			Artifacts: ArtifactLimits{
+				MaxSize:  16 << 20,
+				MaxFiles: 64,
+			},
+			ArtifactStore: &ArtifactStore{TTL: 10 * time.Minute, MaxSize: 256 << 20},
+			Security: SecurityProfile{
+				DropCapabilities: setting(true),
+				NoNewPrivileges:  setting(true),
+				ReadOnlyRoot:     setting(true),
+				Writable:         []string{"/tmp"},
+				User:             "65534:65534",
+				Ulimits: map[string]int64{
+					"core":   0,
+					"nofile": 1024,
+				},
+				Seccomp: seccomp,
+				Runtime: ociruntime,
+			},
+			Limits: LimitPolicy{
+				Default: ResourceLimits{
+					CPU:    0.5,
+					Memory: 128 << 20,
+					Pids:   256,
+					Tmpfs:  64 << 20,
+				},
+				Max: ResourceLimits{
+					CPU:    2,
+					Memory: 1 << 30,
+					Pids:   1024,
+					Tmpfs:  256 << 20,
+					Disk:   2 << 30,
+				},
+			},
 		},
 	}
 	f, err := os.Open("langs.json")
@@ -33,7 +166,94 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+
+	// load API tokens
+	if tokensfile != "" {
+		tf, err := os.Open(tokensfile)
+		if err != nil {
+			panic(err)
+		}
+		err = json.NewDecoder(tf).Decode(&srv.Admission.Limits.Tokens)
+		tf.Close()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// check language resource limits and security profiles against the policy
+	for name, lang := range srv.Containers {
+		for _, cc := range []ContainerConfig{lang.RunContainer, lang.TermContainer} {
+			_, err = srv.SessionConfig.Limits.Resolve(cc.Limits)
+			if err != nil {
+				panic(fmt.Errorf("invalid limits for %s: %s", name, err.Error()))
+			}
+			err = srv.SessionConfig.Security.Override(cc.Security).Check()
+			if err != nil {
+				panic(fmt.Errorf("invalid security profile for %s: %s", name, err.Error()))
+			}
+			if _, ok := diagnosticParsers[cc.Diagnostics]; cc.Diagnostics != "" && !ok {
+				panic(fmt.Errorf("unknown diagnostic parser %q for %s", cc.Diagnostics, name))
+			}
+		}
+
+		// code cannot be copied into a read-only root filesystem
+		rc := lang.RunContainer
+		if rc.CodeDir == "" && isSet(srv.SessionConfig.Security.Override(rc.Security).ReadOnlyRoot) {
+			panic(fmt.Errorf("run container for %s has a read-only root filesystem, so it needs a codedir", name))
+		}
+	}
+
+	// remove containers left behind by previous instances, and periodically check for leaked containers
+	// containers of other instances are kept for as long as they could be in use: idle in a pool, then compiling and running a session which may be drained
+	sc := &srv.SessionConfig
+	reaper := &Reaper{
+		Runtime:   rt,
+		Instance:  instance,
+		OrphanAge: srv.PoolMaxAge + 2*sc.StartTimeout + sc.Compile.DefaultTimeout + sc.SessionTimeout + draintimeout,
+		Live:      liveContainers.has,
+		MinAge:    time.Minute,
+		Interval:  reapinterval,
+		Timeout:   time.Minute,
+	}
+	reaper.Start()
+
+	// start container pools
+	srv.StartPools()
+
+	// drain sessions and remove containers on shutdown
+	hsrv := &http.Server{Addr: ":80"}
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	donech := make(chan error, 1)
+	go func() {
+		sig := <-sigch
+		logrus.WithField("signal", sig.String()).Info("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), draintimeout)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		reaper.Close()
+		hsrv.Close()
+		donech <- err
+	}()
+
 	http.HandleFunc("/term", srv.HandleTerminal)
 	http.HandleFunc("/run", srv.HandleRun)
-	panic(http.ListenAndServe(":80", nil))
+	http.HandleFunc("/exec", srv.HandleExec)
+	http.HandleFunc("/judge", srv.HandleJudge)
+	http.HandleFunc("/signal", srv.HandleSignal)
+	http.HandleFunc("/attach", srv.HandleReattach)
+	http.HandleFunc("/artifacts", srv.HandleArtifacts)
+	srv.registerAdmin(http.DefaultServeMux)
+	registerAdmissionMetrics(&srv.Admission)
+	http.Handle("/metrics", promhttp.Handler())
+	logrus.WithField("instance", instance).Info("starting runcontainer")
+	err = hsrv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		panic(err)
+	}
+	err = <-donech
+	if err != nil {
+		logrus.WithError(err).Error("failed to shut down")
+		os.Exit(1)
+	}
 }
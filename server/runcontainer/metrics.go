@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// sessionsTotal counts started sessions by language and mode ("term", "run", "exec" or "judge").
+	sessionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "openrepl",
+		Name:      "sessions_total",
+		Help:      "Number of sessions started, by language and mode.",
+	}, []string{"language", "mode"})
+
+	// deployDuration tracks the latency of each phase of deploying a container.
+	deployDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "openrepl",
+		Name:      "deploy_duration_seconds",
+		Help:      "Latency of deploying containers, by phase.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"phase"})
+
+	// containersActive is the number of containers which have been created and not yet removed.
+	containersActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "openrepl",
+		Name:      "containers_active",
+		Help:      "Number of containers which have been created and not yet removed, including pooled containers.",
+	})
+
+	// sessionBytes counts bytes sent between clients and containers, by direction ("in" or "out").
+	sessionBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "openrepl",
+		Name:      "session_bytes_total",
+		Help:      "Number of bytes sent to (in) and received from (out) containers.",
+	}, []string{"direction"})
+
+	// errorsTotal counts failures by the stage at which they occurred.
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "openrepl",
+		Name:      "errors_total",
+		Help:      "Number of errors, by stage.",
+	}, []string{"stage"})
+
+	// containersReaped counts containers removed by the reaper, by reason ("orphan" or "leaked").
+	containersReaped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "openrepl",
+		Name:      "containers_reaped_total",
+		Help:      "Number of orphaned containers removed by the reaper, by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(sessionsTotal, deployDuration, containersActive, sessionBytes, errorsTotal, containersReaped)
+}
+
+// observePhase records the latency of a deploy phase which started at start.
+func observePhase(phase string, start time.Time) {
+	deployDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+}
+
+// sessionMode returns the metric label for the mode of a session.
+func sessionMode(isrun bool) string {
+	if isrun {
+		return "run"
+	}
+	return "term"
+}
+
+// registerAdmissionMetrics exports the statistics of an AdmissionController.
+func registerAdmissionMetrics(ac *AdmissionController) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "openrepl",
+			Name:      "admission_running",
+			Help:      "Number of containers admitted by admission control.",
+		}, func() float64 { return float64(ac.Stats().Running) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "openrepl",
+			Name:      "admission_queued",
+			Help:      "Number of requests waiting for admission.",
+		}, func() float64 { return float64(ac.Stats().Queued) }),
+	)
+}
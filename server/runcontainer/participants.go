@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Role is the role of a participant in a session.
+type Role string
+
+const (
+	// RoleOwner is the role of the client which started the session.
+	// The owner may send input and control messages, and receives the tokens with which others can join.
+	// The session ends when the owner leaves.
+	RoleOwner Role = "owner"
+
+	// RoleWriter is the role of participants who may send input and signals.
+	RoleWriter Role = "writer"
+
+	// RoleViewer is the role of participants who may only watch the output.
+	RoleViewer Role = "viewer"
+)
+
+// canWrite returns whether participants with the role may send input to the container.
+func (r Role) canWrite() bool {
+	return r == RoleOwner || r == RoleWriter
+}
+
+// maxNameLength is the maximum length of a participant name, in runes.
+const maxNameLength = 32
+
+// cleanName sanitizes a participant name, removing control characters and truncating it to maxNameLength.
+func cleanName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if r := []rune(name); len(r) > maxNameLength {
+		name = string(r[:maxNameLength])
+	}
+	return name
+}
+
+// ParticipantInfo is a summary of a participant in a session.
+type ParticipantInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	Role Role   `json:"role"`
+}
+
+// errSessionFull is an error indicating that a client could not join a session because it has too many participants.
+var errSessionFull = errors.New("session has too many participants")
+
+// addClient adds a client to the session, assigning it a participant ID.
+// The caller must hold clck.
+func (cs *ContainerSession) addClient(c *sessionClient) {
+	cs.nextParticipant++
+	c.id = strconv.Itoa(cs.nextParticipant)
+	cs.clients = append(cs.clients, c)
+}
+
+// removeClient removes a client from the session.
+// Returns false if the client was not attached.
+// The caller must hold clck.
+func (cs *ContainerSession) removeClient(c *sessionClient) bool {
+	for i, v := range cs.clients {
+		if v == c {
+			cs.clients = append(cs.clients[:i], cs.clients[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// owner returns the attached client of the owner, or nil if the owner is disconnected.
+// The caller must hold clck.
+func (cs *ContainerSession) owner() *sessionClient {
+	for _, c := range cs.clients {
+		if c.role == RoleOwner {
+			return c
+		}
+	}
+	return nil
+}
+
+// Participants returns summaries of the participants attached to the session.
+func (cs *ContainerSession) Participants() []ParticipantInfo {
+	cs.clck.Lock()
+	defer cs.clck.Unlock()
+	infos := make([]ParticipantInfo, len(cs.clients))
+	for i, c := range cs.clients {
+		infos[i] = ParticipantInfo{
+			ID:   c.id,
+			Name: c.name,
+			Role: c.role,
+		}
+	}
+	return infos
+}
+
+// broadcastParticipants sends the list of participants to all clients with the "participants" status.
+// It is called whenever a participant joins or leaves.
+func (cs *ContainerSession) broadcastParticipants() {
+	err := cs.UpdateStatus(StatusUpdate{Status: "participants", Participants: cs.Participants()})
+	if err != nil {
+		cs.logger().WithError(err).Warn("failed to send participants")
+	}
+}
+
+// runningStatus returns the "running" status sent to a client when it attaches.
+// The owner is sent the session ID and the tokens with which others can join, while other participants are sent the token they joined with.
+// The session ID is withheld from other participants, as it authorizes signals.
+func (cs *ContainerSession) runningStatus(c *sessionClient) StatusUpdate {
+	su := StatusUpdate{
+		Status:      "running",
+		Role:        c.role,
+		Participant: c.id,
+	}
+	switch c.role {
+	case RoleOwner:
+		su.ID = cs.ID
+		su.Token = cs.Token
+		su.WriteToken = cs.WriteToken
+		su.ViewToken = cs.ViewToken
+	case RoleWriter:
+		su.Token = cs.WriteToken
+	case RoleViewer:
+		su.Token = cs.ViewToken
+	}
+	return su
+}
+
+// tokenRole returns the role granted by a token, or false if it is not a token of the session.
+func (cs *ContainerSession) tokenRole(token string) (Role, bool) {
+	for _, v := range []struct {
+		token string
+		role  Role
+	}{
+		{cs.Token, RoleOwner},
+		{cs.WriteToken, RoleWriter},
+		{cs.ViewToken, RoleViewer},
+	} {
+		if v.token != "" && subtle.ConstantTimeCompare([]byte(v.token), []byte(token)) == 1 {
+			return v.role, true
+		}
+	}
+	return "", false
+}
+
+// GetByToken looks up a session by one of its tokens, and returns the role granted by the token.
+// If there is no session with the token, returns nil.
+func (sr *SessionRegistry) GetByToken(token string) (*ContainerSession, Role) {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	for _, cs := range sr.sessions {
+		if role, ok := cs.tokenRole(token); ok {
+			return cs, role
+		}
+	}
+	return nil, ""
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// expectParticipants reads a "participants" status and checks the roles of the participants.
+func expectParticipants(t *testing.T, ws *websocket.Conn, roles ...Role) {
+	su := expectStatus(t, ws, "participants")
+	if len(su.Participants) != len(roles) {
+		t.Fatalf("expected %d participants but got %+v", len(roles), su.Participants)
+	}
+	for i, p := range su.Participants {
+		if p.Role != roles[i] {
+			t.Fatalf("expected participant %d to be %q but got %+v", i, roles[i], p)
+		}
+	}
+}
+
+func TestCleanName(t *testing.T) {
+	tbl := []struct {
+		in, out string
+	}{
+		{"alice", "alice"},
+		{"  bob\t", "bob"},
+		{"eve\x1b[31m", "eve[31m"},
+		{strings.Repeat("é", 40), strings.Repeat("é", maxNameLength)},
+	}
+	for _, v := range tbl {
+		if out := cleanName(v.in); out != v.out {
+			t.Errorf("cleanName(%q) = %q, expected %q", v.in, out, v.out)
+		}
+	}
+}
+
+func TestParticipants(t *testing.T) {
+	srv, ts := newTestServer(echoProgram)
+	defer ts.Close()
+	srv.SessionConfig.MaxParticipants = 3
+
+	// start session
+	owner := dialTest(t, ts, "/term", url.Values{"lang": {"test"}, "name": {"alice"}})
+	defer owner.Close()
+	expectStatus(t, owner, "starting")
+	su := expectStatus(t, owner, "running")
+	if su.Role != RoleOwner || su.WriteToken == "" || su.ViewToken == "" {
+		t.Fatalf("expected owner with join tokens but got %+v", su)
+	}
+	sendInput(t, owner, "a\n")
+	expectOutput(t, owner, "a\n")
+
+	// viewer joins and receives the buffered output
+	viewer := dialTest(t, ts, "/attach", url.Values{"token": {su.ViewToken}, "name": {"bob"}})
+	defer viewer.Close()
+	vsu := expectStatus(t, viewer, "running")
+	if vsu.Role != RoleViewer || vsu.Token != su.ViewToken || vsu.WriteToken != "" || vsu.ViewToken != "" || vsu.ID != "" {
+		t.Fatalf("unexpected viewer status %+v", vsu)
+	}
+	expectOutput(t, viewer, "a\n")
+	expectParticipants(t, viewer, RoleOwner, RoleViewer)
+	expectParticipants(t, owner, RoleOwner, RoleViewer)
+
+	// input from the viewer is ignored
+	sendInput(t, viewer, "x\n")
+
+	// writer joins
+	writer := dialTest(t, ts, "/attach", url.Values{"token": {su.WriteToken}})
+	defer writer.Close()
+	if wsu := expectStatus(t, writer, "running"); wsu.Role != RoleWriter {
+		t.Fatalf("unexpected writer status %+v", wsu)
+	}
+	expectOutput(t, writer, "a\n")
+	for _, ws := range []*websocket.Conn{writer, owner, viewer} {
+		expectParticipants(t, ws, RoleOwner, RoleViewer, RoleWriter)
+	}
+
+	// the session is full
+	extra := dialTest(t, ts, "/attach", url.Values{"token": {su.ViewToken}})
+	defer extra.Close()
+	if esu := expectStatus(t, extra, "error"); esu.Error != errSessionFull.Error() {
+		t.Errorf("expected session full error but got %+v", esu)
+	}
+
+	// output from the writer is fanned out to everyone
+	sendInput(t, writer, "b\n")
+	for _, ws := range []*websocket.Conn{owner, viewer, writer} {
+		expectOutput(t, ws, "b\n")
+	}
+
+	// viewer leaves
+	viewer.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	expectParticipants(t, owner, RoleOwner, RoleWriter)
+	expectParticipants(t, writer, RoleOwner, RoleWriter)
+
+	// the session ends when the owner leaves
+	owner.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	writer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := writer.ReadMessage()
+		if err != nil {
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+				t.Fatalf("writer was not disconnected")
+			}
+			break
+		}
+	}
+}
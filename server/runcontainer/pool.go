@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PoolSize is the size configuration of a ContainerPool.
+type PoolSize struct {
+	// MinIdle is the number of idle containers which the pool keeps ready.
+	MinIdle int `json:"min"`
+
+	// MaxIdle is the number of idle containers which the pool may grow to under load.
+	MaxIdle int `json:"max"`
+}
+
+// pooledContainer is an idle container in a ContainerPool.
+type pooledContainer struct {
+	c       *Container
+	created time.Time
+}
+
+// PoolStats is a set of statistics for a ContainerPool.
+type PoolStats struct {
+	Idle   int    `json:"idle"`
+	Target int    `json:"target"`
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// ContainerPool is a pool of pre-created containers for a ContainerConfig.
+// The pool keeps between Size.MinIdle and Size.MaxIdle containers ready, growing after misses and shrinking as containers go stale.
+type ContainerPool struct {
+	// accessed atomically
+	hits, misses uint64
+
+	// Config is the ContainerConfig used to create pooled containers.
+	Config ContainerConfig
+
+	// Size is the size configuration of the pool.
+	Size PoolSize
+
+	// MaxAge is the amount of time after which an idle container is considered stale and removed.
+	MaxAge time.Duration
+
+	// RefillRate is the amount of time between checks for stale containers and refills.
+	RefillRate time.Duration
+
+	// SessionConfig is the ContainerSessionConfig used to create containers.
+	SessionConfig *ContainerSessionConfig
+
+	lck      sync.Mutex
+	idle     []pooledContainer
+	target   int
+	closed   bool
+	refillch chan struct{}
+	stopch   chan struct{}
+	donech   chan struct{}
+}
+
+// Start starts refilling the pool in the background.
+func (p *ContainerPool) Start() {
+	p.target = p.Size.MinIdle
+	p.refillch = make(chan struct{}, 1)
+	p.stopch = make(chan struct{})
+	p.donech = make(chan struct{})
+	go p.run()
+}
+
+// run is the refill loop of the pool.
+func (p *ContainerPool) run() {
+	defer close(p.donech)
+	tick := time.NewTicker(p.RefillRate)
+	defer tick.Stop()
+	for {
+		p.evict()
+		p.fill()
+
+		select {
+		case <-tick.C:
+		case <-p.refillch:
+		case <-p.stopch:
+			return
+		}
+	}
+}
+
+// requestRefill wakes up the refill loop.
+func (p *ContainerPool) requestRefill() {
+	select {
+	case p.refillch <- struct{}{}:
+	default:
+	}
+}
+
+// evict removes stale containers from the pool.
+func (p *ContainerPool) evict() {
+	// select stale containers
+	p.lck.Lock()
+	var stale []*Container
+	fresh := p.idle[:0]
+	for _, v := range p.idle {
+		if time.Since(v.created) > p.MaxAge {
+			stale = append(stale, v.c)
+		} else {
+			fresh = append(fresh, v)
+		}
+	}
+	p.idle = fresh
+
+	// shrink the pool back towards the minimum when containers go unused
+	p.target -= len(stale)
+	if p.target < p.Size.MinIdle {
+		p.target = p.Size.MinIdle
+	}
+	p.lck.Unlock()
+
+	// remove stale containers
+	for _, c := range stale {
+		c.Close()
+	}
+}
+
+// fill creates containers until the pool reaches its target size.
+func (p *ContainerPool) fill() {
+	for {
+		// check if more containers are needed
+		p.lck.Lock()
+		n := len(p.idle)
+		done := p.closed || n >= p.target
+		p.lck.Unlock()
+		if done {
+			return
+		}
+
+		// create container
+		ctx, cancel := context.WithTimeout(context.Background(), p.SessionConfig.StartTimeout)
+		c, err := p.Config.Create(ctx, p.SessionConfig.Runtime, p.SessionConfig.Limits, p.SessionConfig.Security, p.SessionConfig.ContainerStopTimeout, true)
+		cancel()
+		if err != nil {
+			logrus.WithError(err).WithField("image", p.Config.Image).Error("failed to create pooled container")
+			return
+		}
+
+		// add container to pool
+		p.lck.Lock()
+		closed := p.closed
+		if !closed {
+			p.idle = append(p.idle, pooledContainer{
+				c:       c,
+				created: time.Now(),
+			})
+		}
+		p.lck.Unlock()
+		if closed {
+			c.Close()
+			return
+		}
+	}
+}
+
+// Get takes an idle container from the pool.
+// The container has been created but not started.
+// If the pool is empty, Get returns nil and the pool grows.
+func (p *ContainerPool) Get() *Container {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	defer p.requestRefill()
+
+	// handle miss
+	if len(p.idle) == 0 {
+		atomic.AddUint64(&p.misses, 1)
+		if p.target < p.Size.MaxIdle {
+			p.target++
+		}
+		return nil
+	}
+
+	// take oldest container
+	c := p.idle[0].c
+	p.idle[0] = pooledContainer{}
+	p.idle = p.idle[1:]
+	atomic.AddUint64(&p.hits, 1)
+
+	return c
+}
+
+// Stats returns the current statistics of the pool.
+func (p *ContainerPool) Stats() PoolStats {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	return PoolStats{
+		Idle:   len(p.idle),
+		Target: p.target,
+		Hits:   atomic.LoadUint64(&p.hits),
+		Misses: atomic.LoadUint64(&p.misses),
+	}
+}
+
+// Close stops the pool and removes all idle containers.
+func (p *ContainerPool) Close() error {
+	// stop refill loop
+	close(p.stopch)
+	<-p.donech
+
+	// take all idle containers
+	p.lck.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.lck.Unlock()
+
+	// remove containers
+	var err error
+	for _, v := range idle {
+		cerr := v.c.Close()
+		if cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
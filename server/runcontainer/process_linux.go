@@ -0,0 +1,608 @@
+// +build linux
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// sandboxInitArg is the argument with which ProcessRuntime re-executes the server to start a sandboxed process.
+const sandboxInitArg = "-sandbox-init"
+
+// ProcessRuntime is a Runtime which runs languages as local processes, for development without Docker.
+// Each container is a process in its own temporary directory, isolated with Linux namespaces and resource limits.
+// Absolute paths in the container command and filesystem are mapped into the temporary directory.
+// Security profiles are not applied, and the isolation is much weaker than that of Docker, so it must not be used to run untrusted code.
+// Processes are killed if the server exits, so they are never left behind by previous instances.
+type ProcessRuntime struct {
+	// TempDir is the directory in which the directories of containers are created.
+	// If empty, the default directory for temporary files is used.
+	TempDir string
+
+	// NoNamespaces disables isolation with Linux namespaces, for systems without unprivileged user namespaces.
+	NoNamespaces bool
+
+	// Instance is the ID of this instance of the service, reported for all processes by List.
+	Instance string
+
+	lck   sync.Mutex
+	procs map[string]*process
+}
+
+// newProcessRuntime creates a ProcessRuntime.
+func newProcessRuntime(tmpdir string, nons bool, instance string) (Runtime, error) {
+	return &ProcessRuntime{
+		TempDir:      tmpdir,
+		NoNamespaces: nons,
+		Instance:     instance,
+	}, nil
+}
+
+// process is a container of a ProcessRuntime.
+type process struct {
+	dir     string
+	cmd     *exec.Cmd
+	created time.Time
+
+	// pty is the master side of the TTY of the process, or nil if it has no TTY.
+	pty *os.File
+
+	// stdin, stdout and stderr are the server ends of the standard streams of a process without a TTY.
+	stdin, stdout, stderr *os.File
+
+	// output is the stdcopy multiplexed output of a process without a TTY.
+	output *io.PipeReader
+	outw   *io.PipeWriter
+
+	// child is the set of files passed to the process, closed in the server once it starts.
+	child []*os.File
+
+	started bool
+	done    chan struct{}
+	status  ExitStatus
+}
+
+// path maps an absolute path in the container to a path in the directory of the process.
+func (p *process) path(cpath string) string {
+	return filepath.Join(p.dir, filepath.Clean("/"+cpath))
+}
+
+// closeFiles closes all of the files of the process which are still open.
+func (p *process) closeFiles() {
+	for _, f := range append(p.child, p.pty, p.stdin, p.stdout, p.stderr) {
+		if f != nil {
+			f.Close()
+		}
+	}
+	if p.output != nil {
+		p.output.Close()
+	}
+}
+
+// ioctl runs an ioctl syscall.
+func ioctl(fd, req, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPty opens a new pseudo-terminal.
+func openPty() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			master.Close()
+		}
+	}()
+
+	// unlock slave
+	var unlock int32
+	err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// open slave
+	var n uint32
+	err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	if err != nil {
+		return nil, nil, err
+	}
+	slave, err = os.OpenFile("/dev/pts/"+strconv.FormatUint(uint64(n), 10), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return master, slave, nil
+}
+
+// Create creates a container without starting it, and returns its ID.
+func (pr *ProcessRuntime) Create(ctx context.Context, opts CreateOptions) (id string, err error) {
+	if len(opts.Entrypoint) == 0 {
+		return "", fmt.Errorf("image %s has no local entrypoint", opts.Image)
+	}
+
+	// create directory
+	dir, err := ioutil.TempDir(pr.TempDir, "openrepl-")
+	if err != nil {
+		return "", err
+	}
+	p := &process{
+		dir:     dir,
+		created: time.Now(),
+		done:    make(chan struct{}),
+	}
+	defer func() {
+		if err != nil {
+			p.closeFiles()
+			os.RemoveAll(dir)
+		}
+	}()
+
+	// run the entrypoint through the sandbox init, which applies resource limits
+	args := []string{
+		sandboxInitArg,
+		strconv.FormatInt(int64(opts.Limits.Memory), 10),
+		strconv.FormatInt(int64(opts.Limits.Disk), 10),
+		"--",
+	}
+	args = append(args, opts.Entrypoint...)
+	for _, v := range opts.Command {
+		if path.IsAbs(v) {
+			v = p.path(v)
+		}
+		args = append(args, v)
+	}
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.Dir = dir
+	if opts.WorkDir != "" {
+		cmd.Dir = p.path(opts.WorkDir)
+		err = os.MkdirAll(cmd.Dir, 0755)
+		if err != nil {
+			return "", err
+		}
+	}
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + dir,
+		"TMPDIR=" + dir,
+	}
+
+	// isolate the process in its own session and namespaces
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Pdeathsig: syscall.SIGKILL}
+	if !pr.NoNamespaces {
+		cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	}
+
+	// set up standard streams
+	if opts.Tty {
+		master, slave, err := openPty()
+		if err != nil {
+			return "", err
+		}
+		p.pty = master
+		p.child = []*os.File{slave}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+		cmd.SysProcAttr.Setctty = true
+		cmd.Env = append(cmd.Env, "TERM=xterm")
+	} else {
+		var stdin, stdout, stderr *os.File
+		stdin, p.stdin, err = os.Pipe()
+		if err != nil {
+			return "", err
+		}
+		p.child = append(p.child, stdin)
+		p.stdout, stdout, err = os.Pipe()
+		if err != nil {
+			return "", err
+		}
+		p.child = append(p.child, stdout)
+		p.stderr, stderr, err = os.Pipe()
+		if err != nil {
+			return "", err
+		}
+		p.child = append(p.child, stderr)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+		p.output, p.outw = io.Pipe()
+	}
+	p.cmd = cmd
+
+	// register process
+	id, err = newSessionID()
+	if err != nil {
+		return "", err
+	}
+	pr.lck.Lock()
+	defer pr.lck.Unlock()
+	if pr.procs == nil {
+		pr.procs = map[string]*process{}
+	}
+	pr.procs[id] = p
+
+	return id, nil
+}
+
+// get looks up a process by ID.
+func (pr *ProcessRuntime) get(id string) (*process, error) {
+	pr.lck.Lock()
+	defer pr.lck.Unlock()
+	p, ok := pr.procs[id]
+	if !ok {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+	return p, nil
+}
+
+// CopyTo extracts a tar archive into a directory in the filesystem of a container.
+func (pr *ProcessRuntime) CopyTo(ctx context.Context, id string, dir string, tarball io.Reader) error {
+	p, err := pr.get(id)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(tarball)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := p.path(path.Join(dir, hdr.Name))
+		mode := os.FileMode(hdr.Mode) & os.ModePerm
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+			if err == nil {
+				err = os.Chmod(target, mode)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			var f *os.File
+			f, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			cerr := f.Close()
+			if err == nil {
+				err = cerr
+			}
+		default:
+			err = fmt.Errorf("unsupported file type for %q", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CopyFrom returns a tar archive of a path in the filesystem of a container.
+// Symbolic links are not followed.
+func (pr *ProcessRuntime) CopyFrom(ctx context.Context, id string, cpath string) (io.ReadCloser, error) {
+	p, err := pr.get(id)
+	if err != nil {
+		return nil, err
+	}
+	root := p.path(cpath)
+	_, err = os.Lstat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// stream tarball through pipe
+	r, w := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(w)
+		base := filepath.Base(root)
+		err := filepath.Walk(root, func(fp string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() && !fi.Mode().IsRegular() {
+				return nil
+			}
+
+			// write header
+			rel, err := filepath.Rel(root, fp)
+			if err != nil {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = path.Join(base, filepath.ToSlash(rel))
+			if fi.IsDir() {
+				hdr.Name += "/"
+			}
+			err = tw.WriteHeader(hdr)
+			if err != nil || fi.IsDir() {
+				return err
+			}
+
+			// copy file
+			f, err := os.Open(fp)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+// ptyStream is an io.ReadWriteCloser over the master side of a pseudo-terminal.
+type ptyStream struct {
+	*os.File
+}
+
+func (ps ptyStream) Read(dat []byte) (int, error) {
+	n, err := ps.File.Read(dat)
+	if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.EIO {
+		// all slaves were closed as the process exited
+		err = io.EOF
+	}
+	return n, err
+}
+
+// pipeStream is an io.ReadWriteCloser over the standard streams of a process without a TTY.
+type pipeStream struct {
+	p *process
+}
+
+func (ps pipeStream) Read(dat []byte) (int, error) {
+	return ps.p.output.Read(dat)
+}
+
+func (ps pipeStream) Write(dat []byte) (int, error) {
+	return ps.p.stdin.Write(dat)
+}
+
+func (ps pipeStream) CloseWrite() error {
+	return ps.p.stdin.Close()
+}
+
+func (ps pipeStream) Close() error {
+	ps.p.stdin.Close()
+	return ps.p.output.Close()
+}
+
+// Attach attaches to the standard streams of a container.
+func (pr *ProcessRuntime) Attach(ctx context.Context, id string) (io.ReadWriteCloser, error) {
+	p, err := pr.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if p.pty != nil {
+		return ptyStream{p.pty}, nil
+	}
+	return pipeStream{p}, nil
+}
+
+// Start starts a container.
+func (pr *ProcessRuntime) Start(ctx context.Context, id string) error {
+	p, err := pr.get(id)
+	if err != nil {
+		return err
+	}
+
+	// start process
+	err = p.cmd.Start()
+	for _, f := range p.child {
+		f.Close()
+	}
+	p.child = nil
+	if err != nil {
+		return err
+	}
+	p.started = true
+
+	// multiplex output
+	if p.pty == nil {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			io.Copy(stdcopy.NewStdWriter(p.outw, stdcopy.Stdout), p.stdout)
+		}()
+		go func() {
+			defer wg.Done()
+			io.Copy(stdcopy.NewStdWriter(p.outw, stdcopy.Stderr), p.stderr)
+		}()
+		go func() {
+			wg.Wait()
+			p.outw.Close()
+		}()
+	}
+
+	// wait for exit
+	go func() {
+		defer close(p.done)
+		p.cmd.Wait()
+		ws, ok := p.cmd.ProcessState.Sys().(syscall.WaitStatus)
+		switch {
+		case !ok:
+			p.status.Code = 1
+		case ws.Signaled():
+			p.status.Code = 128 + int(ws.Signal())
+		default:
+			p.status.Code = ws.ExitStatus()
+		}
+	}()
+
+	return nil
+}
+
+// Resize resizes the TTY of a container.
+func (pr *ProcessRuntime) Resize(ctx context.Context, id string, cols, rows uint) error {
+	p, err := pr.get(id)
+	if err != nil {
+		return err
+	}
+	if p.pty == nil {
+		return errors.New("container has no TTY")
+	}
+	ws := struct {
+		rows, cols, x, y uint16
+	}{uint16(rows), uint16(cols), 0, 0}
+	return ioctl(p.pty.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+// processSignals maps signal names to signals.
+var processSignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// Kill sends a signal to all processes in a container.
+func (pr *ProcessRuntime) Kill(ctx context.Context, id string, signal string) error {
+	p, err := pr.get(id)
+	if err != nil {
+		return err
+	}
+	sig, ok := processSignals[signal]
+	if !ok {
+		return fmt.Errorf("unsupported signal %q", signal)
+	}
+	if !p.started {
+		return errors.New("container is not running")
+	}
+	return syscall.Kill(-p.cmd.Process.Pid, sig)
+}
+
+// Wait waits for a container to exit and returns its exit status.
+func (pr *ProcessRuntime) Wait(ctx context.Context, id string) (ExitStatus, error) {
+	p, err := pr.get(id)
+	if err != nil {
+		return ExitStatus{}, err
+	}
+	if !p.started {
+		return ExitStatus{}, errors.New("container is not running")
+	}
+	select {
+	case <-p.done:
+		return p.status, nil
+	case <-ctx.Done():
+		return ExitStatus{}, ctx.Err()
+	}
+}
+
+// Remove forcibly removes a container.
+func (pr *ProcessRuntime) Remove(ctx context.Context, id string) error {
+	p, err := pr.get(id)
+	if err != nil {
+		return err
+	}
+	pr.lck.Lock()
+	delete(pr.procs, id)
+	pr.lck.Unlock()
+
+	// kill process
+	if p.started {
+		syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// clean up
+	p.closeFiles()
+	return os.RemoveAll(p.dir)
+}
+
+// List returns the processes of this instance.
+func (pr *ProcessRuntime) List(ctx context.Context) ([]ContainerInfo, error) {
+	pr.lck.Lock()
+	defer pr.lck.Unlock()
+	infos := make([]ContainerInfo, 0, len(pr.procs))
+	for id, p := range pr.procs {
+		infos = append(infos, ContainerInfo{
+			ID:       id,
+			Instance: pr.Instance,
+			Created:  p.created,
+		})
+	}
+	return infos, nil
+}
+
+// sandboxInit applies resource limits and then executes the command of a sandboxed process.
+// It runs in the re-executed server, inside the namespaces of the sandbox.
+// The arguments are the memory limit, the file size limit, "--", and the command.
+func sandboxInit(args []string) {
+	if len(args) < 4 || args[2] != "--" {
+		fmt.Fprintln(os.Stderr, "invalid sandbox arguments")
+		os.Exit(127)
+	}
+
+	// apply resource limits
+	limits := map[int]string{
+		syscall.RLIMIT_DATA:  args[0],
+		syscall.RLIMIT_FSIZE: args[1],
+		syscall.RLIMIT_CORE:  "0",
+	}
+	for res, str := range limits {
+		v, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid limit %q\n", str)
+			os.Exit(127)
+		}
+		if v == 0 && res != syscall.RLIMIT_CORE {
+			// unset limit
+			continue
+		}
+		err = syscall.Setrlimit(res, &syscall.Rlimit{Cur: v, Max: v})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to set resource limit: %s\n", err.Error())
+			os.Exit(127)
+		}
+	}
+
+	// run command
+	bin, err := exec.LookPath(args[3])
+	if err == nil {
+		err = syscall.Exec(bin, args[3:], os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "failed to run %s: %s\n", args[3], err.Error())
+	os.Exit(127)
+}
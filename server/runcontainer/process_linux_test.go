@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the process runtime re-executes the test binary to start sandboxed processes
+	if len(os.Args) > 1 && os.Args[1] == sandboxInitArg {
+		sandboxInit(os.Args[2:])
+	}
+	os.Exit(m.Run())
+}
+
+func TestProcessRuntime(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rt := &ProcessRuntime{NoNamespaces: true}
+	cc := ContainerConfig{
+		Image:      "test",
+		Command:    []string{"/code"},
+		Entrypoint: []string{"sh"},
+		WorkDir:    "/project",
+	}
+
+	// run a script which writes an artifact
+	c, err := cc.Deploy(ctx, rt, LimitPolicy{}, SecurityProfile{}, time.Second, true, func(ctx context.Context, c *Container) error {
+		err := c.UploadCode(ctx, "/", []byte("echo hello; pwd; echo out > ../output/result.txt; exit 3"))
+		if err != nil {
+			return err
+		}
+		return c.MakeDir(ctx, "/output")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	out, err := ioutil.ReadAll(c.IO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\r\n")
+	if len(lines) != 2 || lines[0] != "hello" || !strings.HasSuffix(lines[1], "/project") {
+		t.Errorf("unexpected output %q", out)
+	}
+	status, err := c.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Code != 3 {
+		t.Errorf("expected exit code 3 but got %d", status.Code)
+	}
+
+	// collect the artifact
+	files, truncated, err := c.CollectArtifacts(ctx, "/output", ArtifactLimits{MaxSize: 1024, MaxFiles: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated || len(files) != 1 || files[0].path != "result.txt" || !bytes.Equal(files[0].dat, []byte("out\n")) {
+		t.Errorf("unexpected artifacts %+v", files)
+	}
+}
+
+func TestProcessPathEscape(t *testing.T) {
+	p := &process{dir: "/tmp/sandbox"}
+	tbl := map[string]string{
+		"/code":            "/tmp/sandbox/code",
+		"project/main.py":  "/tmp/sandbox/project/main.py",
+		"../../etc/passwd": "/tmp/sandbox/etc/passwd",
+		"/a/../../b":       "/tmp/sandbox/b",
+	}
+	for in, expect := range tbl {
+		if out := p.path(in); out != expect {
+			t.Errorf("path %q mapped to %q instead of %q", in, out, expect)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// sandboxInitArg is the argument with which ProcessRuntime re-executes the server to start a sandboxed process.
+const sandboxInitArg = "-sandbox-init"
+
+// newProcessRuntime creates a ProcessRuntime, which is only supported on Linux.
+func newProcessRuntime(tmpdir string, nons bool, instance string) (Runtime, error) {
+	return nil, errors.New("the process runtime is only supported on Linux")
+}
+
+// sandboxInit is never used outside of Linux.
+func sandboxInit(args []string) {
+	fmt.Fprintln(os.Stderr, "sandboxed processes are only supported on Linux")
+	os.Exit(127)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// codePath is the path in the container at which single-file code is uploaded.
+const codePath = "/code"
+
+// ProjectConfig is the configuration for multi-file project uploads to a run container.
+type ProjectConfig struct {
+	// Dir is the directory in the container which project files are written to.
+	// It is also used as the working directory of the container.
+	Dir string `json:"dir"`
+
+	// Entrypoint is the file, relative to Dir, which is run if the project does not name one.
+	// The path of the entrypoint replaces the "/code" argument in the container command.
+	Entrypoint string `json:"entry"`
+}
+
+// ProjectLimits is a set of limits on code uploads.
+type ProjectLimits struct {
+	// MaxUploadSize is the maximum size of an upload message.
+	MaxUploadSize int64
+
+	// MaxSize is the maximum total size of the files in a project.
+	MaxSize int64
+
+	// MaxFiles is the maximum number of files in a project.
+	MaxFiles int
+
+	// MaxStdinSize is the maximum size of the stdin payload of an upload.
+	// If zero, the payload is only limited by MaxUploadSize.
+	MaxStdinSize int64
+}
+
+// projectFile is a file in an uploaded project.
+type projectFile struct {
+	// path is the path of the file, relative to the project directory.
+	path string
+
+	dat []byte
+}
+
+// project is a decoded code upload.
+type project struct {
+	// files are the files in the project.
+	files []projectFile
+
+	// entry is the path of the file to run, relative to the project directory.
+	entry string
+
+	// single is whether the upload was a single file of code rather than a multi-file project.
+	single bool
+
+	// stdin is the payload written to the standard input of the program before interactive input.
+	stdin []byte
+
+	// closeStdin is whether standard input is closed once the payload has been written.
+	closeStdin bool
+}
+
+// projectManifest is a multi-file project, or a single file of code, uploaded as JSON.
+type projectManifest struct {
+	Files []struct {
+		Path    string `json:"path"`
+		Content string `json:"content"`
+	} `json:"files"`
+
+	// Entrypoint optionally overrides the default entrypoint of the language.
+	Entrypoint string `json:"entry"`
+
+	// Code is a single file of code, uploaded instead of Files.
+	Code *string `json:"code"`
+
+	// Stdin is written to the standard input of the program before interactive input.
+	Stdin string `json:"stdin"`
+
+	// CloseStdin closes standard input once Stdin has been written.
+	CloseStdin bool `json:"closeStdin"`
+}
+
+// stdin returns the stdin payload of the manifest, or nil if there is none.
+func (m projectManifest) stdin() []byte {
+	if m.Stdin == "" {
+		return nil
+	}
+	return []byte(m.Stdin)
+}
+
+var (
+	errTooManyFiles    = errors.New("project has too many files")
+	errProjectTooLarge = errors.New("project is too large")
+)
+
+// cleanProjectPath validates and normalizes the path of a file in a project.
+// Paths must be relative and may not escape the project directory.
+func cleanProjectPath(p string) (string, error) {
+	p = strings.Replace(p, "\\", "/", -1)
+	if p == "" || path.IsAbs(p) {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	clean := path.Clean(p)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("path %q escapes project directory", p)
+	}
+	return clean, nil
+}
+
+// projectBuilder collects the files of a project while enforcing limits.
+type projectBuilder struct {
+	lim   ProjectLimits
+	files []projectFile
+	size  int64
+	seen  map[string]bool
+}
+
+// add reads a file into the project.
+func (pb *projectBuilder) add(p string, r io.Reader) error {
+	// validate path
+	clean, err := cleanProjectPath(p)
+	if err != nil {
+		return err
+	}
+	if pb.seen == nil {
+		pb.seen = map[string]bool{}
+	}
+	if pb.seen[clean] {
+		return fmt.Errorf("duplicate file %q", clean)
+	}
+	pb.seen[clean] = true
+
+	// check file count
+	if len(pb.files) >= pb.lim.MaxFiles {
+		return errTooManyFiles
+	}
+
+	// read file, stopping once the size limit is exceeded
+	dat, err := ioutil.ReadAll(io.LimitReader(r, pb.lim.MaxSize-pb.size+1))
+	if err != nil {
+		return err
+	}
+	pb.size += int64(len(dat))
+	if pb.size > pb.lim.MaxSize {
+		return errProjectTooLarge
+	}
+
+	pb.files = append(pb.files, projectFile{path: clean, dat: dat})
+
+	return nil
+}
+
+// addZip reads the files of a zip archive into the project.
+func (pb *projectBuilder) addZip(dat []byte) error {
+	zr, err := zip.NewReader(bytes.NewReader(dat), int64(len(dat)))
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		// skip directories
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			return fmt.Errorf("unsupported file type for %q", f.Name)
+		}
+
+		// read file
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = pb.add(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTar reads the files of a tar archive into the project.
+func (pb *projectBuilder) addTar(dat []byte) error {
+	tr := tar.NewReader(bytes.NewReader(dat))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			err = pb.add(hdr.Name, tr)
+			if err != nil {
+				return err
+			}
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			// skip directories and metadata
+		default:
+			return fmt.Errorf("unsupported file type for %q", hdr.Name)
+		}
+	}
+}
+
+// isZip returns whether dat is a zip archive.
+func isZip(dat []byte) bool {
+	return bytes.HasPrefix(dat, []byte("PK\x03\x04")) || bytes.HasPrefix(dat, []byte("PK\x05\x06"))
+}
+
+// isTar returns whether dat is a tar archive.
+func isTar(dat []byte) bool {
+	return len(dat) > 262 && string(dat[257:262]) == "ustar"
+}
+
+// singleFile returns a project consisting of a single file of code.
+func singleFile(dat []byte) project {
+	return project{
+		files:  []projectFile{{path: path.Base(codePath), dat: dat}},
+		entry:  path.Base(codePath),
+		single: true,
+	}
+}
+
+// parseUpload decodes code uploaded by a client.
+// The upload may be a zip or tar archive, a JSON projectManifest, or otherwise a single file of code.
+// Multi-file projects are only accepted if pc is not nil.
+func parseUpload(dat []byte, pc *ProjectConfig, lim ProjectLimits) (project, error) {
+	pb := &projectBuilder{lim: lim}
+	var m projectManifest
+	var err error
+	switch {
+	case isZip(dat):
+		err = pb.addZip(dat)
+	case isTar(dat):
+		err = pb.addTar(dat)
+	default:
+		// handle JSON manifest
+		if json.Unmarshal(dat, &m) != nil || (len(m.Files) == 0 && m.Code == nil) {
+			// not a manifest - treat as a single file
+			return singleFile(dat), nil
+		}
+		if lim.MaxStdinSize > 0 && int64(len(m.Stdin)) > lim.MaxStdinSize {
+			return project{}, errors.New("stdin payload too large")
+		}
+		if m.Code != nil {
+			// single file with a stdin payload
+			if len(m.Files) > 0 {
+				return project{}, errors.New("manifest may not contain both code and files")
+			}
+			proj := singleFile([]byte(*m.Code))
+			proj.stdin, proj.closeStdin = m.stdin(), m.CloseStdin
+			return proj, nil
+		}
+		for _, f := range m.Files {
+			err = pb.add(f.Path, strings.NewReader(f.Content))
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return project{}, err
+	}
+	if pc == nil {
+		return project{}, errors.New("language does not support multi-file projects")
+	}
+
+	// select entrypoint
+	entry := m.Entrypoint
+	if entry == "" {
+		entry = pc.Entrypoint
+	}
+	entry, err = cleanProjectPath(entry)
+	if err != nil {
+		return project{}, err
+	}
+	if !pb.seen[entry] {
+		return project{}, fmt.Errorf("entrypoint %q not found in project", entry)
+	}
+
+	return project{
+		files:      pb.files,
+		entry:      entry,
+		stdin:      m.stdin(),
+		closeStdin: m.CloseStdin,
+	}, nil
+}
+
+// replaceCode returns a copy of cmd with the "/code" argument replaced with target.
+func replaceCode(cmd []string, target string) []string {
+	out := make([]string, len(cmd))
+	for i, v := range cmd {
+		if v == codePath {
+			v = target
+		}
+		out[i] = v
+	}
+	return out
+}
+
+// forProject returns a copy of cc which runs the given entrypoint of a project.
+// The entrypoint is also passed to the compile command, if the language has one.
+func (cc ContainerConfig) forProject(entry string) ContainerConfig {
+	target := path.Join(cc.Project.Dir, entry)
+	cc.Command = replaceCode(cc.Command, target)
+	if cc.Compile != nil {
+		comp := *cc.Compile
+		comp.Command = replaceCode(comp.Command, target)
+		cc.Compile = &comp
+	}
+	cc.WorkDir = cc.Project.Dir
+	return cc
+}
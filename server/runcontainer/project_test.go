@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCleanProjectPath(t *testing.T) {
+	tbl := []struct {
+		path   string
+		expect string
+		err    bool
+	}{
+		{path: "main.py", expect: "main.py"},
+		{path: "./lib/../lib/util.py", expect: "lib/util.py"},
+		{path: `lib\util.py`, expect: "lib/util.py"},
+		{path: "", err: true},
+		{path: ".", err: true},
+		{path: "/etc/passwd", err: true},
+		{path: "../main.py", err: true},
+		{path: "lib/../../main.py", err: true},
+	}
+	for _, v := range tbl {
+		p, err := cleanProjectPath(v.path)
+		if v.err {
+			if err == nil {
+				t.Errorf("expected error for %q but got %q", v.path, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", v.path, err.Error())
+			continue
+		}
+		if p != v.expect {
+			t.Errorf("expected %q but got %q", v.expect, p)
+		}
+	}
+}
+
+func TestParseUpload(t *testing.T) {
+	// build archives
+	var tarbuf bytes.Buffer
+	tw := tar.NewWriter(&tarbuf)
+	tw.WriteHeader(&tar.Header{Name: "main.py", Mode: 0644, Size: 6, Typeflag: tar.TypeReg})
+	tw.Write([]byte("import"))
+	tw.Close()
+	var zipbuf bytes.Buffer
+	zw := zip.NewWriter(&zipbuf)
+	fw, _ := zw.Create("lib/util.py")
+	fw.Write([]byte("x = 1"))
+	fw, _ = zw.Create("main.py")
+	fw.Write([]byte("y"))
+	zw.Close()
+
+	pc := &ProjectConfig{Dir: "/project", Entrypoint: "main.py"}
+	lim := ProjectLimits{MaxSize: 16, MaxFiles: 2, MaxStdinSize: 4}
+	tbl := []struct {
+		dat    string
+		pc     *ProjectConfig
+		expect project
+		err    bool
+	}{
+		{
+			dat: "print('hi')",
+			pc:  pc,
+			expect: project{
+				files:  []projectFile{{path: "code", dat: []byte("print('hi')")}},
+				entry:  "code",
+				single: true,
+			},
+		},
+		{
+			dat: "{}",
+			pc:  nil,
+			expect: project{
+				files:  []projectFile{{path: "code", dat: []byte("{}")}},
+				entry:  "code",
+				single: true,
+			},
+		},
+		{
+			dat: `{"files":[{"path":"main.py","content":"import a"},{"path":"a.py","content":""}]}`,
+			pc:  pc,
+			expect: project{
+				files: []projectFile{{path: "main.py", dat: []byte("import a")}, {path: "a.py", dat: []byte("")}},
+				entry: "main.py",
+			},
+		},
+		{
+			dat: `{"files":[{"path":"a.py","content":""}],"entry":"a.py"}`,
+			pc:  pc,
+			expect: project{
+				files: []projectFile{{path: "a.py", dat: []byte("")}},
+				entry: "a.py",
+			},
+		},
+		{
+			dat: tarbuf.String(),
+			pc:  pc,
+			expect: project{
+				files: []projectFile{{path: "main.py", dat: []byte("import")}},
+				entry: "main.py",
+			},
+		},
+		{
+			dat: zipbuf.String(),
+			pc:  pc,
+			expect: project{
+				files: []projectFile{{path: "lib/util.py", dat: []byte("x = 1")}, {path: "main.py", dat: []byte("y")}},
+				entry: "main.py",
+			},
+		},
+		{
+			dat: zipbuf.String(),
+			pc:  nil,
+			err: true,
+		},
+		{
+			dat: `{"code":"print(input())","stdin":"hi\n","closeStdin":true}`,
+			pc:  nil,
+			expect: project{
+				files:      []projectFile{{path: "code", dat: []byte("print(input())")}},
+				entry:      "code",
+				single:     true,
+				stdin:      []byte("hi\n"),
+				closeStdin: true,
+			},
+		},
+		{
+			dat: `{"files":[{"path":"main.py","content":""}],"stdin":"1 2"}`,
+			pc:  pc,
+			expect: project{
+				files: []projectFile{{path: "main.py", dat: []byte("")}},
+				entry: "main.py",
+				stdin: []byte("1 2"),
+			},
+		},
+		{
+			dat: `{"code":"","stdin":"12345"}`,
+			pc:  nil,
+			err: true,
+		},
+		{
+			dat: `{"code":"","files":[{"path":"main.py","content":""}]}`,
+			pc:  pc,
+			err: true,
+		},
+		{
+			dat: `{"files":[{"path":"../main.py","content":""}]}`,
+			pc:  pc,
+			err: true,
+		},
+		{
+			dat: `{"files":[{"path":"a.py","content":""}]}`,
+			pc:  pc,
+			err: true,
+		},
+		{
+			dat: `{"files":[{"path":"main.py","content":""},{"path":"./main.py","content":""}]}`,
+			pc:  pc,
+			err: true,
+		},
+		{
+			dat: `{"files":[{"path":"main.py","content":""},{"path":"a","content":""},{"path":"b","content":""}]}`,
+			pc:  pc,
+			err: true,
+		},
+		{
+			dat: `{"files":[{"path":"main.py","content":"0123456789abcdefg"}]}`,
+			pc:  pc,
+			err: true,
+		},
+	}
+	for _, v := range tbl {
+		proj, err := parseUpload([]byte(v.dat), v.pc, lim)
+		if v.err {
+			if err == nil {
+				t.Errorf("expected error for %q but got %+v", v.dat, proj)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", v.dat, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(proj, v.expect) {
+			t.Errorf("expected %+v but got %+v", v.expect, proj)
+		}
+	}
+}
+
+func TestForProject(t *testing.T) {
+	cc := ContainerConfig{
+		Image:   "openrepl/python",
+		Command: []string{"-u", "/code"},
+		Project: &ProjectConfig{Dir: "/project", Entrypoint: "main.py"},
+	}
+	pcc := cc.forProject("lib/main.py")
+	if !reflect.DeepEqual(pcc.Command, []string{"-u", "/project/lib/main.py"}) {
+		t.Errorf("unexpected command %q", pcc.Command)
+	}
+	if pcc.WorkDir != "/project" {
+		t.Errorf("unexpected working directory %q", pcc.WorkDir)
+	}
+	if cc.Command[1] != "/code" {
+		t.Errorf("original command modified")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolV2 is the websocket subprotocol name of the framed v2 protocol.
+//
+// In the v2 protocol, every websocket message is a binary message beginning with a frame type byte, followed by the payload.
+// The stdin, stdout, stderr and code frames carry raw data.
+// The status and exit frames carry a StatusUpdate as JSON.
+// The resize and signal frames carry a ControlMessage as JSON, with the type field implied by the frame type.
+//
+// Clients which do not request the v2 subprotocol use the raw protocol.
+// In the raw protocol, output and status updates are sent as text messages, input is sent as text messages, and control messages are sent as JSON in binary messages.
+const ProtocolV2 = "openrepl.v2"
+
+// v2 protocol frame types
+const (
+	frameStdin  byte = 0
+	frameStdout byte = 1
+	frameStderr byte = 2
+	frameStatus byte = 3
+	frameResize byte = 4
+	frameSignal byte = 5
+	frameExit   byte = 6
+	frameCode   byte = 7
+)
+
+// clientMessage is a decoded message from the client.
+type clientMessage struct {
+	// input is data to be written to the container.
+	input []byte
+
+	// control is a control message, or nil if the message is input.
+	control *ControlMessage
+}
+
+// protocol is a websocket framing protocol for container sessions.
+type protocol interface {
+	// encodeOutput encodes container output from the given stream (frameStdout or frameStderr).
+	encodeOutput(stream byte, dat []byte) (int, []byte)
+
+	// encodeStatus encodes a status update.
+	encodeStatus(status StatusUpdate) (int, []byte, error)
+
+	// decodeMessage decodes a client message sent while the session is running.
+	decodeMessage(t int, dat []byte) (clientMessage, error)
+
+	// decodeCode decodes the code sent by the client during startup of a run session.
+	decodeCode(t int, dat []byte) ([]byte, error)
+}
+
+// rawProtocol is the original unframed protocol.
+type rawProtocol struct{}
+
+func (rawProtocol) encodeOutput(stream byte, dat []byte) (int, []byte) {
+	return websocket.TextMessage, dat
+}
+
+func (rawProtocol) encodeStatus(status StatusUpdate) (int, []byte, error) {
+	dat, err := json.Marshal(status)
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.TextMessage, dat, nil
+}
+
+func (rawProtocol) decodeMessage(t int, dat []byte) (clientMessage, error) {
+	if t == websocket.BinaryMessage {
+		if cm, ok := parseControlMessage(dat); ok {
+			return clientMessage{control: &cm}, nil
+		}
+	}
+	return clientMessage{input: dat}, nil
+}
+
+func (rawProtocol) decodeCode(t int, dat []byte) ([]byte, error) {
+	return dat, nil
+}
+
+// v2Protocol is the framed v2 protocol.
+type v2Protocol struct{}
+
+func (v2Protocol) encodeOutput(stream byte, dat []byte) (int, []byte) {
+	return websocket.BinaryMessage, append([]byte{stream}, dat...)
+}
+
+func (v2Protocol) encodeStatus(status StatusUpdate) (int, []byte, error) {
+	// select frame type
+	ft := frameStatus
+	if status.Status == "exited" {
+		ft = frameExit
+	}
+
+	// encode frame
+	dat, err := json.Marshal(status)
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.BinaryMessage, append([]byte{ft}, dat...), nil
+}
+
+// errBadFrame is an error indicating that a v2 frame was malformed.
+var errBadFrame = errors.New("malformed frame")
+
+func (v2Protocol) decodeMessage(t int, dat []byte) (clientMessage, error) {
+	if t != websocket.BinaryMessage || len(dat) == 0 {
+		return clientMessage{}, errBadFrame
+	}
+	switch dat[0] {
+	case frameStdin:
+		return clientMessage{input: dat[1:]}, nil
+	case frameResize, frameSignal:
+		var cm ControlMessage
+		err := json.Unmarshal(dat[1:], &cm)
+		if err != nil {
+			return clientMessage{}, err
+		}
+		cm.Type = "resize"
+		if dat[0] == frameSignal {
+			cm.Type = "signal"
+		}
+		return clientMessage{control: &cm}, nil
+	default:
+		return clientMessage{}, fmt.Errorf("unexpected frame type %d", dat[0])
+	}
+}
+
+func (v2Protocol) decodeCode(t int, dat []byte) ([]byte, error) {
+	if t != websocket.BinaryMessage || len(dat) == 0 || dat[0] != frameCode {
+		return nil, errBadFrame
+	}
+	return dat[1:], nil
+}
+
+// selectProtocol selects the protocol for a websocket connection based on the negotiated subprotocol.
+func selectProtocol(ws *websocket.Conn) protocol {
+	if ws.Subprotocol() == ProtocolV2 {
+		return v2Protocol{}
+	}
+	return rawProtocol{}
+}
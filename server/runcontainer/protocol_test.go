@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	tbl := []struct {
+		proto  protocol
+		t      int
+		dat    string
+		expect clientMessage
+		err    bool
+	}{
+		{
+			proto:  rawProtocol{},
+			t:      websocket.TextMessage,
+			dat:    `{"type":"resize","cols":80,"rows":24}`,
+			expect: clientMessage{input: []byte(`{"type":"resize","cols":80,"rows":24}`)},
+		},
+		{
+			proto: rawProtocol{},
+			t:     websocket.BinaryMessage,
+			dat:   `{"type":"resize","cols":80,"rows":24}`,
+			expect: clientMessage{control: &ControlMessage{
+				Type: "resize",
+				Cols: 80,
+				Rows: 24,
+			}},
+		},
+		{
+			proto:  rawProtocol{},
+			t:      websocket.BinaryMessage,
+			dat:    "ls\n",
+			expect: clientMessage{input: []byte("ls\n")},
+		},
+		{
+			proto:  v2Protocol{},
+			t:      websocket.BinaryMessage,
+			dat:    "\x00ls\n",
+			expect: clientMessage{input: []byte("ls\n")},
+		},
+		{
+			proto: v2Protocol{},
+			t:     websocket.BinaryMessage,
+			dat:   "\x04" + `{"cols":120,"rows":40}`,
+			expect: clientMessage{control: &ControlMessage{
+				Type: "resize",
+				Cols: 120,
+				Rows: 40,
+			}},
+		},
+		{
+			proto: v2Protocol{},
+			t:     websocket.TextMessage,
+			dat:   "ls\n",
+			err:   true,
+		},
+		{
+			proto: v2Protocol{},
+			t:     websocket.BinaryMessage,
+			dat:   "\x01hello",
+			err:   true,
+		},
+	}
+	for _, v := range tbl {
+		got, err := v.proto.decodeMessage(v.t, []byte(v.dat))
+		switch {
+		case v.err && err == nil:
+			t.Errorf("expected error decoding %q but got %+v", v.dat, got)
+		case !v.err && err != nil:
+			t.Errorf("unexpected error decoding %q: %s", v.dat, err.Error())
+		case !v.err && !reflect.DeepEqual(got, v.expect):
+			t.Errorf("expected %+v decoding %q but got %+v", v.expect, v.dat, got)
+		}
+	}
+}
+
+func TestEncodeV2(t *testing.T) {
+	mt, frame := v2Protocol{}.encodeOutput(frameStderr, []byte("oops"))
+	if mt != websocket.BinaryMessage || !bytes.Equal(frame, []byte("\x02oops")) {
+		t.Errorf("bad stderr frame %q", frame)
+	}
+
+	code := 1
+	_, frame, err := v2Protocol{}.encodeStatus(StatusUpdate{Status: "exited", Code: &code, Reason: "error"})
+	if err != nil {
+		t.Fatalf("failed to encode exit: %s", err.Error())
+	}
+	if expect := "\x06" + `{"status":"exited","code":1,"reason":"error"}`; string(frame) != expect {
+		t.Errorf("expected exit frame %q but got %q", expect, frame)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// labelManaged is the label marking containers created by the service.
+	labelManaged = "openrepl.managed"
+
+	// labelInstance is the label holding the ID of the instance of the service which created a container.
+	labelInstance = "openrepl.instance"
+)
+
+// ContainerInfo is a summary of a container created by the service.
+type ContainerInfo struct {
+	// ID is the ID of the container.
+	ID string
+
+	// Instance is the ID of the instance of the service which created the container.
+	Instance string
+
+	// Created is the time at which the container was created.
+	Created time.Time
+}
+
+// containerSet is a concurrency-safe set of container IDs.
+type containerSet struct {
+	lck sync.Mutex
+	ids map[string]bool
+}
+
+func (s *containerSet) add(id string) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if s.ids == nil {
+		s.ids = map[string]bool{}
+	}
+	s.ids[id] = true
+}
+
+func (s *containerSet) remove(id string) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	delete(s.ids, id)
+}
+
+func (s *containerSet) has(id string) bool {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.ids[id]
+}
+
+// liveContainers is the set of containers created by this instance which have not been closed.
+var liveContainers containerSet
+
+// Reaper removes containers left behind by previous instances of the service, as well as containers leaked by this instance.
+type Reaper struct {
+	// Runtime is the runtime whose containers are reaped.
+	Runtime Runtime
+
+	// Instance is the ID of this instance of the service.
+	// Containers created by any other instance are removed once they are older than OrphanAge.
+	Instance string
+
+	// OrphanAge is the age under which containers of other instances are kept.
+	// Other instances may still be running, such as replicas sharing the runtime or an instance which is draining, so it must be longer than any container of a running instance can live.
+	OrphanAge time.Duration
+
+	// Live reports whether a container created by this instance is still in use.
+	// If nil, containers created by this instance are never removed.
+	Live func(id string) bool
+
+	// MinAge is the age under which unused containers of this instance are kept, so that containers which are still being set up are not removed.
+	MinAge time.Duration
+
+	// Interval is the amount of time between periodic reaping.
+	Interval time.Duration
+
+	// Timeout is the timeout for each pass of the reaper.
+	Timeout time.Duration
+
+	stopch chan struct{}
+	donech chan struct{}
+}
+
+// Reap removes all orphaned and leaked containers, and returns the number of containers which were removed.
+func (r *Reaper) Reap(ctx context.Context) (int, error) {
+	// list containers
+	cs, err := r.Runtime.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, c := range cs {
+		// select orphaned containers
+		reason := "orphan"
+		if c.Instance != r.Instance && time.Since(c.Created) < r.OrphanAge {
+			continue
+		}
+		if c.Instance == r.Instance {
+			if r.Live == nil || r.Live(c.ID) || time.Since(c.Created) < r.MinAge {
+				continue
+			}
+			reason = "leaked"
+		}
+
+		// remove container
+		l := logrus.WithFields(logrus.Fields{
+			"container": c.ID,
+			"instance":  c.Instance,
+			"reason":    reason,
+		})
+		err = r.Runtime.Remove(ctx, c.ID)
+		if err != nil {
+			l.WithError(err).Warn("failed to reap container")
+			continue
+		}
+		l.Info("reaped container")
+		containersReaped.WithLabelValues(reason).Inc()
+		n++
+	}
+
+	return n, nil
+}
+
+// reap runs a pass of the reaper with the reaper timeout.
+func (r *Reaper) reap() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	_, err := r.Reap(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("failed to reap containers")
+	}
+}
+
+// Start reaps containers immediately, and then periodically in the background.
+func (r *Reaper) Start() {
+	r.reap()
+	r.stopch = make(chan struct{})
+	r.donech = make(chan struct{})
+	go func() {
+		defer close(r.donech)
+		tick := time.NewTicker(r.Interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				r.reap()
+			case <-r.stopch:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops periodic reaping.
+func (r *Reaper) Close() {
+	if r.stopch == nil {
+		return
+	}
+	close(r.stopch)
+	<-r.donech
+}
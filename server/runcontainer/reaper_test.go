@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReaper(t *testing.T) {
+	rt := &fakeRuntime{instance: "old"}
+	ctx := context.Background()
+
+	// containers left behind by a previous instance, and of another instance which may still be running
+	orphan, _ := rt.Create(ctx, CreateOptions{})
+	other, _ := rt.Create(ctx, CreateOptions{})
+	rt.containers[orphan].created = time.Now().Add(-2 * time.Hour)
+	rt.instance = "new"
+
+	// containers of this instance
+	live, _ := rt.Create(ctx, CreateOptions{})
+	leaked, _ := rt.Create(ctx, CreateOptions{})
+	fresh, _ := rt.Create(ctx, CreateOptions{})
+	rt.containers[live].created = time.Now().Add(-time.Hour)
+	rt.containers[leaked].created = time.Now().Add(-time.Hour)
+
+	r := &Reaper{
+		Runtime:   rt,
+		Instance:  "new",
+		Live:      func(id string) bool { return id == live },
+		MinAge:    time.Minute,
+		OrphanAge: time.Hour,
+	}
+	n, err := r.Reap(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 containers to be reaped but got %d", n)
+	}
+	tbl := []struct {
+		id      string
+		removed bool
+	}{
+		{orphan, true},
+		{other, false},
+		{live, false},
+		{leaked, true},
+		{fresh, false},
+	}
+	for _, v := range tbl {
+		if rt.containers[v.id].removed != v.removed {
+			t.Errorf("expected removed=%v for %s", v.removed, v.id)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Recorder records the terminal I/O of a session in the asciicast v2 format.
+// It is safe to use concurrently.
+type Recorder struct {
+	lck   sync.Mutex
+	start time.Time
+	buf   bytes.Buffer
+	max   int
+
+	// truncated is whether events were dropped because the recording reached its maximum size.
+	truncated bool
+
+	// pending is the incomplete UTF-8 sequence at the end of the recorded data of each event type.
+	pending map[string][]byte
+}
+
+// newRecorder starts a recording of a terminal with the given size, with a maximum size of max bytes.
+// If the terminal size is zero, the default size of 80x24 is used.
+func newRecorder(title string, cols, rows uint, max int) *Recorder {
+	if cols == 0 || rows == 0 {
+		cols, rows = 80, 24
+	}
+	r := &Recorder{
+		start:   time.Now(),
+		max:     max,
+		pending: map[string][]byte{},
+	}
+	hdr, _ := json.Marshal(map[string]interface{}{
+		"version":   2,
+		"width":     cols,
+		"height":    rows,
+		"timestamp": r.start.Unix(),
+		"title":     title,
+		"env":       map[string]string{"TERM": "xterm"},
+	})
+	r.buf.Write(hdr)
+	r.buf.WriteByte('\n')
+	return r
+}
+
+// event records an event with the given type and data.
+func (r *Recorder) event(typ string, dat string) {
+	t := time.Since(r.start).Seconds()
+	line, _ := json.Marshal([]interface{}{json.Number(strconv.FormatFloat(t, 'f', 6, 64)), typ, dat})
+	if r.buf.Len()+len(line)+1 > r.max {
+		r.truncated = true
+		return
+	}
+	r.buf.Write(line)
+	r.buf.WriteByte('\n')
+}
+
+// record records a chunk of terminal data as an event.
+// Incomplete UTF-8 sequences at the end of the data are held back until the rest of the sequence is recorded.
+func (r *Recorder) record(typ string, dat []byte) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	// prepend incomplete sequence from the previous chunk
+	if p := r.pending[typ]; len(p) > 0 {
+		dat = append(p, dat...)
+		r.pending[typ] = nil
+	}
+
+	// hold back incomplete sequence at the end
+	for i := 1; i < utf8.UTFMax && i <= len(dat); i++ {
+		if utf8.RuneStart(dat[len(dat)-i]) {
+			if !utf8.FullRune(dat[len(dat)-i:]) {
+				r.pending[typ] = append([]byte(nil), dat[len(dat)-i:]...)
+				dat = dat[:len(dat)-i]
+			}
+			break
+		}
+	}
+
+	if len(dat) > 0 {
+		r.event(typ, string(dat))
+	}
+}
+
+// Output records output from the container.
+func (r *Recorder) Output(dat []byte) {
+	r.record("o", dat)
+}
+
+// Input records input from the client.
+func (r *Recorder) Input(dat []byte) {
+	r.record("i", dat)
+}
+
+// Resize records a resize of the terminal.
+func (r *Recorder) Resize(cols, rows uint) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// Bytes returns the encoded recording, and whether it was truncated.
+func (r *Recorder) Bytes() ([]byte, bool) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	return append([]byte(nil), r.buf.Bytes()...), r.truncated
+}
+
+// uploadRecording uploads an encoded recording to the recording endpoint of the store service, and returns its key.
+func uploadRecording(ctx context.Context, url string, dat []byte) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(dat))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-asciicast")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("store responded with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
+
+// saveRecording uploads the recording of the session and sends its key to the client with the "recorded" status.
+func (cs *ContainerSession) saveRecording() error {
+	dat, truncated := cs.Recorder.Bytes()
+	if truncated {
+		cs.logger().Warn("recording truncated")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cs.Config.ContainerStopTimeout)
+	defer cancel()
+	key, err := uploadRecording(ctx, cs.Config.RecordingStore, dat)
+	if err != nil {
+		cs.UpdateStatus(StatusUpdate{Status: "error", Error: fmt.Sprintf("failed to save recording: %s", err.Error())})
+		return err
+	}
+	cs.logger().WithField("recording", key).Info("saved recording")
+	return cs.UpdateStatus(StatusUpdate{Status: "recorded", Recording: key})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// parseTestRecording decodes the header and events of an asciicast recording.
+func parseTestRecording(t *testing.T, dat []byte) (map[string]interface{}, [][]interface{}) {
+	lines := bytes.Split(bytes.TrimSuffix(dat, []byte("\n")), []byte("\n"))
+	var hdr map[string]interface{}
+	err := json.Unmarshal(lines[0], &hdr)
+	if err != nil {
+		t.Fatalf("invalid header %q: %s", lines[0], err.Error())
+	}
+	var events [][]interface{}
+	for _, l := range lines[1:] {
+		var ev []interface{}
+		err = json.Unmarshal(l, &ev)
+		if err != nil || len(ev) != 3 {
+			t.Fatalf("invalid event %q", l)
+		}
+		events = append(events, ev)
+	}
+	return hdr, events
+}
+
+func TestRecorder(t *testing.T) {
+	r := newRecorder("test", 0, 0, 1024)
+	r.Output([]byte("a\xe2\x82"))
+	r.Output([]byte("\xac!"))
+	r.Input([]byte("\xe2"))
+	r.Input([]byte("\x82\xac"))
+	r.Resize(100, 30)
+	dat, truncated := r.Bytes()
+	if truncated {
+		t.Errorf("recording truncated")
+	}
+	hdr, events := parseTestRecording(t, dat)
+	if hdr["version"] != 2.0 || hdr["width"] != 80.0 || hdr["height"] != 24.0 {
+		t.Errorf("unexpected header %v", hdr)
+	}
+	expect := [][2]string{
+		{"o", "a"},
+		{"o", "€!"},
+		{"i", "€"},
+		{"r", "100x30"},
+	}
+	if len(events) != len(expect) {
+		t.Fatalf("expected %d events but got %v", len(expect), events)
+	}
+	for i, v := range expect {
+		if events[i][1] != v[0] || events[i][2] != v[1] {
+			t.Errorf("expected event %v but got %v", v, events[i])
+		}
+	}
+
+	// events past the maximum size are dropped
+	r = newRecorder("test", 80, 24, 200)
+	for i := 0; i < 10; i++ {
+		r.Output([]byte("0123456789"))
+	}
+	dat, truncated = r.Bytes()
+	if !truncated || len(dat) > 200 {
+		t.Errorf("expected truncated recording under 200 bytes but got %d bytes (truncated=%v)", len(dat), truncated)
+	}
+	parseTestRecording(t, dat)
+}
+
+func TestContainerSessionRecord(t *testing.T) {
+	// start fake store
+	recch := make(chan []byte, 1)
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dat, _ := ioutil.ReadAll(r.Body)
+		recch <- dat
+		io.WriteString(w, "abc123")
+	}))
+	defer store.Close()
+
+	srv, ts := newTestServer(func(stdin io.Reader, stdout io.Writer, files map[string][]byte) int {
+		line, _ := bufio.NewReader(stdin).ReadString('\n')
+		io.WriteString(stdout, "echo: "+line)
+		return 0
+	})
+	defer ts.Close()
+	srv.SessionConfig.RecordingStore = store.URL
+	srv.SessionConfig.MaxRecordingSize = 1 << 20
+
+	// run recorded session
+	ws := dialTest(t, ts, "/term", url.Values{"lang": {"test"}, "record": {"true"}, "cols": {"90"}, "rows": {"20"}})
+	defer ws.Close()
+	expectStatus(t, ws, "starting")
+	expectStatus(t, ws, "running")
+	sendInput(t, ws, "hello\n")
+	expectOutput(t, ws, "echo: hello\n")
+	expectStatus(t, ws, "exited")
+	if su := expectStatus(t, ws, "recorded"); su.Recording != "abc123" {
+		t.Errorf("expected recording key %q but got %q", "abc123", su.Recording)
+	}
+
+	// check recording
+	hdr, events := parseTestRecording(t, <-recch)
+	if hdr["width"] != 90.0 || hdr["height"] != 20.0 {
+		t.Errorf("unexpected header %v", hdr)
+	}
+	var in, out string
+	for _, ev := range events {
+		switch ev[1] {
+		case "i":
+			in += ev[2].(string)
+		case "o":
+			out += ev[2].(string)
+		}
+	}
+	if in != "hello\n" || out != "echo: hello\n" {
+		t.Errorf("unexpected recorded input %q and output %q", in, out)
+	}
+}
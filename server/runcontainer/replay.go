@@ -0,0 +1,83 @@
+package main
+
+// outputChunk is a chunk of container output from a single stream.
+type outputChunk struct {
+	// offset is the position of the first byte of the chunk in the output of the session.
+	offset int64
+
+	// stream is the stream which the output came from (frameStdout or frameStderr).
+	stream byte
+
+	dat []byte
+}
+
+// replayBuffer is a ring buffer of recent container output, used to replay missed output to reattaching clients.
+// It keeps at most max bytes, dropping the oldest output first.
+type replayBuffer struct {
+	chunks []outputChunk
+	size   int
+	max    int
+
+	// end is the offset after the last byte of output written.
+	end int64
+}
+
+// write appends output from a stream to the buffer.
+func (rb *replayBuffer) write(stream byte, dat []byte) {
+	offset := rb.end
+	rb.end += int64(len(dat))
+
+	// keep only the tail of oversized output
+	if len(dat) > rb.max {
+		offset += int64(len(dat) - rb.max)
+		dat = dat[len(dat)-rb.max:]
+	}
+	if len(dat) == 0 {
+		return
+	}
+
+	// drop old output to make room
+	for rb.size+len(dat) > rb.max {
+		first := &rb.chunks[0]
+		if drop := rb.size + len(dat) - rb.max; drop < len(first.dat) {
+			first.offset += int64(drop)
+			first.dat = first.dat[drop:]
+			rb.size -= drop
+			break
+		}
+		rb.size -= len(first.dat)
+		rb.chunks[0] = outputChunk{}
+		rb.chunks = rb.chunks[1:]
+	}
+
+	// copy output into buffer
+	rb.chunks = append(rb.chunks, outputChunk{
+		offset: offset,
+		stream: stream,
+		dat:    append([]byte(nil), dat...),
+	})
+	rb.size += len(dat)
+}
+
+// start returns the offset of the oldest output still in the buffer.
+func (rb *replayBuffer) start() int64 {
+	return rb.end - int64(rb.size)
+}
+
+// since returns the buffered output after the given offset.
+// If output after the offset has already been dropped, all buffered output is returned.
+func (rb *replayBuffer) since(offset int64) []outputChunk {
+	var out []outputChunk
+	for _, c := range rb.chunks {
+		end := c.offset + int64(len(c.dat))
+		if end <= offset {
+			continue
+		}
+		if c.offset < offset {
+			c.dat = c.dat[offset-c.offset:]
+			c.offset = offset
+		}
+		out = append(out, c)
+	}
+	return out
+}
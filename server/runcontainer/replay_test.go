@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReplayBuffer(t *testing.T) {
+	type write struct {
+		stream byte
+		dat    string
+	}
+	tbl := []struct {
+		max    int
+		writes []write
+		since  int64
+		expect []outputChunk
+	}{
+		{
+			max:    16,
+			writes: []write{{frameStdout, "hello "}, {frameStderr, "world"}},
+			since:  0,
+			expect: []outputChunk{
+				{offset: 0, stream: frameStdout, dat: []byte("hello ")},
+				{offset: 6, stream: frameStderr, dat: []byte("world")},
+			},
+		},
+		{
+			max:    16,
+			writes: []write{{frameStdout, "hello "}, {frameStderr, "world"}},
+			since:  8,
+			expect: []outputChunk{
+				{offset: 8, stream: frameStderr, dat: []byte("rld")},
+			},
+		},
+		{
+			max:    16,
+			writes: []write{{frameStdout, "hello "}, {frameStderr, "world"}},
+			since:  11,
+			expect: nil,
+		},
+		{
+			max:    8,
+			writes: []write{{frameStdout, "hello "}, {frameStderr, "world"}},
+			since:  0,
+			expect: []outputChunk{
+				{offset: 3, stream: frameStdout, dat: []byte("lo ")},
+				{offset: 6, stream: frameStderr, dat: []byte("world")},
+			},
+		},
+		{
+			max:    4,
+			writes: []write{{frameStdout, "hello "}, {frameStderr, "world"}},
+			since:  2,
+			expect: []outputChunk{
+				{offset: 7, stream: frameStderr, dat: []byte("orld")},
+			},
+		},
+	}
+	for _, v := range tbl {
+		rb := &replayBuffer{max: v.max}
+		for _, w := range v.writes {
+			rb.write(w.stream, []byte(w.dat))
+		}
+		out := rb.since(v.since)
+		if !reflect.DeepEqual(out, v.expect) {
+			t.Errorf("expected %+v but got %+v (max %d, since %d)", v.expect, out, v.max, v.since)
+		}
+		if rb.end != 11 {
+			t.Errorf("expected end offset 11 but got %d", rb.end)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io"
+)
+
+// CreateOptions is the configuration of a container created by a Runtime.
+type CreateOptions struct {
+	// Image is the name of the image to run.
+	Image string
+
+	// Command is the command passed to the image.
+	Command []string
+
+	// Entrypoint is the local command to which Command is appended, for runtimes which do not run images.
+	// Runtimes which run images ignore it.
+	Entrypoint []string
+
+	// WorkDir is the working directory of the container.
+	// If empty, the working directory of the image is used.
+	WorkDir string
+
+	// Limits is the set of resolved resource limits of the container.
+	Limits ResourceLimits
+
+	// Security is the resolved security profile of the container.
+	// Runtimes which do not run images ignore it.
+	Security SecurityProfile
+
+	// Tty is whether the container runs with a TTY.
+	// Without a TTY, the output of the container is multiplexed with stdcopy and stdin is closed when the attached stream is closed for writing.
+	Tty bool
+}
+
+// Runtime is a backend which runs containers.
+type Runtime interface {
+	// Create creates a container without starting it, and returns its ID.
+	Create(ctx context.Context, opts CreateOptions) (string, error)
+
+	// CopyTo extracts a tar archive into a directory in the filesystem of a container.
+	// If the root filesystem is read-only, the directory must be in a volume.
+	CopyTo(ctx context.Context, id string, dir string, tarball io.Reader) error
+
+	// CopyFrom returns a tar archive of a path in the filesystem of a container.
+	CopyFrom(ctx context.Context, id string, path string) (io.ReadCloser, error)
+
+	// Attach attaches to the standard streams of a container.
+	Attach(ctx context.Context, id string) (io.ReadWriteCloser, error)
+
+	// Start starts a container.
+	Start(ctx context.Context, id string) error
+
+	// Resize resizes the TTY of a container.
+	Resize(ctx context.Context, id string, cols, rows uint) error
+
+	// Kill sends a signal to a container.
+	Kill(ctx context.Context, id string, signal string) error
+
+	// Wait waits for a container to exit and returns its exit status.
+	Wait(ctx context.Context, id string) (ExitStatus, error)
+
+	// Remove forcibly removes a container.
+	Remove(ctx context.Context, id string) error
+
+	// List returns the containers created by the service, including those left behind by previous instances.
+	List(ctx context.Context) ([]ContainerInfo, error)
+}
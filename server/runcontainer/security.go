@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+)
+
+// SecurityProfile is a set of security settings for a container.
+// Unset fields leave the Docker defaults in place.
+type SecurityProfile struct {
+	// DropCapabilities drops all Linux capabilities, except for those listed in AddCapabilities.
+	DropCapabilities *bool `json:"dropCapabilities,omitempty"`
+
+	// AddCapabilities is a list of capabilities to add back after dropping all capabilities.
+	AddCapabilities []string `json:"addCapabilities,omitempty"`
+
+	// NoNewPrivileges prevents processes from gaining privileges, such as through setuid binaries.
+	NoNewPrivileges *bool `json:"noNewPrivileges,omitempty"`
+
+	// ReadOnlyRoot mounts the root filesystem of the container read-only.
+	// Docker does not allow copying files into a read-only root filesystem, so the directories into which code is uploaded are mounted as Volumes.
+	ReadOnlyRoot *bool `json:"readOnlyRoot,omitempty"`
+
+	// Volumes is a list of paths at which anonymous volumes are mounted, which are removed with the container.
+	// Unlike the tmpfs filesystems of Writable, files can be copied into volumes while the root filesystem is read-only, and out of them after the container exits.
+	Volumes []string `json:"volumes,omitempty"`
+
+	// Writable is a list of paths at which writable tmpfs filesystems are mounted.
+	// Each is limited to the tmpfs size of the container, if one is set.
+	Writable []string `json:"writable,omitempty"`
+
+	// User is the user to run the container as, as either a name or "uid:gid".
+	// If empty, the user of the image is used.
+	User string `json:"user,omitempty"`
+
+	// Ulimits is a set of ulimits by name (e.g. "nofile"), each used as both the soft and hard limit.
+	Ulimits map[string]int64 `json:"ulimits,omitempty"`
+
+	// Seccomp is the path of a seccomp profile to apply, or "unconfined" to disable seccomp.
+	// If empty, the default Docker seccomp profile is used.
+	Seccomp string `json:"seccomp,omitempty"`
+
+	// Runtime is the name of the OCI runtime used to run the container, such as "runsc" for gVisor.
+	// If empty, the Docker default runtime is used.
+	Runtime string `json:"runtime,omitempty"`
+}
+
+// Override returns a copy of sp with all settings set in o replacing those in sp.
+// Ulimits are overridden individually.
+func (sp SecurityProfile) Override(o SecurityProfile) SecurityProfile {
+	if o.DropCapabilities != nil {
+		sp.DropCapabilities = o.DropCapabilities
+	}
+	if o.AddCapabilities != nil {
+		sp.AddCapabilities = o.AddCapabilities
+	}
+	if o.NoNewPrivileges != nil {
+		sp.NoNewPrivileges = o.NoNewPrivileges
+	}
+	if o.ReadOnlyRoot != nil {
+		sp.ReadOnlyRoot = o.ReadOnlyRoot
+	}
+	if o.Writable != nil {
+		sp.Writable = o.Writable
+	}
+	if o.Volumes != nil {
+		sp.Volumes = o.Volumes
+	}
+	if o.User != "" {
+		sp.User = o.User
+	}
+	if o.Ulimits != nil {
+		ulimits := map[string]int64{}
+		for k, v := range sp.Ulimits {
+			ulimits[k] = v
+		}
+		for k, v := range o.Ulimits {
+			ulimits[k] = v
+		}
+		sp.Ulimits = ulimits
+	}
+	if o.Seccomp != "" {
+		sp.Seccomp = o.Seccomp
+	}
+	if o.Runtime != "" {
+		sp.Runtime = o.Runtime
+	}
+	return sp
+}
+
+// setting returns a pointer to b, for use as an optional setting.
+func setting(b bool) *bool {
+	return &b
+}
+
+// isSet returns whether an optional setting is enabled.
+func isSet(b *bool) bool {
+	return b != nil && *b
+}
+
+// apply applies the profile to a container configuration.
+// The tmpfs size of writable paths is taken from the resource limits of the container.
+func (sp SecurityProfile) apply(cfg *container.Config, hc *container.HostConfig, lim ResourceLimits) error {
+	if isSet(sp.DropCapabilities) {
+		hc.CapDrop = []string{"ALL"}
+		hc.CapAdd = sp.AddCapabilities
+	}
+	if isSet(sp.NoNewPrivileges) {
+		hc.SecurityOpt = append(hc.SecurityOpt, "no-new-privileges")
+	}
+	hc.ReadonlyRootfs = isSet(sp.ReadOnlyRoot)
+	if len(sp.Writable) > 0 {
+		if hc.Tmpfs == nil {
+			hc.Tmpfs = map[string]string{}
+		}
+		opts := "rw,exec,nosuid,nodev"
+		if lim.Tmpfs != 0 {
+			opts += ",size=" + strconv.FormatInt(int64(lim.Tmpfs), 10)
+		}
+		for _, p := range sp.Writable {
+			hc.Tmpfs[p] = opts
+		}
+	}
+	if len(sp.Volumes) > 0 {
+		cfg.Volumes = map[string]struct{}{}
+		for _, p := range sp.Volumes {
+			cfg.Volumes[p] = struct{}{}
+		}
+	}
+	cfg.User = sp.User
+
+	// apply ulimits in a stable order
+	names := make([]string, 0, len(sp.Ulimits))
+	for name := range sp.Ulimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := sp.Ulimits[name]
+		hc.Ulimits = append(hc.Ulimits, &units.Ulimit{Name: name, Soft: v, Hard: v})
+	}
+
+	// load seccomp profile
+	switch sp.Seccomp {
+	case "":
+	case "unconfined":
+		hc.SecurityOpt = append(hc.SecurityOpt, "seccomp=unconfined")
+	default:
+		dat, err := ioutil.ReadFile(sp.Seccomp)
+		if err != nil {
+			return fmt.Errorf("failed to load seccomp profile: %s", err.Error())
+		}
+		hc.SecurityOpt = append(hc.SecurityOpt, "seccomp="+string(dat))
+	}
+
+	hc.Runtime = sp.Runtime
+
+	return nil
+}
+
+// Check returns an error if the profile is invalid.
+func (sp SecurityProfile) Check() error {
+	for name, v := range sp.Ulimits {
+		if _, err := units.ParseUlimit(name + "=" + strconv.FormatInt(v, 10)); err != nil {
+			return err
+		}
+	}
+	for _, p := range sp.Writable {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("writable path %q is not absolute", p)
+		}
+	}
+	for _, p := range sp.Volumes {
+		if !strings.HasPrefix(p, "/") || p == "/" {
+			return fmt.Errorf("volume path %q is not an absolute directory", p)
+		}
+	}
+	if sp.Seccomp != "" && sp.Seccomp != "unconfined" {
+		if _, err := ioutil.ReadFile(sp.Seccomp); err != nil {
+			return fmt.Errorf("failed to load seccomp profile: %s", err.Error())
+		}
+	}
+	return nil
+}
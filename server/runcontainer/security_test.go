@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestSecurityProfile(t *testing.T) {
+	def := SecurityProfile{
+		DropCapabilities: setting(true),
+		NoNewPrivileges:  setting(true),
+		ReadOnlyRoot:     setting(true),
+		Writable:         []string{"/tmp"},
+		User:             "65534:65534",
+		Ulimits:          map[string]int64{"core": 0, "nofile": 1024},
+		Runtime:          "runsc",
+	}
+
+	// loosen settings for a language
+	var lang SecurityProfile
+	err := json.Unmarshal([]byte(`{"readOnlyRoot": false, "user": "root", "ulimits": {"nofile": 4096}}`), &lang)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := def.Override(lang)
+	if err := sp.Check(); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	cfg := &container.Config{}
+	hc := &container.HostConfig{}
+	err = sp.apply(cfg, hc, ResourceLimits{Tmpfs: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.User != "root" {
+		t.Errorf("expected user root but got %q", cfg.User)
+	}
+	if hc.ReadonlyRootfs {
+		t.Errorf("expected writable root filesystem")
+	}
+	if !reflect.DeepEqual([]string(hc.CapDrop), []string{"ALL"}) {
+		t.Errorf("expected all capabilities dropped but got %v", hc.CapDrop)
+	}
+	if !reflect.DeepEqual(hc.SecurityOpt, []string{"no-new-privileges"}) {
+		t.Errorf("unexpected security options %v", hc.SecurityOpt)
+	}
+	if hc.Tmpfs["/tmp"] != "rw,exec,nosuid,nodev,size=1024" {
+		t.Errorf("unexpected tmpfs options %q", hc.Tmpfs["/tmp"])
+	}
+	if len(hc.Ulimits) != 2 || hc.Ulimits[0].Name != "core" || hc.Ulimits[1].Name != "nofile" || hc.Ulimits[1].Hard != 4096 {
+		t.Errorf("unexpected ulimits %v", hc.Ulimits)
+	}
+	if hc.Runtime != "runsc" {
+		t.Errorf("expected runtime runsc but got %q", hc.Runtime)
+	}
+
+	// the default profile is unchanged
+	if def.Ulimits["nofile"] != 1024 || !isSet(def.ReadOnlyRoot) {
+		t.Errorf("override modified the default profile: %+v", def)
+	}
+
+	// invalid settings are rejected
+	for _, bad := range []SecurityProfile{
+		{Ulimits: map[string]int64{"bogus": 1}},
+		{Writable: []string{"tmp"}},
+		{Volumes: []string{"/"}},
+		{Seccomp: "/nonexistent/seccomp.json"},
+	} {
+		if err := bad.Check(); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestUploadVolumes(t *testing.T) {
+	fr := &fakeRuntime{}
+	def := SecurityProfile{ReadOnlyRoot: setting(true), Volumes: []string{"/cache"}}
+	cc := ContainerConfig{
+		Image:     "test",
+		Command:   []string{"/code"},
+		CodeDir:   "/src",
+		OutputDir: "/output",
+		Project:   &ProjectConfig{Dir: "/project", Entrypoint: "main"},
+	}
+
+	// upload directories are mounted as volumes, and the code argument points into the code directory
+	c, err := cc.Create(context.Background(), fr, LimitPolicy{}, def, time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc, _ := fr.get(c.ID)
+	if !reflect.DeepEqual(fc.opts.Security.Volumes, []string{"/cache", "/src", "/project", "/output"}) {
+		t.Errorf("unexpected volumes %v", fc.opts.Security.Volumes)
+	}
+	if !reflect.DeepEqual(fc.opts.Command, []string{"/src/code"}) {
+		t.Errorf("unexpected command %v", fc.opts.Command)
+	}
+	if len(def.Volumes) != 1 {
+		t.Errorf("create modified the default profile: %+v", def)
+	}
+
+	// files can only be copied into the volumes of a read-only root filesystem
+	err = c.UploadCode(context.Background(), cc.codeDir(), []byte("code"))
+	if err != nil {
+		t.Errorf("failed to upload code: %s", err.Error())
+	}
+	if _, ok := fc.files["/src/code"]; !ok {
+		t.Errorf("code was not uploaded to the code directory: %v", fc.files)
+	}
+	err = c.UploadCode(context.Background(), "/", []byte("code"))
+	if err == nil {
+		t.Errorf("uploaded code outside of the volumes")
+	}
+	err = c.MakeDir(context.Background(), cc.OutputDir)
+	if err != nil {
+		t.Errorf("failed to make output directory: %s", err.Error())
+	}
+
+	cfg := &container.Config{}
+	err = def.apply(cfg, &container.HostConfig{}, ResourceLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.Volumes["/cache"]; !ok || len(cfg.Volumes) != 1 {
+		t.Errorf("unexpected volumes %v", cfg.Volumes)
+	}
+}
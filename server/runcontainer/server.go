@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -22,30 +24,97 @@ type ContainerServer struct {
 
 	// Upgrader is a websocket Upgrader used for all websocket connections.
 	Upgrader websocket.Upgrader
+
+	// Sessions is the registry of running sessions.
+	Sessions SessionRegistry
+
+	// AdminToken is the bearer token required to use the admin API.
+	// If empty, the admin API is disabled.
+	AdminToken string
+
+	// Exec is the configuration for non-interactive runs.
+	Exec ExecConfig
+
+	// Admission limits the number of concurrently running containers.
+	Admission AdmissionController
+
+	// TrustProxy is whether to identify clients by the X-Real-IP header set by a reverse proxy.
+	TrustProxy bool
+
+	// PoolMaxAge is the amount of time after which an idle pooled container is replaced.
+	PoolMaxAge time.Duration
+
+	// PoolRefillRate is the amount of time between container pool maintenance checks.
+	PoolRefillRate time.Duration
+
+	// pools is a map of pool keys to container pools.
+	pools map[string]*ContainerPool
+
+	// drain tracks in-flight sessions and runs for graceful shutdown.
+	drain drainState
 }
 
-// HandleTerminal serves an interactive terminal websocket.
-func (cs *ContainerServer) HandleTerminal(w http.ResponseWriter, r *http.Request) {
-	// get language
-	lang, ok := cs.Containers[r.URL.Query().Get("lang")]
-	if !ok {
-		http.Error(w, "language not supported", http.StatusBadRequest)
-		return
+// poolKey returns the key of the container pool for a language and mode.
+func poolKey(lang string, isrun bool) string {
+	if isrun {
+		return lang + "/run"
 	}
+	return lang + "/term"
+}
 
-	// run ContainerSession
-	HandleContainerSession(w, r, false, lang.TermContainer, &cs.SessionConfig)
+// StartPools starts container pools for all containers with pooling configured.
+func (cs *ContainerServer) StartPools() {
+	cs.pools = map[string]*ContainerPool{}
+	for name, lang := range cs.Containers {
+		for _, isrun := range []bool{false, true} {
+			cc := lang.TermContainer
+			if isrun {
+				cc = lang.RunContainer
+			}
+			if cc.Pool.MinIdle == 0 && cc.Pool.MaxIdle == 0 {
+				continue
+			}
+			p := &ContainerPool{
+				Config:        cc,
+				Size:          cc.Pool,
+				MaxAge:        cs.PoolMaxAge,
+				RefillRate:    cs.PoolRefillRate,
+				SessionConfig: &cs.SessionConfig,
+			}
+			p.Start()
+			cs.pools[poolKey(name, isrun)] = p
+		}
+	}
 }
 
-// HandleRun serves an interactive terminal websocket running user code.
-func (cs *ContainerServer) HandleRun(w http.ResponseWriter, r *http.Request) {
-	// get language
-	lang, ok := cs.Containers[r.URL.Query().Get("lang")]
-	if !ok {
-		http.Error(w, "language not supported", http.StatusBadRequest)
-		return
+// Close shuts down the ContainerServer, removing all pooled containers.
+func (cs *ContainerServer) Close() error {
+	var err error
+	for _, p := range cs.pools {
+		cerr := p.Close()
+		if cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// HandlePoolStats serves the statistics of all container pools as JSON.
+func (cs *ContainerServer) HandlePoolStats(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]PoolStats{}
+	for k, p := range cs.pools {
+		stats[k] = p.Stats()
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
 
-	// run ContainerSession
-	HandleContainerSession(w, r, true, lang.RunContainer, &cs.SessionConfig)
+// HandleTerminal serves an interactive terminal websocket.
+func (cs *ContainerServer) HandleTerminal(w http.ResponseWriter, r *http.Request) {
+	cs.HandleContainerSession(w, r, r.URL.Query().Get("lang"), false)
+}
+
+// HandleRun serves an interactive terminal websocket running user code.
+func (cs *ContainerServer) HandleRun(w http.ResponseWriter, r *http.Request) {
+	cs.HandleContainerSession(w, r, r.URL.Query().Get("lang"), true)
 }
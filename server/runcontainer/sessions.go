@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// newSessionID generates a random session ID.
+func newSessionID() (string, error) {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// SessionInfo is a summary of a running session.
+type SessionInfo struct {
+	ID          string    `json:"id"`
+	Language    string    `json:"lang"`
+	Mode        string    `json:"mode"`
+	StartTime   time.Time `json:"start"`
+	ContainerID string    `json:"container"`
+	ClientAddr  string    `json:"client"`
+	Attached    bool      `json:"attached"`
+	BytesIn     uint64    `json:"bytesIn"`
+	BytesOut    uint64    `json:"bytesOut"`
+	Recording   bool      `json:"recording"`
+
+	// Participants is the list of clients attached to the session.
+	Participants []ParticipantInfo `json:"participants"`
+}
+
+// Info returns a summary of the session.
+func (cs *ContainerSession) Info() SessionInfo {
+	mode := "term"
+	if cs.IsRun {
+		mode = "run"
+	}
+	return SessionInfo{
+		ID:           cs.ID,
+		Language:     cs.Language,
+		Mode:         mode,
+		StartTime:    cs.StartTime,
+		ContainerID:  cs.Container.ID,
+		ClientAddr:   cs.ClientAddr,
+		Attached:     cs.Attached(),
+		BytesIn:      atomic.LoadUint64(&cs.bytesIn),
+		BytesOut:     atomic.LoadUint64(&cs.bytesOut),
+		Recording:    cs.Recorder != nil,
+		Participants: cs.Participants(),
+	}
+}
+
+// Terminate forcibly ends the session, stopping its container.
+func (cs *ContainerSession) Terminate() {
+	if cs.cancel != nil {
+		cs.cancel()
+	}
+}
+
+// SessionRegistry is a concurrency-safe registry of running ContainerSessions.
+type SessionRegistry struct {
+	lck      sync.Mutex
+	sessions map[string]*ContainerSession
+}
+
+// Add adds a session to the registry under its ID.
+func (sr *SessionRegistry) Add(cs *ContainerSession) {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	if sr.sessions == nil {
+		sr.sessions = map[string]*ContainerSession{}
+	}
+	sr.sessions[cs.ID] = cs
+}
+
+// Remove removes the session with the given ID from the registry.
+func (sr *SessionRegistry) Remove(id string) {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	delete(sr.sessions, id)
+}
+
+// Get looks up a session by ID.
+// If there is no session with the ID, returns nil.
+func (sr *SessionRegistry) Get(id string) *ContainerSession {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	return sr.sessions[id]
+}
+
+// Snapshot returns all sessions in the registry.
+func (sr *SessionRegistry) Snapshot() []*ContainerSession {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	sessions := make([]*ContainerSession, 0, len(sr.sessions))
+	for _, cs := range sr.sessions {
+		sessions = append(sessions, cs)
+	}
+	return sessions
+}
+
+// List returns summaries of all sessions in the registry, ordered by start time.
+func (sr *SessionRegistry) List() []SessionInfo {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	infos := make([]SessionInfo, 0, len(sr.sessions))
+	for _, cs := range sr.sessions {
+		infos = append(infos, cs.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartTime.Before(infos[j].StartTime)
+	})
+	return infos
+}
+
+// signals is the set of signals which clients may send to a container.
+var signals = map[string]bool{
+	"SIGINT":  true,
+	"SIGTERM": true,
+	"SIGKILL": true,
+}
+
+// parseSignal parses and validates a signal name such as "SIGINT" or "int".
+func parseSignal(sig string) (string, error) {
+	sig = strings.ToUpper(sig)
+	if !strings.HasPrefix(sig, "SIG") {
+		sig = "SIG" + sig
+	}
+	if !signals[sig] {
+		return "", fmt.Errorf("unsupported signal %q", sig)
+	}
+	return sig, nil
+}
+
+// Signal sends a signal to the program running in the session.
+// Only SIGINT, SIGTERM and SIGKILL are supported.
+func (cs *ContainerSession) Signal(sig string) error {
+	sig, err := parseSignal(sig)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cs.Config.ContainerStopTimeout)
+	defer cancel()
+	return cs.Container.Kill(ctx, sig)
+}
+
+// HandleSignal sends a signal to a session.
+// The session ID and signal are passed with the "id" and "signal" query parameters.
+func (cs *ContainerServer) HandleSignal(w http.ResponseWriter, r *http.Request) {
+	// only allow POST requests
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// find session
+	sess := cs.Sessions.Get(r.URL.Query().Get("id"))
+	if sess == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	// send signal
+	sig, err := parseSignal(r.URL.Query().Get("signal"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = sess.Signal(sig)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to send signal: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errShuttingDown is an error indicating that a request was rejected because the server is shutting down.
+var errShuttingDown = errors.New("server is shutting down")
+
+// drainState tracks in-flight requests which run containers, so that they can be drained when the server shuts down.
+type drainState struct {
+	lck      sync.Mutex
+	active   int
+	draining bool
+	killed   bool
+	deadline time.Time
+
+	// stopch is closed when draining begins.
+	stopch chan struct{}
+
+	// killch is closed when the remaining requests are terminated.
+	killch chan struct{}
+
+	// idlech is closed once the server is draining and no requests remain.
+	idlech chan struct{}
+}
+
+// init initializes the channels of the drainState.
+// The caller must hold lck.
+func (d *drainState) init() {
+	if d.stopch == nil {
+		d.stopch = make(chan struct{})
+		d.killch = make(chan struct{})
+		d.idlech = make(chan struct{})
+	}
+}
+
+// enter registers an in-flight request.
+// Returns false if the server is draining, in which case the request must be rejected.
+func (d *drainState) enter() bool {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	d.init()
+	if d.draining {
+		return false
+	}
+	d.active++
+	return true
+}
+
+// leave unregisters an in-flight request.
+func (d *drainState) leave() {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	d.active--
+	if d.draining && d.active == 0 {
+		close(d.idlech)
+	}
+}
+
+// channels returns channels which are closed when draining begins and when the remaining requests are terminated.
+func (d *drainState) channels() (stop, kill <-chan struct{}) {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	d.init()
+	return d.stopch, d.killch
+}
+
+// begin starts draining with the given deadline, and returns a channel which is closed once no requests remain.
+func (d *drainState) begin(deadline time.Time) <-chan struct{} {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	d.init()
+	if !d.draining {
+		d.draining = true
+		d.deadline = deadline
+		close(d.stopch)
+		if d.active == 0 {
+			close(d.idlech)
+		}
+	}
+	return d.idlech
+}
+
+// kill terminates the remaining requests.
+func (d *drainState) kill() {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	d.init()
+	if !d.killed {
+		d.killed = true
+		close(d.killch)
+	}
+}
+
+// warning returns the warning sent to clients while draining.
+// Returns false if the server is not draining.
+func (d *drainState) warning() (StatusUpdate, bool) {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+	if !d.draining {
+		return StatusUpdate{}, false
+	}
+	msg := "server is shutting down"
+	if !d.deadline.IsZero() {
+		msg = fmt.Sprintf("server is shutting down, session will end in %s", time.Until(d.deadline).Round(time.Second))
+	}
+	return StatusUpdate{Status: "warning", Message: msg}, true
+}
+
+// cancelOn returns a context derived from parent which is also cancelled when ch is closed.
+func cancelOn(parent context.Context, ch <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Shutdown gracefully shuts down the ContainerServer.
+// New sessions and runs are rejected, queued requests are aborted, and connected clients are warned.
+// Running sessions are given until ctx is done to finish, after which they are terminated.
+// Finally, pooled containers are removed.
+func (cs *ContainerServer) Shutdown(ctx context.Context) error {
+	// stop accepting sessions
+	deadline, _ := ctx.Deadline()
+	idlech := cs.drain.begin(deadline)
+
+	// warn connected clients
+	warning, _ := cs.drain.warning()
+	sessions := cs.Sessions.Snapshot()
+	for _, sess := range sessions {
+		err := sess.UpdateStatus(warning)
+		if err != nil {
+			sess.logger().WithError(err).Warn("failed to send shutdown warning")
+		}
+	}
+	logrus.WithField("sessions", len(sessions)).Info("draining sessions")
+
+	// wait for sessions to finish, terminating them at the deadline
+	var err error
+	select {
+	case <-idlech:
+	case <-ctx.Done():
+		logrus.WithField("sessions", len(cs.Sessions.Snapshot())).Warn("drain deadline exceeded, terminating sessions")
+		cs.drain.kill()
+		select {
+		case <-idlech:
+		case <-time.After(cs.SessionConfig.KillGracePeriod + cs.SessionConfig.ContainerStopTimeout):
+			err = errors.New("timed out terminating sessions")
+		}
+	}
+
+	// remove pooled containers
+	cerr := cs.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	srv, ts := newTestServer(echoProgram)
+	defer ts.Close()
+
+	// start session
+	ws := dialTest(t, ts, "/term", url.Values{"lang": {"test"}})
+	defer ws.Close()
+	expectStatus(t, ws, "starting")
+	expectStatus(t, ws, "running")
+
+	// begin shutdown
+	errch := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		errch <- srv.Shutdown(ctx)
+	}()
+
+	// the client is warned, and keeps running until the deadline
+	if su := expectStatus(t, ws, "warning"); !strings.Contains(su.Message, "shutting down") {
+		t.Errorf("unexpected warning %q", su.Message)
+	}
+	sendInput(t, ws, "a\n")
+	expectOutput(t, ws, "a\n")
+
+	// new sessions are rejected
+	resp, err := http.Get(ts.URL + "/term?lang=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d but got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	// the session is terminated at the deadline
+	expectStatus(t, ws, "terminated")
+	select {
+	case err = <-errch:
+		if err != nil {
+			t.Fatalf("failed to shut down: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+	if infos := srv.Sessions.List(); len(infos) != 0 {
+		t.Errorf("sessions left after shutdown: %+v", infos)
+	}
+	cs, _ := srv.SessionConfig.Runtime.List(context.Background())
+	if len(cs) != 0 {
+		t.Errorf("containers left after shutdown: %+v", cs)
+	}
+}
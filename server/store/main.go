@@ -7,13 +7,43 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// opDuration tracks the latency of store operations on code and recordings ("get" or "set").
+	opDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "openrepl",
+		Subsystem: "store",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of store operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+
+	// lookups counts get operations by result ("hit", "miss" or "error").
+	lookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "openrepl",
+		Subsystem: "store",
+		Name:      "lookups_total",
+		Help:      "Number of code lookups, by result.",
+	}, []string{"result"})
 )
 
+func init() {
+	prometheus.MustRegister(opDuration, lookups)
+}
+
 // DirStore is a KVStore backed by a directory.
 type DirStore struct {
 	Dir string
@@ -95,7 +125,17 @@ func (cs CodeStore) Get(key string) (Code, error) {
 	}
 
 	// get code from store
+	start := time.Now()
 	dat, err := cs.KV.Get(k)
+	opDuration.WithLabelValues("get").Observe(time.Since(start).Seconds())
+	switch err {
+	case nil:
+		lookups.WithLabelValues("hit").Inc()
+	case ErrNotExist:
+		lookups.WithLabelValues("miss").Inc()
+	default:
+		lookups.WithLabelValues("error").Inc()
+	}
 	if err != nil {
 		return Code{}, err
 	}
@@ -122,7 +162,9 @@ func (cs CodeStore) Store(c Code) (string, error) {
 	hash := sha256.Sum256(dat)
 
 	// save in KVStore
+	start := time.Now()
 	err = cs.KV.Set(hash[:], dat)
+	opDuration.WithLabelValues("set").Observe(time.Since(start).Seconds())
 	if err != nil {
 		return "", err
 	}
@@ -131,12 +173,53 @@ func (cs CodeStore) Store(c Code) (string, error) {
 	return hex.EncodeToString(hash[:]), nil
 }
 
+// setupLogging configures the global logger with a level name (e.g. "info") and a format ("json" or "text").
+func setupLogging(level, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
+	switch format {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// maxReplaySpeed is the maximum speedup of replays.
+const maxReplaySpeed = 1000
+
+// loadError reports a failure to load the value with the given key.
+func loadError(w http.ResponseWriter, key string, err error) {
+	http.Error(w, fmt.Sprintf("failed to load: %s", err.Error()), http.StatusInternalServerError)
+	l := logrus.WithError(err).WithField("key", key)
+	if err == ErrNotExist {
+		l.Debug("key not found")
+	} else {
+		l.Error("failed to load")
+	}
+}
+
 func main() {
 	var driver string
 	var dir string
+	var loglevel, logformat string
+	var maxrecording int64
 	flag.StringVar(&driver, "driver", "mem", "driver for key-value store")
 	flag.StringVar(&dir, "dir", "", "directory to use for dir driver")
+	flag.Int64Var(&maxrecording, "max-recording-size", 16<<20, "maximum size of a session recording in bytes")
+	flag.StringVar(&loglevel, "log-level", "info", "minimum level of logged messages (debug, info, warning or error)")
+	flag.StringVar(&logformat, "log-format", "json", "log format (json or text)")
 	flag.Parse()
+	err := setupLogging(loglevel, logformat)
+	if err != nil {
+		panic(err)
+	}
 
 	// initialize KVStore
 	var kv KVStore
@@ -162,14 +245,20 @@ func main() {
 		err := json.NewDecoder(r.Body).Decode(&c)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("failed to decode request: %s", err.Error()), http.StatusBadRequest)
+			logrus.WithError(err).Debug("invalid store request")
 			return
 		}
 
 		key, err := cs.Store(c)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to store: %s", err.Error()), http.StatusInternalServerError)
+			logrus.WithError(err).WithField("language", c.Language).Error("failed to store code")
 			return
 		}
+		logrus.WithFields(logrus.Fields{
+			"key":      key,
+			"language": c.Language,
+		}).Debug("stored code")
 
 		// write back key
 		w.Header().Add("Content-Type", "text/plain")
@@ -196,7 +285,7 @@ func main() {
 		// run KV lookup
 		c, err := cs.Get(key)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to load: %s", err.Error()), http.StatusInternalServerError)
+			loadError(w, key, err)
 			return
 		}
 
@@ -208,5 +297,110 @@ func main() {
 		json.NewEncoder(w).Encode(c)
 	})
 
+	rs := RecordingStore{kv}
+
+	// store or load a session recording
+	http.HandleFunc("/recording", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			// read recording
+			dat, err := ioutil.ReadAll(io.LimitReader(r.Body, maxrecording+1))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to read request: %s", err.Error()), http.StatusBadRequest)
+				return
+			}
+			if int64(len(dat)) > maxrecording {
+				http.Error(w, "recording too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			// store recording
+			key, err := rs.Store(dat)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to store recording: %s", err.Error()), http.StatusBadRequest)
+				logrus.WithError(err).Warn("failed to store recording")
+				return
+			}
+			logrus.WithFields(logrus.Fields{
+				"key":  key,
+				"size": len(dat),
+			}).Debug("stored recording")
+
+			// write back key
+			w.Header().Add("Content-Type", "text/plain")
+			w.Write([]byte(key))
+		case http.MethodGet:
+			// handle ETag caching
+			key := r.URL.Query().Get("key")
+			if etag := r.Header.Get("If-None-Match"); etag != "" && etag == key {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			// load recording
+			dat, err := rs.Get(key)
+			if err != nil {
+				loadError(w, key, err)
+				return
+			}
+
+			// send recording
+			w.Header().Add("ETag", key)
+			w.Header().Add("Content-Type", "application/x-asciicast")
+			w.Write(dat)
+		default:
+			http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// replay a session recording at its original timing
+	http.HandleFunc("/replay", func(w http.ResponseWriter, r *http.Request) {
+		// check method
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// parse replay speed
+		speed := 1.0
+		if s := r.URL.Query().Get("speed"); s != "" {
+			var err error
+			speed, err = strconv.ParseFloat(s, 64)
+			if err != nil || speed < 1 || speed > maxReplaySpeed {
+				http.Error(w, fmt.Sprintf("invalid speed %q: must be between 1 and %d", s, maxReplaySpeed), http.StatusBadRequest)
+				return
+			}
+		}
+		raw := r.URL.Query().Get("format") == "raw"
+
+		// load recording
+		key := r.URL.Query().Get("key")
+		dat, err := rs.Get(key)
+		if err != nil {
+			loadError(w, key, err)
+			return
+		}
+		rec, err := parseRecording(dat)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to parse recording: %s", err.Error()), http.StatusInternalServerError)
+			logrus.WithError(err).WithField("key", key).Error("failed to parse recording")
+			return
+		}
+
+		// stream recording
+		if raw {
+			w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Add("Content-Type", "application/x-asciicast")
+		}
+		err = rec.Replay(r.Context(), w, speed, raw)
+		if err != nil {
+			logrus.WithError(err).WithField("key", key).Debug("replay stopped")
+		}
+	})
+
+	http.Handle("/metrics", promhttp.Handler())
+
+	logrus.WithField("driver", driver).Info("starting store")
 	panic(http.ListenAndServe(":80", nil))
 }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// recordingKey returns the KVStore key of a recording with the given hash.
+// Keys of recordings are prefixed to keep them apart from code.
+func recordingKey(hash []byte) []byte {
+	return append([]byte("asciicast:"), hash...)
+}
+
+// asciicastHeader is the header of a recording in the asciicast v2 format.
+type asciicastHeader struct {
+	Version       int     `json:"version"`
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	IdleTimeLimit float64 `json:"idle_time_limit,omitempty"`
+}
+
+// asciicastEvent is an event of a recording in the asciicast v2 format.
+type asciicastEvent struct {
+	// Time is the time of the event in seconds since the start of the recording.
+	Time float64
+
+	// Type is the type of the event: "o" for output, "i" for input, "r" for a resize or "m" for a marker.
+	Type string
+
+	// Data is the data of the event.
+	Data string
+
+	// line is the encoded event.
+	line []byte
+}
+
+// Recording is a parsed recording in the asciicast v2 format.
+type Recording struct {
+	Header asciicastHeader
+	Events []asciicastEvent
+
+	// header is the encoded header.
+	header []byte
+}
+
+// parseRecording parses and validates a recording in the asciicast v2 format.
+func parseRecording(dat []byte) (Recording, error) {
+	var rec Recording
+	var last float64
+	for i, line := range bytes.Split(dat, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		// parse header
+		if rec.header == nil {
+			err := json.Unmarshal(line, &rec.Header)
+			if err != nil {
+				return Recording{}, fmt.Errorf("invalid header: %s", err.Error())
+			}
+			if rec.Header.Version != 2 {
+				return Recording{}, fmt.Errorf("unsupported asciicast version %d", rec.Header.Version)
+			}
+			if rec.Header.Width <= 0 || rec.Header.Height <= 0 {
+				return Recording{}, errors.New("invalid terminal size")
+			}
+			rec.header = line
+			continue
+		}
+
+		// parse event
+		var fields []json.RawMessage
+		err := json.Unmarshal(line, &fields)
+		if err != nil || len(fields) != 3 {
+			return Recording{}, fmt.Errorf("invalid event on line %d", i+1)
+		}
+		ev := asciicastEvent{line: line}
+		for j, v := range []interface{}{&ev.Time, &ev.Type, &ev.Data} {
+			err = json.Unmarshal(fields[j], v)
+			if err != nil {
+				return Recording{}, fmt.Errorf("invalid event on line %d: %s", i+1, err.Error())
+			}
+		}
+		switch ev.Type {
+		case "o", "i", "r", "m":
+		default:
+			return Recording{}, fmt.Errorf("invalid event type %q on line %d", ev.Type, i+1)
+		}
+		if ev.Time < last {
+			return Recording{}, fmt.Errorf("event on line %d is out of order", i+1)
+		}
+		last = ev.Time
+		rec.Events = append(rec.Events, ev)
+	}
+	if rec.header == nil {
+		return Recording{}, errors.New("missing header")
+	}
+	return rec, nil
+}
+
+// RecordingStore is a storage system for session recordings using a KVStore.
+type RecordingStore struct {
+	KV KVStore
+}
+
+// Get retrieves an encoded recording from the store.
+func (rs RecordingStore) Get(key string) ([]byte, error) {
+	// decode key
+	k, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// get recording from store
+	start := time.Now()
+	dat, err := rs.KV.Get(recordingKey(k))
+	opDuration.WithLabelValues("get").Observe(time.Since(start).Seconds())
+	return dat, err
+}
+
+// Store validates an encoded recording and stores it in the KVStore.
+func (rs RecordingStore) Store(dat []byte) (string, error) {
+	// validate recording
+	_, err := parseRecording(dat)
+	if err != nil {
+		return "", err
+	}
+
+	// hash recording to generate key
+	hash := sha256.Sum256(dat)
+
+	// save in KVStore
+	start := time.Now()
+	err = rs.KV.Set(recordingKey(hash[:]), dat)
+	opDuration.WithLabelValues("set").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return "", err
+	}
+
+	// encode hash key into text format
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// Replay writes a recording to w at its original timing, sped up by a factor of speed.
+// If raw is set, only the output is written, so that the replay can be watched in a terminal.
+// Otherwise, the header and events are written in the asciicast v2 format.
+// Pauses longer than the idle time limit of the recording are shortened to the limit.
+func (rec Recording) Replay(ctx context.Context, w io.Writer, speed float64, raw bool) error {
+	// write header
+	if !raw {
+		err := writeLine(w, rec.header)
+		if err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	var last, elapsed float64
+	for _, ev := range rec.Events {
+		// skip events which are not output in raw mode
+		if raw && ev.Type != "o" {
+			continue
+		}
+
+		// wait until the event, shortening long pauses
+		pause := ev.Time - last
+		if rec.Header.IdleTimeLimit > 0 && pause > rec.Header.IdleTimeLimit {
+			pause = rec.Header.IdleTimeLimit
+		}
+		last = ev.Time
+		elapsed += pause
+		t := time.NewTimer(time.Until(start.Add(time.Duration(elapsed / speed * float64(time.Second)))))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+
+		// write event
+		var err error
+		if raw {
+			_, err = io.WriteString(w, ev.Data)
+			flush(w)
+		} else {
+			err = writeLine(w, ev.line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flush flushes buffered data to the client if w is an http.Flusher.
+func flush(w io.Writer) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writeLine writes a line to w and flushes it.
+func writeLine(w io.Writer, line []byte) error {
+	_, err := w.Write(line)
+	if err == nil {
+		_, err = io.WriteString(w, "\n")
+	}
+	flush(w)
+	return err
+}
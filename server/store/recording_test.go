@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+const testRecording = `{"version": 2, "width": 80, "height": 24, "idle_time_limit": 0.05}
+[0.01, "o", "$ "]
+[0.02, "i", "ls\r"]
+[0.03, "o", "ls\r\n"]
+[10.0, "r", "100x30"]
+[10.04, "o", "a.txt\r\n"]
+`
+
+func TestParseRecording(t *testing.T) {
+	tbl := []struct {
+		dat string
+		ok  bool
+	}{
+		{testRecording, true},
+		{`{"version": 2, "width": 80, "height": 24}`, true},
+		{"", false},
+		{`{"version": 1, "width": 80, "height": 24}`, false},
+		{`{"version": 2, "width": 0, "height": 24}`, false},
+		{`{"version": 2, "width": 80, "height": 24}` + "\n" + `[0.1, "x", "a"]`, false},
+		{`{"version": 2, "width": 80, "height": 24}` + "\n" + `[0.1, "o"]`, false},
+		{`{"version": 2, "width": 80, "height": 24}` + "\n" + `[0.2, "o", "a"]` + "\n" + `[0.1, "o", "b"]`, false},
+	}
+	for _, v := range tbl {
+		_, err := parseRecording([]byte(v.dat))
+		if (err == nil) != v.ok {
+			t.Errorf("expected ok=%v for %q but got error %v", v.ok, v.dat, err)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	rec, err := parseRecording([]byte(testRecording))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// raw replay writes only output, shortening the long pause to the idle time limit
+	var buf bytes.Buffer
+	start := time.Now()
+	err = rec.Replay(context.Background(), &buf, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 80*time.Millisecond || d > 5*time.Second {
+		t.Errorf("unexpected replay duration %s", d)
+	}
+	if buf.String() != "$ ls\r\na.txt\r\n" {
+		t.Errorf("unexpected raw replay %q", buf.String())
+	}
+
+	// asciicast replay writes the recording unchanged
+	buf.Reset()
+	err = rec.Replay(context.Background(), &buf, maxReplaySpeed, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != testRecording {
+		t.Errorf("unexpected asciicast replay %q", buf.String())
+	}
+
+	// cancelled replays stop
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = rec.Replay(ctx, &buf, 1, false)
+	if err != context.Canceled {
+		t.Errorf("expected %v but got %v", context.Canceled, err)
+	}
+}
+
+func TestRecordingStore(t *testing.T) {
+	rs := RecordingStore{new(MemStore)}
+	key, err := rs.Store([]byte(testRecording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err := rs.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dat) != testRecording {
+		t.Errorf("unexpected recording %q", dat)
+	}
+
+	// recordings are kept apart from code
+	_, err = CodeStore{rs.KV}.Get(key)
+	if err != ErrNotExist {
+		t.Errorf("expected %v loading recording as code but got %v", ErrNotExist, err)
+	}
+	_, err = rs.Store([]byte("not a recording"))
+	if err == nil {
+		t.Errorf("stored invalid recording")
+	}
+}
@@ -21,12 +21,28 @@ openrepl.wsurl = function(url) {
     url.protocol = {"http:":"ws:","https:":"wss:","ws:":"ws:","wss:":"wss:"}[url.protocol] || "ws:";
 };
 
+// openrepl.setSize sets the initial terminal size query parameters on a session URL.
+// size is an optional object with cols and rows fields.
+openrepl.setSize = function(url, size) {
+    if(!size) return;
+    url.searchParams.set('cols', size.cols);
+    url.searchParams.set('rows', size.rows);
+};
+
+// openrepl.resize notifies the server of a new terminal size on a session WebSocket.
+// Control messages are sent as binary messages to keep them separate from input.
+openrepl.resize = function(ws, cols, rows) {
+    var msg = JSON.stringify({"type": "resize", "cols": cols, "rows": rows});
+    ws.send(new TextEncoder().encode(msg));
+};
+
 // openrepl.run starts a code run session and returns a promise to a corresponding WebSocket.
-openrepl.run = function(code, lang) {
+openrepl.run = function(code, lang, size) {
     return new Promise(function(s, f) {
         // build target url
         var targurl = new URL('/api/exec/run', window.location.href);
         targurl.searchParams.set('lang', lang);
+        openrepl.setSize(targurl, size);
         openrepl.wsurl(targurl);
 
         // connect WebSocket
@@ -74,11 +90,12 @@ openrepl.run = function(code, lang) {
 };
 
 // openrepl.term starts an interactive terminal session and returns a promise to a corresponding WebSocket.
-openrepl.term = function(lang) {
+openrepl.term = function(lang, size) {
     return new Promise(function(s, f) {
         // build target url
         var targurl = new URL('/api/exec/term', window.location.href);
         targurl.searchParams.set('lang', lang);
+        openrepl.setSize(targurl, size);
         openrepl.wsurl(targurl);
 
         // connect WebSocket
@@ -121,6 +138,457 @@ openrepl.term = function(lang) {
     });
 };
 
+// openrepl.exec runs code non-interactively and returns a promise to the result.
+// The result has stdout, stderr, exitCode, wallTime, timedOut and oomKilled fields.
+// If artifacts is set, the result also has an artifacts field listing the files written to the output directory, as {path, content} with base64 content.
+openrepl.exec = function(code, lang, stdin, timeout, artifacts) {
+    return new Promise(function(resolve, reject) {
+        var xhr = new XMLHttpRequest();
+        xhr.open('POST', '/api/exec/exec');
+        xhr.responseType = 'json';
+        var req = {"code": code, "lang": lang, "stdin": stdin || ""};
+        if(timeout) req.timeout = timeout;
+        if(artifacts) req.artifacts = true;
+        openrepl.xhrpromise(xhr, JSON.stringify(req)).then(function(res) {
+            resolve(res);
+        }, function(e) {
+            reject(e);
+        });
+    });
+};
+
+// openrepl.parseStatus returns the status update in a message from a running session, or null if it is output.
+openrepl.parseStatus = function(data) {
+    if(typeof data !== 'string' || data.lastIndexOf('{"status":', 0) !== 0) return null;
+    try {
+        return JSON.parse(data);
+    } catch(e) {
+        return null;
+    }
+};
+
+// openrepl.attach connects a terminal to a running raw protocol session WebSocket.
+// Status updates are passed to onstatus instead of being written to the terminal.
+// Terminal resizes are forwarded to the server.
+// When the program exits, onstatus receives a status of 'exited' with the exit code and a reason of 'success', 'error', 'signal', 'oom' or 'timeout'.
+// Returns a function which detaches the terminal.
+openrepl.attach = function(term, ws, onstatus) {
+    var ondata = function(data) {
+        ws.send(data);
+    };
+    var onresize = function(size) {
+        openrepl.resize(ws, size.cols, size.rows);
+    };
+    ws.onmessage = function(ev) {
+        var su = openrepl.parseStatus(ev.data);
+        if(su != null) {
+            if(onstatus) onstatus(su);
+            return;
+        }
+        term.write(ev.data);
+    };
+    term.on('data', ondata);
+    term.on('resize', onresize);
+    return function() {
+        ws.onmessage = null;
+        term.off('data', ondata);
+        term.off('resize', onresize);
+    };
+};
+
+// openrepl.frames is the set of frame types in the framed v2 protocol.
+// Every v2 message is a binary message starting with a frame type byte.
+openrepl.frames = {
+    stdin: 0,
+    stdout: 1,
+    stderr: 2,
+    status: 3,
+    resize: 4,
+    signal: 5,
+    exit: 6,
+    code: 7
+};
+
+// openrepl.Session is a session using the framed v2 protocol.
+// Set onstdout, onstderr, onstatus and onexit to receive output and status updates.
+// Set onclose to be notified when the session ends or the connection is lost for good.
+// If the connection drops, the session reconnects automatically and missed output is replayed.
+// role is the role of the participant in the session ('owner', 'writer' or 'viewer'), and participants is the latest list of participants.
+// The owner also receives writeToken and viewToken, with which others can join the session.
+openrepl.Session = function(ws) {
+    this.ws = ws;
+    this.id = null;
+    this.token = null;
+    this.name = null;
+    this.role = null;
+    this.participant = null;
+    this.writeToken = null;
+    this.viewToken = null;
+    this.participants = [];
+    this.received = 0;
+    this.closed = false;
+    this.onstdout = null;
+    this.onstderr = null;
+    this.onstatus = null;
+    this.onexit = null;
+    this.onclose = null;
+    this.decoders = {};
+    this.decoders[openrepl.frames.stdout] = new TextDecoder();
+    this.decoders[openrepl.frames.stderr] = new TextDecoder();
+};
+
+// update updates the session information from a status update.
+openrepl.Session.prototype.update = function(su) {
+    if(su.id) this.id = su.id;
+    if(su.token) this.token = su.token;
+    if(su.role) this.role = su.role;
+    if(su.participant) this.participant = su.participant;
+    if(su.writeToken) this.writeToken = su.writeToken;
+    if(su.viewToken) this.viewToken = su.viewToken;
+    if(su.participants) this.participants = su.participants;
+};
+
+// sendFrame sends a frame of the given type with a string or Uint8Array payload.
+openrepl.Session.prototype.sendFrame = function(type, payload) {
+    if(typeof payload === 'string') payload = new TextEncoder().encode(payload);
+    var frame = new Uint8Array(payload.length + 1);
+    frame[0] = type;
+    frame.set(payload, 1);
+    this.ws.send(frame);
+};
+
+// send sends input to the program.
+openrepl.Session.prototype.send = function(data) {
+    this.sendFrame(openrepl.frames.stdin, data);
+};
+
+// resize notifies the server of a new terminal size.
+openrepl.Session.prototype.resize = function(cols, rows) {
+    this.sendFrame(openrepl.frames.resize, JSON.stringify({"cols": cols, "rows": rows}));
+};
+
+// signal sends a signal ('SIGINT', 'SIGTERM' or 'SIGKILL') to the program.
+openrepl.Session.prototype.signal = function(sig) {
+    this.sendFrame(openrepl.frames.signal, JSON.stringify({"signal": sig}));
+};
+
+// close closes the session.
+openrepl.Session.prototype.close = function() {
+    this.closed = true;
+    this.ws.close();
+};
+
+// openrepl.reconnectDelays is the list of delays in milliseconds between attempts to reconnect a dropped session.
+openrepl.reconnectDelays = [500, 2000, 5000];
+
+// handleClose handles the WebSocket of the session closing, reconnecting if the connection dropped.
+openrepl.Session.prototype.handleClose = function(ev) {
+    var sess = this;
+    var end = function() {
+        if(sess.onclose) sess.onclose();
+    };
+    if(this.closed || ev.code == 1000 || !this.token) {
+        end();
+        return;
+    }
+    var attempt = function(i) {
+        if(i >= openrepl.reconnectDelays.length) {
+            end();
+            return;
+        }
+        setTimeout(function() {
+            sess.reconnect().then(function() {}, function() {
+                attempt(i + 1);
+            });
+        }, openrepl.reconnectDelays[i]);
+    };
+    attempt(0);
+};
+
+// reconnect reattaches to the session over a new WebSocket, replaying output missed while disconnected.
+// Returns a promise which is fulfilled when the session is running again.
+openrepl.Session.prototype.reconnect = function() {
+    var sess = this;
+    return new Promise(function(s, f) {
+        // build target url
+        var targurl = new URL('/api/exec/attach', window.location.href);
+        targurl.searchParams.set('token', sess.token);
+        targurl.searchParams.set('offset', sess.received);
+        if(sess.name) targurl.searchParams.set('name', sess.name);
+        openrepl.wsurl(targurl);
+
+        // connect WebSocket
+        var ws = new WebSocket(targurl.toString(), 'openrepl.v2');
+        ws.binaryType = 'arraybuffer';
+        var finished = false;
+
+        // wait for running status, then pass off WebSocket
+        ws.onmessage = function(ev) {
+            var frame = new Uint8Array(ev.data);
+            var su = null;
+            if(frame[0] == openrepl.frames.status) {
+                su = JSON.parse(new TextDecoder().decode(frame.subarray(1)));
+            }
+            finished = true;
+            if(su == null || su.status != 'running') {
+                ws.onclose = null;
+                ws.close();
+                f(su ? su.err : "unexpected frame");
+                return;
+            }
+            sess.update(su);
+            sess.ws = ws;
+            ws.onmessage = function(ev) {
+                sess.handleFrame(ev.data);
+            };
+            s(sess);
+        };
+
+        // handle close
+        ws.onclose = function(ev) {
+            if(!finished) {
+                finished = true;
+                f("premature close");
+                return;
+            }
+            sess.handleClose(ev);
+        };
+    });
+};
+
+// handleFrame dispatches a frame received from the server.
+openrepl.Session.prototype.handleFrame = function(dat) {
+    var frame = new Uint8Array(dat);
+    var payload = frame.subarray(1);
+    switch(frame[0]) {
+    case openrepl.frames.stdout:
+    case openrepl.frames.stderr:
+        this.received += payload.length;
+        var txt = this.decoders[frame[0]].decode(payload, {stream: true});
+        var cb = frame[0] == openrepl.frames.stdout ? this.onstdout : this.onstderr;
+        if(cb) cb(txt);
+        break;
+    case openrepl.frames.status:
+        var su = JSON.parse(new TextDecoder().decode(payload));
+        if(su.status == 'participants') this.update(su);
+        if(this.onstatus) this.onstatus(su);
+        break;
+    case openrepl.frames.exit:
+        if(this.onexit) this.onexit(JSON.parse(new TextDecoder().decode(payload)));
+        break;
+    }
+};
+
+// attach connects a terminal to the session.
+// Returns a function which detaches the terminal.
+openrepl.Session.prototype.attach = function(term) {
+    var sess = this;
+    var ondata = function(data) {
+        sess.send(data);
+    };
+    var onresize = function(size) {
+        // only the owner controls the size of the terminal
+        if(sess.role && sess.role != 'owner') return;
+        sess.resize(size.cols, size.rows);
+    };
+    this.onstdout = this.onstderr = function(txt) {
+        term.write(txt);
+    };
+    term.on('data', ondata);
+    term.on('resize', onresize);
+    return function() {
+        sess.onstdout = sess.onstderr = null;
+        term.off('data', ondata);
+        term.off('resize', onresize);
+    };
+};
+
+// openrepl.upload encodes the code of a run session for upload.
+// files is a list of {path, content} objects making up a multi-file project, and entry optionally names the file to run.
+// stdin is optionally written to the program before interactive input, and closeStdin closes its input afterwards.
+// A stdin payload cannot be sent with an archive.
+openrepl.upload = function(opts) {
+    if(opts.archive) return opts.archive;
+    var hasStdin = opts.stdin != null || opts.closeStdin;
+    if(!opts.files && !hasStdin) return opts.code;
+    var manifest = {};
+    if(opts.files) {
+        manifest.files = opts.files;
+        if(opts.entry) manifest.entry = opts.entry;
+    } else {
+        manifest.code = opts.code;
+    }
+    if(opts.stdin != null) manifest.stdin = opts.stdin;
+    if(opts.closeStdin) manifest.closeStdin = true;
+    return JSON.stringify(manifest);
+};
+
+// openrepl.open starts a session using the framed v2 protocol and returns a promise to an openrepl.Session.
+// mode is either 'run' or 'term'.
+// opts may contain size ({cols, rows}) and tty (false to separate stdout and stderr).
+// If opts.record is set, the session is recorded, and when it ends the session receives a status of 'recorded' with the recording key.
+// opts.name optionally sets the display name of the owner in the list of participants.
+// If the server is busy, opts.onqueue is called with the position of the session in the queue whenever it changes.
+// For compiled languages, opts.oncompile is called with the result of compiling the code ({success, exitCode, output, ...}), including when compilation fails.
+// opts.ondiagnostics is called with the errors and warnings reported by the compiler ([{file, line, column, severity, message}]).
+// Diagnostics of a failed run without a TTY are sent to the session afterwards with the 'diagnostics' status.
+// Run sessions also require the code to run, given as one of code (a single file), files (see openrepl.upload) or archive (a tar or zip archive as a Uint8Array).
+// Run sessions may also pass stdin and closeStdin to feed input to the program up front (see openrepl.upload).
+openrepl.open = function(mode, lang, opts) {
+    opts = opts || {};
+    return new Promise(function(s, f) {
+        // build target url
+        var targurl = new URL('/api/exec/' + mode, window.location.href);
+        targurl.searchParams.set('lang', lang);
+        openrepl.setSize(targurl, opts.size);
+        if(opts.tty === false) targurl.searchParams.set('tty', 'false');
+        if(opts.record) targurl.searchParams.set('record', 'true');
+        if(opts.name) targurl.searchParams.set('name', opts.name);
+        openrepl.wsurl(targurl);
+
+        // connect WebSocket
+        var ws = new WebSocket(targurl.toString(), 'openrepl.v2');
+        ws.binaryType = 'arraybuffer';
+        var sess = new openrepl.Session(ws);
+        var finished = false;
+        ws.onopen = function() {
+            if(ws.protocol != 'openrepl.v2') {
+                finished = true;
+                ws.close();
+                f("server does not support protocol v2");
+            }
+        };
+        ws.onerror = function() {
+            if(!finished) {
+                finished = true;
+                f("connection failed");
+            }
+        };
+
+        // run handshake
+        sess.onstatus = function(su) {
+            if(finished) return;
+            sess.update(su);
+            switch(su.status) {
+            case 'queued':
+                // waiting for admission
+                if(opts.onqueue) opts.onqueue(su.position);
+                break;
+            case 'ready':
+                // send code
+                sess.sendFrame(openrepl.frames.code, openrepl.upload(opts));
+                break;
+            case 'diagnostics':
+                // report compiler errors
+                if(opts.ondiagnostics) opts.ondiagnostics(su.diagnostics);
+                break;
+            case 'compiled':
+                // report compiler output
+                if(opts.oncompile) opts.oncompile(su.compile);
+                break;
+            case 'running':
+                // done - pass off session
+                finished = true;
+                sess.onstatus = null;
+                s(sess);
+                break;
+            case 'error':
+                // error - fail
+                finished = true;
+                ws.close();
+                if(su.compile && opts.oncompile) opts.oncompile(su.compile);
+                // include the session ID so that failures can be matched to server logs
+                f(sess.id ? su.err + ' (session ' + sess.id + ')' : su.err);
+                break;
+            }
+        };
+        ws.onmessage = function(ev) {
+            sess.handleFrame(ev.data);
+        };
+
+        // handle close
+        ws.onclose = function(ev) {
+            if(finished) {
+                sess.handleClose(ev);
+                return;
+            }
+            finished = true;
+            f("premature close");
+        };
+    });
+};
+
+// openrepl.join joins a running session with a token from a join link and returns a promise to an openrepl.Session.
+// The token determines whether the participant may type into the session ('writer') or only watch it ('viewer').
+// opts may contain the display name of the participant.
+// The output buffered by the server is replayed after joining.
+openrepl.join = function(token, opts) {
+    opts = opts || {};
+    var sess = new openrepl.Session(null);
+    sess.token = token;
+    sess.name = opts.name || null;
+    return sess.reconnect();
+};
+
+// openrepl.Session.prototype.joinURL returns a link to the current page which joins the session with the given role ('writer' or 'viewer').
+// Only the owner of the session can create join links.
+openrepl.Session.prototype.joinURL = function(role) {
+    var token = role == 'viewer' ? this.viewToken : this.writeToken;
+    if(!token) return null;
+    var targ = new URL(window.location.href);
+    targ.searchParams.delete('key');
+    targ.searchParams.set('join', token);
+    return targ.toString();
+};
+
+// openrepl.Session.prototype.artifactsURL returns the download URL of the files produced by a finished run session.
+// format is either 'zip' (default) or 'tar'.
+openrepl.Session.prototype.artifactsURL = function(format) {
+    var targ = new URL('/api/exec/artifacts', window.location.href);
+    targ.searchParams.set('token', this.token);
+    if(format) targ.searchParams.set('format', format);
+    return targ.toString();
+};
+
+// openrepl.recordingURL returns the download URL of a session recording in the asciicast v2 format.
+openrepl.recordingURL = function(key) {
+    var targ = new URL('/api/store/recording', window.location.href);
+    targ.searchParams.set('key', key);
+    return targ.toString();
+};
+
+// openrepl.replayURL returns the URL of a replay of a session recording, streamed at its original timing.
+// speed optionally speeds up the replay, and if raw is set only the terminal output is streamed.
+openrepl.replayURL = function(key, speed, raw) {
+    var targ = new URL('/api/store/replay', window.location.href);
+    targ.searchParams.set('key', key);
+    if(speed) targ.searchParams.set('speed', speed);
+    if(raw) targ.searchParams.set('format', 'raw');
+    return targ.toString();
+};
+
+// openrepl.signal sends a signal ('SIGINT', 'SIGTERM' or 'SIGKILL') to the program in a session by ID.
+openrepl.signal = function(id, sig) {
+    var xhr = new XMLHttpRequest();
+    var targ = new URL('/api/exec/signal', window.location.href);
+    targ.searchParams.set('id', id);
+    targ.searchParams.set('signal', sig);
+    xhr.open('POST', targ.toString());
+    return new Promise(function(resolve, reject) {
+        xhr.onload = function() {
+            if(xhr.status == 204) {
+                resolve();
+            } else {
+                reject(xhr.statusText);
+            }
+        };
+        xhr.onerror = function(e) {
+            reject(e);
+        };
+        xhr.send();
+    });
+};
+
 openrepl.xhrpromise = function(xhr, body) {
     return new Promise(function(resolve, reject) {
         xhr.onload = function() {
@@ -1,6 +1,41 @@
 M.AutoInit();
 Terminal.applyAddon(fit);
-Terminal.applyAddon(attach);
+// sessions are recorded if the page was opened with the record query parameter
+var recordSessions = new URL(window.location.href).searchParams.has('record');
+// the interactive terminal joins a shared session if the page was opened with a join link
+var joinToken = new URL(window.location.href).searchParams.get('join');
+var participantName = new URL(window.location.href).searchParams.get('name');
+function toastShare(sess) {
+    M.toast({
+        html: 'Share terminal: <a href="' + sess.joinURL('writer') + '">edit link</a>, <a href="' + sess.joinURL('viewer') + '">view link</a>.',
+        displayLength: 30000
+    });
+}
+function toastParticipants(su) {
+    var names = su.participants.map(function(p) {
+        return (p.name || 'anonymous') + ' (' + p.role + ')';
+    });
+    M.toast({html: 'Participants: ' + names.join(', ') + '.'});
+}
+function toastRecording(su) {
+    M.toast({
+        html: '<a href="' + openrepl.recordingURL(su.recording) + '">Download session recording.</a>',
+        displayLength: 30000
+    });
+}
+function toastCompile(res) {
+    if(res.success) {
+        if(res.output) console.log(res.output);
+        return;
+    }
+    var msg = res.timedOut ? 'Compilation timed out.' : res.oomKilled ? 'Compilation ran out of memory.' : 'Compilation failed.';
+    var pre = document.createElement('pre');
+    pre.textContent = res.output;
+    M.toast({
+        html: msg + pre.outerHTML,
+        displayLength: 30000
+    });
+}
 function toastErr(err) {
     M.toast({
         html: err,
@@ -13,28 +48,50 @@ var term1 = new Terminal({
 var term2;
 term1.open(document.getElementById("terminal"));
 var t1pre = document.getElementById('tpre');
-var t1ws;
+var t1sess;
+var t1detach;
 var t1c = true;
-function updateT1WS(ws) {
-    t1ws = ws;
+function updateT1Session(sess) {
+    t1sess = sess;
     t1c = false;
-    ws.onclose = function() {
+    sess.onclose = function() {
         toastErr('Interactive terminal disconnected.');
-        term1.detach(ws);
+        t1detach();
         t1c = true;
     };
-    term1.attach(ws, true, true);
+    t1detach = sess.attach(term1);
+    sess.onstatus = function(su) {
+        if(su.status == 'warning') toastErr('Interactive terminal: ' + su.msg + '.');
+        if(su.status == 'recorded') toastRecording(su);
+        if(su.status == 'participants') toastParticipants(su);
+    };
+    if(sess.role == 'owner') toastShare(sess);
 }
 function loadTerm1(lang) {
     t1pre.classList.remove('invisible');
     if(!t1c) {
-        t1ws.onclose = function() {};
-        term1.detach(t1ws);
-        t1ws.close();
+        t1sess.onclose = null;
+        t1detach();
+        t1sess.close();
     }
     term1.reset();
-    openrepl.term(lang).then((ws) => {
-        updateT1WS(ws);
+    var p;
+    if(joinToken) {
+        // join the shared session once
+        p = openrepl.join(joinToken, {name: participantName});
+        joinToken = null;
+    } else {
+        p = openrepl.open('term', lang, {
+            size: {cols: term1.cols, rows: term1.rows},
+            record: recordSessions,
+            name: participantName,
+            onqueue: function(pos) {
+                toastErr('Server busy: interactive terminal is number ' + pos + ' in the queue.');
+            }
+        });
+    }
+    p.then((sess) => {
+        updateT1Session(sess);
         t1pre.classList.add('invisible');
     }, (e) => {
         toastErr('Failed to load repl terminal.');
@@ -55,6 +112,34 @@ editor.setOptions({
     copyWithEmptySelection: true,
     fadeFoldWidgets: true
 });
+// the code in the editor is uploaded as a file named code, which run scripts may copy (e.g. to /tmp/code.go or /tmp/script.ts)
+function isEditorFile(file) {
+    return /^(code|script)(\.\w+)?$/.test(file.split('/').pop());
+}
+var diagnosticMarkers = [];
+function clearDiagnostics() {
+    var session = editor.getSession();
+    diagnosticMarkers.forEach(function(id) {
+        session.removeMarker(id);
+    });
+    diagnosticMarkers = [];
+    session.clearAnnotations();
+}
+// showDiagnostics underlines errors and warnings in the editor, with the message shown in the gutter
+function showDiagnostics(diags) {
+    clearDiagnostics();
+    var session = editor.getSession();
+    var Range = ace.require('ace/range').Range;
+    session.setAnnotations(diags.filter(function(d) {
+        return isEditorFile(d.file);
+    }).map(function(d) {
+        var row = d.line - 1;
+        var col = d.column ? d.column - 1 : 0;
+        var range = new Range(row, col, row, Math.max(session.getLine(row).length, col + 1));
+        diagnosticMarkers.push(session.addMarker(range, 'diagnostic-' + d.severity, 'text'));
+        return {row: row, column: col, text: d.message, type: d.severity == 'note' ? 'info' : d.severity};
+    }));
+}
 editor.commands.addCommand({
     name: 'save',
     bindKey: {
@@ -110,30 +195,61 @@ function setLanguage(lang) {
     loadTerm1(lang);
     language = lang;
 }
-var t2ws;
-var t2c = true;
+var t2sess;
+function exitMessage(su) {
+    switch(su.reason) {
+    case 'success':
+        return 'Run finished.';
+    case 'oom':
+        return 'Run killed: out of memory.';
+    case 'timeout':
+        return 'Run killed: timed out.';
+    case 'signal':
+        return 'Run killed by signal (exit code ' + su.code + ').';
+    default:
+        return 'Run failed with exit code ' + su.code + '.';
+    }
+}
 var closecancel;
 stopbtn.onclick = function() {
     stopbtn.classList.add('disabled');
     closecancel = true;
-    t2ws.close();
+    t2sess.signal('SIGKILL');
 };
 runbtn.onclick = function() {
     if(runbtn.classList.contains('disabled')) return;
     closecancel = false;
     runbtn.classList.add("disabled");
+    clearDiagnostics();
     if(term2) {
         term2.reset();
     }
-    openrepl.run(editor.getValue(), language).then(function(ws) {
-        ws.onclose = function() {
-            term2.detach(ws);
+    var size = term2 ? {cols: term2.cols, rows: term2.rows} : null;
+    openrepl.open('run', language, {
+        code: editor.getValue(),
+        size: size,
+        record: recordSessions,
+        onqueue: function(pos) {
+            M.toast({html: 'Server busy: run is number ' + pos + ' in the queue.'});
+        },
+        oncompile: toastCompile,
+        ondiagnostics: showDiagnostics
+    }).then(function(sess) {
+        var exit;
+        var detach;
+        sess.onclose = function() {
+            detach();
             runbtn.classList.remove("disabled");
             runbtn.classList.remove('invisible');
             stopbtn.classList.add('invisible');
             stopbtn.classList.remove("disabled");
             if(closecancel) {
                 toastErr('Sucessfully stopped run.');
+            } else if(exit) {
+                M.toast({html: exitMessage(exit)});
+                if(exit.artifacts) {
+                    M.toast({html: '<a href="' + sess.artifactsURL() + '">Download ' + exit.artifacts + ' output file(s).</a>'});
+                }
             } else {
                 M.toast({html: 'Run finished.'});
             }
@@ -141,7 +257,7 @@ runbtn.onclick = function() {
         runbtn.classList.add('invisible');
         stopbtn.classList.remove('invisible');
         termdiv.style.visibility = "visible";
-        t2ws = ws;
+        t2sess = sess;
         if(!term2) {
             term2 = new Terminal({
                 cursorBlink: true
@@ -149,7 +265,16 @@ runbtn.onclick = function() {
             term2.open(document.getElementById("term2"));
             window.onresize();
         }
-        term2.attach(ws);
+        detach = sess.attach(term2);
+        sess.onstatus = function(su) {
+            if(su.status == 'warning') toastErr('Run ' + su.msg + '.');
+            if(su.status == 'recorded') toastRecording(su);
+            if(su.status == 'diagnostics') showDiagnostics(su.diagnostics);
+        };
+        sess.onexit = function(su) {
+            exit = su;
+        };
+        if(!size) sess.resize(term2.cols, term2.rows);
     }, function(e) {
         toastErr('Failed to load run session.');
         console.log(e);